@@ -0,0 +1,106 @@
+package cel
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+type backendTrackerKey struct{}
+
+// backendTracker counts the backends of a request returning a complete response. KrakenD merges
+// the responses of the backends without keeping track of their individual results, so the
+// backends built by the BackendFactory report them through the context of the request
+type backendTracker struct {
+	completed int64
+}
+
+func withBackendTracker(ctx context.Context) (context.Context, *backendTracker) {
+	t := &backendTracker{}
+	return context.WithValue(ctx, backendTrackerKey{}, t), t
+}
+
+func (t *backendTracker) count() int {
+	return int(atomic.LoadInt64(&t.completed))
+}
+
+// trackBackend reports the complete responses of the backend to the tracker of the request, if any
+func trackBackend(next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		resp, err := next(ctx, r)
+		if t, ok := ctx.Value(backendTrackerKey{}).(*backendTracker); ok && err == nil && resp != nil && resp.IsComplete {
+			atomic.AddInt64(&t.completed, 1)
+		}
+		return resp, err
+	}
+}
+
+type sequenceKey struct{}
+
+// sequence keeps the data of the complete responses of the backends of a sequential endpoint, in
+// the order they arrive. KrakenD only forwards the fields referenced by the url patterns of the
+// next backends (as the RespN_field params), so the backends built by the BackendFactory record
+// their whole responses through the context of the request
+type sequence struct {
+	mu    sync.Mutex
+	parts []map[string]interface{}
+}
+
+// data returns the data of the recorded responses merged in order, so the later responses
+// override the keys of the previous ones. It returns an empty map when the request has no sequence
+func (s *sequence) data() map[string]interface{} {
+	res := map[string]interface{}{}
+	if s == nil {
+		return res
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, part := range s.parts {
+		for k, v := range part {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func sequenceFrom(ctx context.Context) *sequence {
+	s, _ := ctx.Value(sequenceKey{}).(*sequence)
+	return s
+}
+
+// isSequential returns true if KrakenD calls the backends of the endpoint one after the other
+func isSequential(cfg *config.EndpointConfig) bool {
+	if len(cfg.Backend) < 2 {
+		return false
+	}
+	e, ok := cfg.ExtraConfig[proxy.Namespace].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	v, ok := e["sequential"].(bool)
+	return ok && v
+}
+
+// withSequence starts a new sequence for each request of the endpoint
+func withSequence(next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		return next(context.WithValue(ctx, sequenceKey{}, &sequence{}), r)
+	}
+}
+
+// sequenceBackend records the complete responses of the backend in the sequence of the request,
+// if any
+func sequenceBackend(next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		resp, err := next(ctx, r)
+		if s := sequenceFrom(ctx); s != nil && err == nil && resp != nil && resp.IsComplete {
+			s.mu.Lock()
+			s.parts = append(s.parts, resp.Data)
+			s.mu.Unlock()
+		}
+		return resp, err
+	}
+}
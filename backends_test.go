@@ -0,0 +1,205 @@
+package cel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestProxyFactory_backendsCompleted(t *testing.T) {
+	failing := errors.New("backend failure")
+	backendFactory := BackendFactory(logging.NoOp, func(cfg *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			if cfg.URLPattern == "/broken" {
+				return nil, failing
+			}
+			return &proxy.Response{Data: map[string]interface{}{cfg.URLPattern: true}, IsComplete: true}, nil
+		}
+	})
+
+	for _, tc := range []struct {
+		name     string
+		backends []string
+		expr     string
+		err      bool
+	}{
+		{name: "complete", backends: []string{"/a", "/b"}, expr: "resp_backends_completed == resp_backends"},
+		{name: "partial", backends: []string{"/a", "/broken"}, expr: "resp_backends_completed == resp_backends", err: true},
+		{name: "tolerated", backends: []string{"/a", "/broken"}, expr: "resp_backends_completed > 0 && resp_backends == 2"},
+	} {
+		cfg := &config.EndpointConfig{
+			Endpoint: "/",
+			Timeout:  time.Second,
+			ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{
+				"definitions": []internal.InterpretableDefinition{{CheckExpression: tc.expr}},
+			}},
+		}
+		for _, b := range tc.backends {
+			cfg.Backend = append(cfg.Backend, &config.Backend{URLPattern: b})
+		}
+
+		prxy, err := ProxyFactory(logging.NoOp, proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+			backends := make([]proxy.Proxy, len(cfg.Backend))
+			for i, b := range cfg.Backend {
+				backends[i] = backendFactory(b)
+			}
+			return proxy.NewMergeDataMiddleware(cfg)(backends...), nil
+		})).New(cfg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/"})
+		if tc.err {
+			if _, ok := err.(CheckError); !ok {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			if resp != nil {
+				t.Errorf("%s: unexpected response: %v", tc.name, resp)
+			}
+			continue
+		}
+		if resp == nil || resp.Data["/a"] != true {
+			t.Errorf("%s: unexpected response: %v", tc.name, resp)
+		}
+		if len(tc.backends) != len(resp.Data) && err == nil {
+			t.Errorf("%s: the merge error was not returned", tc.name)
+		}
+	}
+}
+
+func TestProxyFactory_rejectIncomplete(t *testing.T) {
+	failing := errors.New("backend failure")
+	backendFactory := func(cfg *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			switch cfg.URLPattern {
+			case "/broken":
+				return nil, failing
+			case "/truncated":
+				return &proxy.Response{Data: map[string]interface{}{}, IsComplete: false}, nil
+			}
+			return &proxy.Response{Data: map[string]interface{}{cfg.URLPattern: true}, IsComplete: true}, nil
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		backends []string
+		enabled  bool
+		err      bool
+	}{
+		{name: "complete", backends: []string{"/a", "/b"}, enabled: true},
+		{name: "partial", backends: []string{"/a", "/broken"}, enabled: true, err: true},
+		{name: "truncated", backends: []string{"/truncated"}, enabled: true, err: true},
+		{name: "disabled", backends: []string{"/truncated"}},
+	} {
+		cfg := &config.EndpointConfig{
+			Endpoint: "/",
+			Timeout:  time.Second,
+			ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{
+				"reject_incomplete": tc.enabled,
+				"definitions":       []internal.InterpretableDefinition{{CheckExpression: "size(resp_data) >= 0"}},
+			}},
+		}
+		for _, b := range tc.backends {
+			cfg.Backend = append(cfg.Backend, &config.Backend{URLPattern: b})
+		}
+
+		prxy, err := ProxyFactory(logging.NoOp, proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+			backends := make([]proxy.Proxy, len(cfg.Backend))
+			for i, b := range cfg.Backend {
+				backends[i] = backendFactory(b)
+			}
+			return proxy.NewMergeDataMiddleware(cfg)(backends...), nil
+		})).New(cfg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/"})
+		if tc.err {
+			if cErr, ok := err.(CheckError); !ok || cErr.Index != -1 || cErr.Phase != internal.PhasePost {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			if resp != nil {
+				t.Errorf("%s: unexpected response: %v", tc.name, resp)
+			}
+			continue
+		}
+		if err != nil || resp == nil {
+			t.Errorf("%s: unexpected result: %v %v", tc.name, err, resp)
+		}
+	}
+}
+
+func TestProxyFactory_prevResp(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		sequential bool
+		status     string
+		expr       string
+		orders     bool
+	}{
+		{name: "active", sequential: true, status: "active", expr: "req_prev_resp.status == 'active'", orders: true},
+		{name: "inactive", sequential: true, status: "blocked", expr: "req_prev_resp.status == 'active'"},
+		{name: "parallel", status: "active", expr: "req_prev_resp.status == 'active'"},
+		{name: "parallel and empty", status: "active", expr: "size(req_prev_resp) == 0", orders: true},
+	} {
+		status := tc.status
+		backendFactory := BackendFactory(logging.NoOp, func(cfg *config.Backend) proxy.Proxy {
+			return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+				if cfg.URLPattern == "/orders" {
+					return &proxy.Response{Data: map[string]interface{}{"orders": []interface{}{1, 2}}, IsComplete: true}, nil
+				}
+				return &proxy.Response{Data: map[string]interface{}{"status": status}, IsComplete: true}, nil
+			}
+		})
+
+		cfg := &config.EndpointConfig{
+			Endpoint: "/",
+			Timeout:  time.Second,
+			Backend: []*config.Backend{
+				{URLPattern: "/account"},
+				{URLPattern: "/orders", ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+					{CheckExpression: tc.expr},
+				}}},
+			},
+			ExtraConfig: config.ExtraConfig{proxy.Namespace: map[string]interface{}{"sequential": tc.sequential}},
+		}
+
+		prxy, err := ProxyFactory(logging.NoOp, proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+			backends := make([]proxy.Proxy, len(cfg.Backend))
+			for i, b := range cfg.Backend {
+				backends[i] = backendFactory(b)
+			}
+			return proxy.NewMergeDataMiddleware(cfg)(backends...), nil
+		})).New(cfg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/", Params: map[string]string{}})
+		if resp == nil || resp.Data["status"] != tc.status {
+			t.Errorf("%s: unexpected response: %v", tc.name, resp)
+			continue
+		}
+		if _, ok := resp.Data["orders"]; ok != tc.orders {
+			t.Errorf("%s: unexpected orders: %v", tc.name, resp.Data)
+		}
+		if tc.orders && err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+		}
+		if !tc.orders && err == nil {
+			t.Errorf("%s: the rejection of the orders was not returned", tc.name)
+		}
+	}
+}
@@ -0,0 +1,506 @@
+package cel
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	contentTypeHeader     = "Content-Type"
+	contentTypeJson       = "application/json"
+	contentTypeForm       = "multipart/form-data"
+	contentTypeURLEncoded = "application/x-www-form-urlencoded"
+	contentTypeXML        = "application/xml"
+	contentTypeTextXML    = "text/xml"
+	contentTypeYAML       = "application/yaml"
+
+	contentEncodingHeader = "Content-Encoding"
+	contentLengthHeader   = "Content-Length"
+)
+
+const (
+	defaultMaxBodySize         = 8 * 1024 * 1024
+	defaultMaxDecompressedSize = 8 * 1024 * 1024
+	defaultMultipartMaxMemory  = 32 * 1024 * 1024
+	defaultMaxBodyB64Size      = 64 * 1024
+)
+
+var (
+	errBodyTooLarge      = errors.New("body too large")
+	errMultipartTooLarge = errors.New("multipart values too large")
+)
+
+func newBodyParser(cfg internal.Config) bodyParser {
+	p := bodyParser{
+		maxBodySize:         defaultMaxBodySize,
+		maxDecompressedSize: defaultMaxDecompressedSize,
+		multipartMaxMemory:  defaultMultipartMaxMemory,
+		maxBodyB64Size:      defaultMaxBodyB64Size,
+	}
+	if cfg.MaxBodySize > 0 {
+		p.maxBodySize = cfg.MaxBodySize
+	}
+	if cfg.MaxDecompressedSize > 0 {
+		p.maxDecompressedSize = cfg.MaxDecompressedSize
+	}
+	if cfg.MultipartMaxMemory > 0 {
+		p.multipartMaxMemory = cfg.MultipartMaxMemory
+	}
+	if cfg.MaxBodyB64Size > 0 {
+		p.maxBodyB64Size = cfg.MaxBodyB64Size
+	}
+	return p
+}
+
+// bodyParser decodes the supported request bodies
+type bodyParser struct {
+	maxBodySize         int64
+	maxDecompressedSize int64
+	multipartMaxMemory  int64
+	maxBodyB64Size      int64
+}
+
+// decode returns the content of the body bytes, following the content type of the request
+func (p bodyParser) decode(l logging.Logger, r *proxy.Request, bodyBytes []byte) map[string]interface{} {
+	bodyData := make(map[string]interface{})
+	if len(r.Headers[contentTypeHeader]) == 0 {
+		return nil
+	}
+	if isBinary(r.Headers[contentTypeHeader][0]) {
+		return nil
+	}
+	//fmt.Printf("BODY BYTES: %v\n", string(bodyBytes))
+	bodyBytes, ok := p.decompressed(l, r, bodyBytes)
+	if !ok {
+		return nil
+	}
+
+	switch bodyFormat(r.Headers[contentTypeHeader][0]) {
+	case contentTypeJson:
+		if err := json.Unmarshal(bodyBytes, &bodyData); err != nil {
+			l.Error("Unmarshal body: %v", err.Error())
+			return nil
+		}
+	case contentTypeForm:
+		values, _, err := readMultipart(r.Headers[contentTypeHeader][0], bodyBytes, p.multipartMaxMemory)
+		if err == errMultipartTooLarge {
+			l.Warning("CEL: the multipart values exceed the limit of", p.multipartMaxMemory, "bytes")
+			return nil
+		}
+		if err != nil {
+			l.Error("ParseForm: %v", err.Error())
+			return nil
+		}
+		bodyData = values
+	case contentTypeXML:
+		doc, err := decodeXML(bytes.NewReader(bodyBytes))
+		if err != nil {
+			l.Error("CEL: decoding the xml body:", err.Error())
+			return nil
+		}
+		bodyData = doc
+	case contentTypeYAML:
+		doc, err := decodeYAML(bodyBytes)
+		if err != nil {
+			l.Error("CEL: decoding the yaml body:", err.Error())
+			return nil
+		}
+		bodyData = doc
+	case contentTypeURLEncoded:
+		values, err := url.ParseQuery(string(bodyBytes))
+		if err != nil {
+			l.Error("CEL: parsing the urlencoded body:", err.Error())
+			return nil
+		}
+		// single-valued keys are flattened; repeated keys keep the list of values
+		for key, vs := range values {
+			switch len(vs) {
+			case 0:
+			case 1:
+				bodyData[key] = vs[0]
+			default:
+				bodyData[key] = vs
+			}
+		}
+	}
+	return bodyData
+}
+
+// bodyFormat returns the format of the body declared by the content type: contentTypeJson,
+// contentTypeForm, contentTypeXML, contentTypeYAML, contentTypeURLEncoded or an empty string when
+// it is not supported. The parameters, like the charset, are ignored and the media types with a
+// structured syntax suffix (RFC 6839), like application/vnd.api+json or application/atom+xml, have
+// the format of their suffix
+func bodyFormat(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if mt == "" && err != nil {
+		return ""
+	}
+	switch {
+	case mt == contentTypeJson || strings.HasSuffix(mt, "+json"):
+		return contentTypeJson
+	case mt == contentTypeXML || mt == contentTypeTextXML || strings.HasSuffix(mt, "+xml"):
+		return contentTypeXML
+	case yamlMediaTypes[mt] || strings.HasSuffix(mt, "+yaml"):
+		return contentTypeYAML
+	case mt == contentTypeForm, mt == contentTypeURLEncoded:
+		return mt
+	}
+	return ""
+}
+
+// binaryMediaTypes are the media types of the binary bodies besides the image, audio, video and
+// font ones, never decoded since any text parsing would fail or mangle them
+var binaryMediaTypes = map[string]bool{
+	"application/octet-stream":        true,
+	"application/protobuf":            true,
+	"application/x-protobuf":          true,
+	"application/vnd.google.protobuf": true,
+	"application/grpc":                true,
+	"application/pdf":                 true,
+	"application/zip":                 true,
+	"application/gzip":                true,
+	"application/x-tar":               true,
+	"application/wasm":                true,
+	"application/cbor":                true,
+	"application/msgpack":             true,
+	"application/x-msgpack":           true,
+}
+
+// isBinary checks if the content type declares a binary body, ignoring its parameters
+func isBinary(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if mt == "" && err != nil {
+		return false
+	}
+	if binaryMediaTypes[mt] || strings.HasPrefix(mt, "application/grpc+") {
+		return true
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/", "font/"} {
+		if strings.HasPrefix(mt, prefix) && !strings.HasSuffix(mt, "+xml") {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeB64 returns the base64 encoding of the body bytes, truncated to the first maxBodyB64Size
+// bytes, so the magic bytes of the big bodies can still be checked
+func (p bodyParser) encodeB64(bodyBytes []byte) string {
+	if int64(len(bodyBytes)) > p.maxBodyB64Size {
+		bodyBytes = bodyBytes[:p.maxBodyB64Size]
+	}
+	return base64.StdEncoding.EncodeToString(bodyBytes)
+}
+
+// read returns the bytes of the body, as received, and restores it so the next stages can consume
+// it, along with the size of the body. The bodies exceeding the size limit are not returned and
+// their size is reported as the limit plus one byte
+func (p bodyParser) read(l logging.Logger, r *proxy.Request) ([]byte, int64, bool) {
+	if r.Body == nil {
+		return nil, 0, false
+	}
+	bodyBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, p.maxBodySize+1))
+	if err != nil {
+		l.Error("Read body: %v", err.Error())
+		return nil, 0, false
+	}
+	if int64(len(bodyBytes)) > p.maxBodySize {
+		// the body is not consumed, so the next stages receive the bytes already read followed by
+		// the rest of the original body
+		r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(bodyBytes), r.Body), Closer: r.Body}
+		l.Warning("CEL: the body exceeds the limit of", p.maxBodySize, "bytes")
+		return nil, p.maxBodySize + 1, false
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+	if len(bodyBytes) == 0 {
+		if n, err := strconv.ParseInt(firstHeaderEntry(r.Headers, contentLengthHeader), 10, 64); err == nil && n > 0 {
+			// the body was read by a previous stage without restoring it, so its content is lost
+			l.Warning("CEL: the body is empty but its Content-Length is", n, "bytes: a previous middleware consumed it without restoring it")
+			return nil, 0, false
+		}
+	}
+	return bodyBytes, int64(len(bodyBytes)), true
+}
+
+// decodeFiles returns the metadata of the files uploaded with a multipart body, grouped by the
+// name of their form field
+func (p bodyParser) decodeFiles(l logging.Logger, r *proxy.Request, bodyBytes []byte) map[string]interface{} {
+	if len(r.Headers[contentTypeHeader]) == 0 || bodyFormat(r.Headers[contentTypeHeader][0]) != contentTypeForm {
+		return nil
+	}
+	bodyBytes, ok := p.decompressed(l, r, bodyBytes)
+	if !ok {
+		return nil
+	}
+	_, files, err := readMultipart(r.Headers[contentTypeHeader][0], bodyBytes, p.multipartMaxMemory)
+	if err != nil {
+		l.Error("CEL: parsing the multipart body:", err.Error())
+		return nil
+	}
+	return files
+}
+
+// decompressed returns the body bytes decompressed following the content encoding of the request.
+// The original bytes are the ones restored, so the compressed body reaches the backend
+func (p bodyParser) decompressed(l logging.Logger, r *proxy.Request, bodyBytes []byte) ([]byte, bool) {
+	encoding := headerValues(r.Headers, contentEncodingHeader)
+	if len(encoding) == 0 {
+		return bodyBytes, true
+	}
+	bodyBytes, err := p.decompress(encoding[0], bodyBytes)
+	if err == errBodyTooLarge {
+		l.Warning("CEL: the decompressed body exceeds the limit of", p.maxDecompressedSize, "bytes")
+		return nil, false
+	}
+	if err != nil {
+		l.Error("CEL: decompressing the body:", err.Error())
+		return nil, false
+	}
+	return bodyBytes, true
+}
+
+// readMultipart returns the first value of every form field and the metadata of the uploaded files
+// (filename, size and declared content type). The parts are streamed from the body bytes, already
+// in memory, so the files are neither copied nor stored in temporary files. The values of the
+// fields are copied, so their total size is limited to maxMemory bytes
+func readMultipart(contentType string, b []byte, maxMemory int64) (map[string]interface{}, map[string]interface{}, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if params["boundary"] == "" {
+		return nil, nil, http.ErrMissingBoundary
+	}
+
+	values := map[string]interface{}{}
+	files := map[string]interface{}{}
+	mr := multipart.NewReader(bytes.NewReader(b), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return values, files, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if filename := part.FileName(); filename != "" {
+			size, err := io.Copy(ioutil.Discard, part)
+			if err != nil {
+				return nil, nil, err
+			}
+			fs, _ := files[name].([]interface{})
+			files[name] = append(fs, map[string]interface{}{
+				"filename":     filename,
+				"size":         size,
+				"content_type": part.Header.Get(contentTypeHeader),
+			})
+			continue
+		}
+
+		v, err := ioutil.ReadAll(io.LimitReader(part, maxMemory+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if maxMemory -= int64(len(v)); maxMemory < 0 {
+			return nil, nil, errMultipartTooLarge
+		}
+		if _, ok := values[name]; !ok {
+			values[name] = string(v)
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decompress inflates the gzip and deflate contents, failing as soon as the decompressed
+// content exceeds the limit. Other encodings are returned as received.
+func (p bodyParser) decompress(encoding string, b []byte) ([]byte, error) {
+	var rd io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		rd = gz
+	case "deflate":
+		// the deflate content-coding is a zlib stream, but some clients send raw deflate data
+		zr, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			fr := flate.NewReader(bytes.NewReader(b))
+			defer fr.Close()
+			rd = fr
+			break
+		}
+		defer zr.Close()
+		rd = zr
+	default:
+		return b, nil
+	}
+
+	res, err := ioutil.ReadAll(io.LimitReader(rd, p.maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(res)) > p.maxDecompressedSize {
+		return nil, errBodyTooLarge
+	}
+	return res, nil
+}
+
+// decodeXML converts an XML document into a map with a single key, the name of the root element.
+// Every element is converted following these rules:
+//   - elements without attributes nor children are converted into their text content
+//   - the rest of elements are converted into maps where the attributes are stored under their
+//     names prefixed with '@', the children under their names and the text content, if any,
+//     under the '#text' key
+//   - repeated children are grouped into a list, in document order
+//
+// Namespace prefixes are dropped, so <ns:order> is exposed as 'order'.
+func decodeXML(r io.Reader) (map[string]interface{}, error) {
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := t.(xml.StartElement); ok {
+			v, err := decodeXMLElement(d, start)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{start.Name.Local: v}, nil
+		}
+	}
+}
+
+func decodeXMLElement(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	res := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		res["@"+attr.Name.Local] = attr.Value
+	}
+	text := ""
+
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := t.(type) {
+		case xml.StartElement:
+			v, err := decodeXMLElement(d, tok)
+			if err != nil {
+				return nil, err
+			}
+			name := tok.Name.Local
+			switch prev := res[name].(type) {
+			case nil:
+				res[name] = v
+			case []interface{}:
+				res[name] = append(prev, v)
+			default:
+				res[name] = []interface{}{prev, v}
+			}
+		case xml.CharData:
+			text += string(tok)
+		case xml.EndElement:
+			text = strings.TrimSpace(text)
+			if len(res) == 0 {
+				return text, nil
+			}
+			if text != "" {
+				res["#text"] = text
+			}
+			return res, nil
+		}
+	}
+}
+
+// yamlMediaTypes are the media types of the YAML documents, since none was registered until the
+// RFC 9512 and the unofficial ones are still common
+var yamlMediaTypes = map[string]bool{
+	contentTypeYAML:      true,
+	"application/x-yaml": true,
+	"text/yaml":          true,
+	"text/x-yaml":        true,
+}
+
+var errYAMLNotMap = errors.New("the document is not a map")
+
+// decodeYAML converts the first document of the YAML stream into a map, like the JSON ones: the
+// keys of the maps are converted into strings (so 1 becomes "1" and true becomes "true") and the
+// numbers into doubles
+func decodeYAML(b []byte) (map[string]interface{}, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return map[string]interface{}{}, nil
+	}
+	res, ok := convertYAML(doc).(map[string]interface{})
+	if !ok {
+		return nil, errYAMLNotMap
+	}
+	return res, nil
+}
+
+func convertYAML(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			key := ""
+			if k != nil {
+				key = fmt.Sprint(k)
+			}
+			res[key] = convertYAML(e)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, e := range val {
+			res[i] = convertYAML(e)
+		}
+		return res
+	case int:
+		return float64(val)
+	case int64:
+		return float64(val)
+	case uint64:
+		return float64(val)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,857 @@
+package cel
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestProxyFactory_reqBody_urlencoded(t *testing.T) {
+	body := "name=John%20Doe&email=john%40example.com&role=admin&role=editor&empty="
+
+	prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_body.name == 'John Doe' && req_body.email == 'john@example.com'"},
+				{CheckExpression: "size(req_body.role) == 2 && 'editor' in req_body.role"},
+				{CheckExpression: "req_body.empty == ''"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := prxy(context.Background(), &proxy.Request{
+		Method:  "POST",
+		Path:    "/some-path",
+		Headers: map[string][]string{"Content-Type": {"application/x-www-form-urlencoded; charset=utf-8"}},
+		Body:    ioutil.NopCloser(strings.NewReader(body)),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if resp.Data["body"] != body {
+		t.Errorf("the body was not restored: %v", resp.Data["body"])
+	}
+}
+
+func TestProxyFactory_reqBody_jsonMediaTypes(t *testing.T) {
+	body := `{"data": {"type": "users", "id": "42"}}`
+
+	prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_body.data.type == 'users' && req_body.data.id == '42'"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, ct := range []string{
+		"application/json",
+		"application/json; charset=utf-8",
+		"Application/JSON;charset=UTF-8",
+		"application/vnd.api+json",
+		"application/problem+json; charset=utf-8",
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Content-Type": {ct}},
+			Body:    ioutil.NopCloser(strings.NewReader(body)),
+		})
+		if err != nil {
+			t.Errorf("%s: %s", ct, err.Error())
+			continue
+		}
+		if resp.Data["body"] != body {
+			t.Errorf("%s: the body was not restored: %v", ct, resp.Data["body"])
+		}
+	}
+}
+
+func TestBodyFormat(t *testing.T) {
+	for ct, expected := range map[string]string{
+		"application/json":                          contentTypeJson,
+		"application/json; charset=utf-8":           contentTypeJson,
+		"application/vnd.api+json":                  contentTypeJson,
+		"application/merge-patch+json":              contentTypeJson,
+		"application/xml":                           contentTypeXML,
+		"text/xml; charset=utf-8":                   contentTypeXML,
+		"application/atom+xml":                      contentTypeXML,
+		"application/yaml":                          contentTypeYAML,
+		"application/x-yaml":                        contentTypeYAML,
+		"text/yaml; charset=utf-8":                  contentTypeYAML,
+		"text/x-yaml":                               contentTypeYAML,
+		"application/openapi+yaml":                  contentTypeYAML,
+		"multipart/form-data; boundary=xyz":         contentTypeForm,
+		"application/x-www-form-urlencoded":         contentTypeURLEncoded,
+		"application/x-www-form-urlencoded;charset": contentTypeURLEncoded,
+		"application/jsonp":                         "",
+		"text/plain; note=application/json":         "",
+		"application/octet-stream":                  "",
+		"":                                          "",
+	} {
+		if res := bodyFormat(ct); res != expected {
+			t.Errorf("%s: unexpected format '%s'", ct, res)
+		}
+	}
+}
+
+func TestProxyFactory_reqBody_xml(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<order id="42" xmlns:x="urn:x">
+	<x:customer>alice</x:customer>
+	<item sku="A1">first</item>
+	<item sku="B2">second</item>
+	<total currency="EUR">10.5</total>
+</order>`
+
+	prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_body.order['@id'] == '42' && req_body.order.customer == 'alice'"},
+				{CheckExpression: "size(req_body.order.item) == 2 && req_body.order.item[1]['@sku'] == 'B2'"},
+				{CheckExpression: "double(req_body.order.total['#text']) > 10.0"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, ct := range []string{"application/xml", "text/xml; charset=utf-8"} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Content-Type": {ct}},
+			Body:    ioutil.NopCloser(strings.NewReader(body)),
+		})
+		if err != nil {
+			t.Errorf("%s: %s", ct, err.Error())
+			continue
+		}
+		if resp.Data["body"] != body {
+			t.Errorf("%s: the body was not restored: %v", ct, resp.Data["body"])
+		}
+	}
+}
+
+func TestProxyFactory_reqBody_yaml(t *testing.T) {
+	body := `order:
+  id: 42
+  customer: alice
+  items:
+    - sku: A1
+      tags: [new, promo]
+    - sku: B2
+  paid: true
+`
+
+	prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_body.order.id == 42.0 && req_body.order.customer == 'alice' && req_body.order.paid"},
+				{CheckExpression: "size(req_body.order.items) == 2 && req_body.order.items[1].sku == 'B2'"},
+				{CheckExpression: "'promo' in req_body.order.items[0].tags"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, ct := range []string{"application/yaml", "text/yaml; charset=utf-8", "application/x-yaml"} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Content-Type": {ct}},
+			Body:    ioutil.NopCloser(strings.NewReader(body)),
+		})
+		if err != nil {
+			t.Errorf("%s: %s", ct, err.Error())
+			continue
+		}
+		if resp.Data["body"] != body {
+			t.Errorf("%s: the body was not restored: %v", ct, resp.Data["body"])
+		}
+	}
+}
+
+func TestProxyFactory_reqBody_schema(t *testing.T) {
+	prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"schemas": map[string]interface{}{
+					"order": map[string]interface{}{
+						"type":     "object",
+						"required": []string{"id", "items"},
+						"properties": map[string]interface{}{
+							"id":    map[string]interface{}{"type": "integer"},
+							"items": map[string]interface{}{"type": "array", "minItems": 1},
+						},
+					},
+				},
+				"definitions": []internal.InterpretableDefinition{
+					{CheckExpression: "matchesSchema(req_body, 'order')", RejectMessage: "invalid order"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		body  string
+		valid bool
+	}{
+		{body: `{"id": 42, "items": ["A1"]}`, valid: true},
+		{body: `{"id": 4.2, "items": ["A1"]}`},
+		{body: `{"id": 42, "items": []}`},
+		{body: `{"items": ["A1"]}`},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Content-Type": {"application/json"}},
+			Body:    ioutil.NopCloser(strings.NewReader(tc.body)),
+		})
+		if !tc.valid {
+			if err == nil || err.Error() != "invalid order" {
+				t.Errorf("%s: unexpected error: %v", tc.body, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.body, err.Error())
+			continue
+		}
+		if resp.Data["body"] != tc.body {
+			t.Errorf("%s: the body was not restored: %v", tc.body, resp.Data["body"])
+		}
+	}
+}
+
+func TestProxyFactory_reqBodyRaw_signature(t *testing.T) {
+	body := `{"event":"push","ref":"refs/heads/master"}`
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "secureCompare('sha256=' + hmacSHA256('secret', req_body_raw), header(req_headers, 'X-Signature'))"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		signature string
+		success   bool
+	}{
+		{signature: signature, success: true},
+		{signature: "sha256=" + strings.Repeat("0", 64), success: false},
+		{signature: "", success: false},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Content-Type": {"application/json"}, "X-Signature": {tc.signature}},
+			Body:    ioutil.NopCloser(strings.NewReader(body)),
+		})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.signature)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.signature, err.Error())
+			continue
+		}
+		if resp.Data["body"] != body {
+			t.Errorf("the body was not restored: %v", resp.Data["body"])
+		}
+	}
+}
+
+func TestDecodeXML(t *testing.T) {
+	doc, err := decodeXML(strings.NewReader(`<a><b>1</b><c x="y">2</c><d/></a>`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": "1",
+			"c": map[string]interface{}{"@x": "y", "#text": "2"},
+			"d": "",
+		},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("unexpected document: %+v", doc)
+	}
+
+	if _, err := decodeXML(strings.NewReader(`<a><b></a>`)); err == nil {
+		t.Error("expecting error")
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	doc, err := decodeYAML([]byte("a:\n  b: [1, 2.5, x]\n  1: one\n  true: yes\n  ~: nothing\n  c: {d: null}\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b":    []interface{}{1.0, 2.5, "x"},
+			"1":    "one",
+			"true": true,
+			"":     "nothing",
+			"c":    map[string]interface{}{"d": nil},
+		},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("unexpected document: %+v", doc)
+	}
+
+	if doc, err := decodeYAML([]byte("")); err != nil || len(doc) != 0 {
+		t.Errorf("unexpected empty document: %+v %v", doc, err)
+	}
+	for _, b := range []string{"- a\n- b\n", "a: [b\n", "just a string"} {
+		if _, err := decodeYAML([]byte(b)); err == nil {
+			t.Errorf("%q: expecting error", b)
+		}
+	}
+}
+
+func bodyEchoProxyFactory() proxy.Factory {
+	return proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			return &proxy.Response{Data: map[string]interface{}{"body": string(b)}, IsComplete: true}, nil
+		}, nil
+	})
+}
+
+func TestProxyFactory_reqBody_compressed(t *testing.T) {
+	payload := []byte(`{"user":"alice","padding":"` + strings.Repeat("x", 2048) + `"}`)
+
+	gz := new(bytes.Buffer)
+	gw := gzip.NewWriter(gz)
+	gw.Write(payload)
+	gw.Close()
+
+	zl := new(bytes.Buffer)
+	zw := zlib.NewWriter(zl)
+	zw.Write(payload)
+	zw.Close()
+
+	fl := new(bytes.Buffer)
+	fw, _ := flate.NewWriter(fl, flate.DefaultCompression)
+	fw.Write(payload)
+	fw.Close()
+
+	for _, tc := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		limit    int64
+		success  bool
+	}{
+		{name: "gzip", encoding: "gzip", body: gz.Bytes(), success: true},
+		{name: "zlib deflate", encoding: "deflate", body: zl.Bytes(), success: true},
+		{name: "raw deflate", encoding: "deflate", body: fl.Bytes(), success: true},
+		{name: "identity", encoding: "identity", body: payload, success: true},
+		{name: "over the limit", encoding: "gzip", body: gz.Bytes(), limit: 1024, success: false},
+		{name: "corrupted", encoding: "gzip", body: payload, success: false},
+	} {
+		extra := map[string]interface{}{
+			"definitions": []internal.InterpretableDefinition{{CheckExpression: "req_body.user == 'alice'"}},
+		}
+		if tc.limit > 0 {
+			extra["max_decompressed_size"] = tc.limit
+		}
+		prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: extra},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method: "POST",
+			Path:   "/some-path",
+			Headers: map[string][]string{
+				"Content-Type":     {"application/json"},
+				"Content-Encoding": {tc.encoding},
+			},
+			Body: ioutil.NopCloser(bytes.NewReader(tc.body)),
+		})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+			continue
+		}
+		if resp.Data["body"] != string(tc.body) {
+			t.Errorf("%s: the original body was not restored", tc.name)
+		}
+	}
+}
+
+func TestProxyFactory_reqBody_maxSize(t *testing.T) {
+	body := `{"user":"alice","padding":"` + strings.Repeat("x", 2048) + `"}`
+
+	for _, tc := range []struct {
+		limit   int64
+		success bool
+	}{
+		{limit: 0, success: true},
+		{limit: int64(len(body)), success: true},
+		{limit: int64(len(body)) - 1, success: false},
+		{limit: 16, success: false},
+	} {
+		extra := map[string]interface{}{
+			"max_body_size": tc.limit,
+			"definitions":   []internal.InterpretableDefinition{{CheckExpression: "has(req_body.user)"}},
+		}
+		var received string
+		pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+			return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+				b, _ := ioutil.ReadAll(r.Body)
+				received = string(b)
+				return &proxy.Response{IsComplete: true}, nil
+			}, nil
+		})
+		prxy, err := ProxyFactory(logging.NoOp, pf).New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: extra},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, err = prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Content-Type": {"application/json"}},
+			Body:    ioutil.NopCloser(strings.NewReader(body)),
+		})
+		if tc.success != (err == nil) {
+			t.Errorf("limit %d: unexpected result: %v", tc.limit, err)
+			continue
+		}
+		if tc.success && received != body {
+			t.Errorf("limit %d: the body was not restored", tc.limit)
+		}
+	}
+}
+
+func TestBodyParser_maxSizeRestoresTheBody(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	r := &proxy.Request{
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    ioutil.NopCloser(strings.NewReader(body)),
+	}
+	// the sequence run by the activation resolving req_body
+	p := bodyParser{maxBodySize: 10}
+	if b, _, ok := p.read(logging.NoOp, r); ok {
+		t.Errorf("unexpected body: %v", p.decode(logging.NoOp, r, b))
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	if string(b) != body {
+		t.Errorf("the body was not restored: %s", string(b))
+	}
+}
+
+func TestBodyParser_consumedBody(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers map[string][]string
+		body    string
+		logged  bool
+		ok      bool
+	}{
+		{name: "consumed", headers: map[string][]string{"Content-Length": {"29"}}, logged: true},
+		{name: "empty", headers: map[string][]string{"Content-Length": {"0"}}, ok: true},
+		{name: "without length", headers: map[string][]string{}, ok: true},
+		{name: "restored", headers: map[string][]string{"Content-Length": {"16"}}, body: `{"user":"alice"}`, ok: true},
+	} {
+		buff := new(bytes.Buffer)
+		logger, err := logging.NewLogger("WARNING", buff, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &proxy.Request{Headers: tc.headers, Body: ioutil.NopCloser(strings.NewReader(tc.body))}
+		b, _, ok := (bodyParser{maxBodySize: defaultMaxBodySize}).read(logger, r)
+		if ok != tc.ok || string(b) != tc.body {
+			t.Errorf("%s: unexpected result: %s %v", tc.name, string(b), ok)
+		}
+		if logged := strings.Contains(buff.String(), "a previous middleware consumed it without restoring it"); logged != tc.logged {
+			t.Errorf("%s: unexpected logs: %s", tc.name, buff.String())
+		}
+	}
+}
+
+func TestProxyFactory_reqBodyRaw(t *testing.T) {
+	compressed := new(bytes.Buffer)
+	gz := gzip.NewWriter(compressed)
+	gz.Write([]byte("compressed"))
+	gz.Close()
+	sum := sha256.Sum256(compressed.Bytes())
+	compressedDigest := hex.EncodeToString(sum[:])
+
+	for _, tc := range []struct {
+		name    string
+		expr    string
+		headers map[string][]string
+		body    string
+		success bool
+	}{
+		{name: "plain text", expr: "req_body_raw == 'hello world'", headers: map[string][]string{"Content-Type": {"text/plain"}}, body: "hello world", success: true},
+		{name: "no content type", expr: "req_body_raw == 'hello world'", headers: map[string][]string{}, body: "hello world", success: true},
+		{name: "json", expr: "req_body_raw == '{\"a\": 1}' && req_body.a == 1.0", headers: map[string][]string{"Content-Type": {"application/json"}}, body: `{"a": 1}`, success: true},
+		{name: "compressed", expr: "sha256(req_body_raw) == '" + compressedDigest + "'", headers: map[string][]string{"Content-Encoding": {"gzip"}}, body: compressed.String(), success: true},
+		{name: "too large", expr: "req_body_raw == ''", headers: map[string][]string{}, body: strings.Repeat("a", 65), success: true},
+		{name: "empty", expr: "req_body_raw != ''", headers: map[string][]string{}, body: "", success: false},
+	} {
+		prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: map[string]interface{}{
+					"max_body_size": 64,
+					"definitions":   []internal.InterpretableDefinition{{CheckExpression: tc.expr}},
+				},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: tc.headers,
+			Body:    ioutil.NopCloser(strings.NewReader(tc.body)),
+		})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+			continue
+		}
+		if resp.Data["body"] != tc.body {
+			t.Errorf("%s: the body was not restored: %v", tc.name, resp.Data["body"])
+		}
+	}
+}
+
+func TestProxyFactory_reqBody_binary(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), bytes.Repeat([]byte{0xff, 0x00, 0xd8}, 40)...)
+
+	for _, tc := range []struct {
+		name    string
+		expr    string
+		headers map[string][]string
+		body    []byte
+		maxB64  int
+		success bool
+	}{
+		{name: "magic bytes", expr: "req_body_b64.startsWith('iVBORw0KGgo') && req_body_size == 136", headers: map[string][]string{"Content-Type": {"image/png"}}, body: png, success: true},
+		{name: "not decoded", expr: "req_body == null", headers: map[string][]string{"Content-Type": {"application/octet-stream"}}, body: png, success: true},
+		{name: "truncated", expr: "size(req_body_b64) == 16", headers: map[string][]string{"Content-Type": {"image/png"}}, body: png, maxB64: 12, success: true},
+		{name: "raw", expr: "size(req_body_raw) > 0", headers: map[string][]string{"Content-Type": {"application/x-protobuf"}}, body: png, success: true},
+		{name: "too large", expr: "req_body_size == 257 && req_body_b64 == ''", headers: map[string][]string{"Content-Type": {"image/png"}}, body: bytes.Repeat(png, 2), success: true},
+		{name: "empty", expr: "req_body_size > 0", headers: map[string][]string{"Content-Type": {"image/png"}}, body: []byte{}, success: false},
+	} {
+		prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: map[string]interface{}{
+					"max_body_size":     256,
+					"req_body_b64":      true,
+					"max_body_b64_size": tc.maxB64,
+					"definitions":       []internal.InterpretableDefinition{{CheckExpression: tc.expr}},
+				},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/upload",
+			Headers: tc.headers,
+			Body:    ioutil.NopCloser(bytes.NewReader(tc.body)),
+		})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+			continue
+		}
+		if resp.Data["body"] != string(tc.body) {
+			t.Errorf("%s: the body was not restored byte for byte", tc.name)
+		}
+	}
+
+	if _, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"strict":      true,
+				"definitions": []internal.InterpretableDefinition{{CheckExpression: "req_body_b64 != ''"}},
+			},
+		},
+	}); err != errReqBodyB64Disabled {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	for ct, expected := range map[string]bool{
+		"image/png":                true,
+		"IMAGE/JPEG":               true,
+		"image/svg+xml":            false,
+		"application/octet-stream": true,
+		"application/x-protobuf":   true,
+		"application/grpc+proto":   true,
+		"video/mp4; codecs=avc1":   true,
+		"application/json":         false,
+		"text/plain":               false,
+		"":                         false,
+	} {
+		if res := isBinary(ct); res != expected {
+			t.Errorf("%s: unexpected result %v", ct, res)
+		}
+	}
+}
+
+func TestProxyFactory_reqBodyFiles(t *testing.T) {
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	w.WriteField("name", "alice")
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="avatar"; filename="me.png"`)
+	h.Set("Content-Type", "image/png")
+	part, _ := w.CreatePart(h)
+	part.Write([]byte(strings.Repeat("x", 100)))
+	part, _ = w.CreateFormFile("docs", "a.pdf")
+	part.Write([]byte("first"))
+	part, _ = w.CreateFormFile("docs", "b.pdf")
+	part.Write([]byte("second"))
+	w.Close()
+
+	for _, tc := range []struct {
+		name    string
+		expr    string
+		success bool
+	}{
+		{name: "values", expr: "req_body.name == 'alice' && !('avatar' in req_body)", success: true},
+		{name: "filename", expr: "req_body_files.avatar[0].filename == 'me.png'", success: true},
+		{name: "size", expr: "req_body_files.avatar[0].size <= 100", success: true},
+		{name: "size exceeded", expr: "req_body_files.avatar[0].size < 100", success: false},
+		{name: "content type", expr: "req_body_files.avatar[0].content_type in ['image/png', 'image/jpeg']", success: true},
+		{name: "repeated field", expr: "size(req_body_files.docs) == 2 && req_body_files.docs[1].filename == 'b.pdf'", success: true},
+		{name: "missing field", expr: "!('other' in req_body_files)", success: true},
+	} {
+		prxy, err := ProxyFactory(logging.NoOp, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: map[string]interface{}{
+					"definitions": []internal.InterpretableDefinition{{CheckExpression: tc.expr}},
+				},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Content-Type": {w.FormDataContentType()}},
+			Body:    ioutil.NopCloser(bytes.NewReader(body.Bytes())),
+		})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+			continue
+		}
+		if resp.Data["body"] != body.String() {
+			t.Errorf("%s: the body was not restored", tc.name)
+		}
+	}
+}
+
+func TestProxyFactory_reqBody_multipartMaxMemory(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		value   string
+		success bool
+	}{
+		{name: "under the limit", value: "alice", success: true},
+		{name: "over the limit", value: strings.Repeat("x", 100), success: false},
+	} {
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		w.WriteField("name", tc.value)
+		// the files do not count against the limit
+		part, _ := w.CreateFormFile("avatar", "me.png")
+		part.Write([]byte(strings.Repeat("x", 200)))
+		w.Close()
+
+		buff := new(bytes.Buffer)
+		logger, err := logging.NewLogger("WARNING", buff, "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		prxy, err := ProxyFactory(logger, bodyEchoProxyFactory()).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: map[string]interface{}{
+					"multipart_max_memory": 50,
+					"definitions":          []internal.InterpretableDefinition{{CheckExpression: "'name' in req_body"}},
+				},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, err = prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Content-Type": {w.FormDataContentType()}},
+			Body:    ioutil.NopCloser(bytes.NewReader(body.Bytes())),
+		})
+		if tc.success {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expecting error", tc.name)
+		}
+		if !strings.Contains(buff.String(), "the multipart values exceed the limit of 50 bytes") {
+			t.Errorf("%s: the limit was not logged: %s", tc.name, buff.String())
+		}
+	}
+}
+
+func TestProxyFactory_reqBody_onlyParsedWhenReferenced(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: "req_method == 'POST'", expected: false},
+		{expr: "has(req_jwt.sub) || req_method == 'POST'", expected: false},
+		{expr: "has(req_body.user) || req_method == 'POST'", expected: true},
+		{expr: "req_body_raw != '' || req_method == 'POST'", expected: true},
+	} {
+		prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: []internal.InterpretableDefinition{{CheckExpression: tc.expr}},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		body := &spyReader{Reader: strings.NewReader(`{"user":"alice"}`)}
+		if _, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Content-Type": {"application/json"}},
+			Body:    ioutil.NopCloser(body),
+		}); err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if body.read != tc.expected {
+			t.Errorf("%s: unexpected body read: %v", tc.expr, body.read)
+		}
+	}
+}
+
+type spyReader struct {
+	io.Reader
+	read bool
+}
+
+func (s *spyReader) Read(p []byte) (int, error) {
+	s.read = true
+	return s.Reader.Read(p)
+}
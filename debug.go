@@ -0,0 +1,122 @@
+package cel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+const redactedValue = internal.RedactedMessage
+
+// defaultRedacted are the identifiers and keys carrying credentials, always redacted
+var defaultRedacted = []string{
+	internal.PreKey + "_jwt",
+	internal.PreKey + "_cookies",
+	internal.PreKey + "_authorization",
+	internal.PreKey + "_body_raw",
+	internal.PreKey + "_body_b64",
+	internal.PostKey + "_body_raw",
+	authHeader,
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// newActivationDumper returns the dumper of the activations when the config enables it, or nil.
+// The configured keys, the ones redacted from all the logs and the header carrying the token are
+// redacted along with the default ones
+func newActivationDumper(cfg internal.Config) *activationDumper {
+	if !cfg.DebugActivation {
+		return nil
+	}
+	keys := append(append(append([]string{}, defaultRedacted...), cfg.DebugRedact...), cfg.LogRedactKeys()...)
+	if cfg.JWTHeader != "" {
+		keys = append(keys, cfg.JWTHeader)
+	}
+	d := &activationDumper{redacted: map[string]bool{}}
+	for _, k := range keys {
+		d.redacted[strings.ToLower(k)] = true
+	}
+	return d
+}
+
+// activationDumper serializes the values available to the expressions, so the authors of the rules
+// can see why a check rejected a request
+type activationDumper struct {
+	redacted map[string]bool
+}
+
+// dump returns the JSON representation of the activation, with the redacted keys masked at any
+// level. All the identifiers of the phase are resolved, so the lazy activations are complete too
+func (d *activationDumper) dump(args interface{}) string {
+	values := map[string]interface{}{}
+	switch a := args.(type) {
+	case *reqActivation:
+		for _, name := range internal.Identifiers() {
+			if name == internal.JwtKey || strings.HasPrefix(name, internal.PostKey+"_") {
+				continue
+			}
+			if d.redacted[strings.ToLower(name)] {
+				values[name] = redactedValue
+				continue
+			}
+			if v, ok := a.ResolveName(name); ok {
+				values[name] = internal.NativeValue(v)
+			}
+		}
+		for name, v := range a.opts.constants {
+			values[name] = v
+		}
+	case *respActivation:
+		for _, name := range internal.Identifiers() {
+			if name == internal.JwtKey || strings.HasPrefix(name, internal.PreKey+"_") {
+				continue
+			}
+			if d.redacted[strings.ToLower(name)] {
+				values[name] = redactedValue
+				continue
+			}
+			if v, ok := a.ResolveName(name); ok {
+				values[name] = internal.NativeValue(v)
+			}
+		}
+		for name, v := range a.opts.constants {
+			values[name] = v
+		}
+	}
+
+	b, err := json.Marshal(d.redact(values))
+	if err != nil {
+		return fmt.Sprintf("%v", values)
+	}
+	return string(b)
+}
+
+func (d *activationDumper) redact(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			if d.redacted[strings.ToLower(k)] {
+				res[k] = redactedValue
+				continue
+			}
+			res[k] = d.redact(e)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, e := range val {
+			res[i] = d.redact(e)
+		}
+		return res
+	case *timestamp.Timestamp:
+		return ptypes.TimestampString(val)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,93 @@
+package cel
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestProxyFactory_debugActivation(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"secret": "s3cr3t", "status": "ko"}, IsComplete: true}
+	token := unsignedToken(map[string]interface{}{"alg": "RS256"}, map[string]interface{}{"sub": "alice"}) + "sig"
+
+	for _, tc := range []struct {
+		name     string
+		cfg      map[string]interface{}
+		expr     string
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "disabled",
+			cfg:      map[string]interface{}{},
+			expr:     "req_method == 'POST'",
+			excludes: []string{"activation"},
+		},
+		{
+			name:     "pre",
+			cfg:      map[string]interface{}{"debug_activation": true},
+			expr:     "req_method == 'POST'",
+			contains: []string{`activation of the rejected check endpoint="proxy /" phase=pre definition_index=0`, `"req_method":"GET"`, `"req_jwt":"[REDACTED]"`, `"req_authorization":"[REDACTED]"`, `"Authorization":"[REDACTED]"`, `"X-Tenant":["acme"]`},
+			excludes: []string{token, "alice"},
+		},
+		{
+			name:     "post",
+			cfg:      map[string]interface{}{"debug_activation": true},
+			expr:     "resp_data.status == 'ok'",
+			contains: []string{`activation of the rejected check endpoint="proxy /" phase=post definition_index=0`, `"status":"ko"`, `"resp_body_raw":"[REDACTED]"`},
+		},
+		{
+			name:     "custom redaction",
+			cfg:      map[string]interface{}{"debug_activation": true, "debug_redact": []string{"secret"}},
+			expr:     "resp_data.status == 'ok'",
+			contains: []string{`"secret":"[REDACTED]"`},
+			excludes: []string{"s3cr3t"},
+		},
+	} {
+		buff := new(bytes.Buffer)
+		logger, err := logging.NewLogger("DEBUG", buff, "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		tc.cfg["definitions"] = []internal.InterpretableDefinition{{CheckExpression: tc.expr}}
+		prxy, err := ProxyFactory(logger, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: tc.cfg},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, err := prxy(context.Background(), &proxy.Request{
+			Method: "GET",
+			Path:   "/some-path",
+			Headers: map[string][]string{
+				"Authorization": {"Bearer " + token},
+				"X-Tenant":      {"acme"},
+			},
+		}); err == nil {
+			t.Errorf("%s: expecting error", tc.name)
+			continue
+		}
+
+		logs := buff.String()
+		for _, s := range tc.contains {
+			if !strings.Contains(logs, s) {
+				t.Errorf("%s: %s not logged: %s", tc.name, s, logs)
+			}
+		}
+		for _, s := range tc.excludes {
+			if strings.Contains(logs, s) {
+				t.Errorf("%s: %s logged: %s", tc.name, s, logs)
+			}
+		}
+	}
+}
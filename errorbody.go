@@ -0,0 +1,88 @@
+package cel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+// errErrorStatus is the error returned by the factories of the pipes declaring an error_body when
+// the router does not report the status codes of the rejections
+var errErrorStatus = errors.New("the error_body needs the ErrorStatus middleware of the router")
+
+// RegisterErrorStatus declares that the router reports the status code of the rejections returned
+// along with their error bodies, like the ErrorStatus middleware of the router/gin package does
+// when it is built. The factories reject the pipes declaring an error_body until it is called,
+// since the stock endpoint handlers would send those rejections with a 200
+func RegisterErrorStatus() {
+	errorStatusMu.Lock()
+	errorStatus = true
+	errorStatusMu.Unlock()
+}
+
+func errorStatusRegistered() bool {
+	errorStatusMu.RLock()
+	defer errorStatusMu.RUnlock()
+	return errorStatus
+}
+
+var (
+	errorStatusMu sync.RWMutex
+	errorStatus   bool
+)
+
+// errorBodyProxy returns the proxy replacing the rejections of the checks with a response carrying
+// the JSON document of the ErrorBody, so the clients get the same contract from every endpoint.
+// The error is still returned along with the response, so the middlewares see the rejection. The
+// endpoint handlers render the responses returned with an error with the status of the writer, so
+// the router must report the code of the rejection (see RegisterErrorStatus). The redirections are
+// kept as they are
+func errorBodyProxy(body internal.ErrorBody, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		resp, err := next(ctx, r)
+		if err == nil {
+			return resp, err
+		}
+		if _, ok := err.(RedirectError); ok {
+			return resp, err
+		}
+		checkErr, ok := AsCheckError(err)
+		if !ok {
+			return resp, err
+		}
+
+		code, _ := RejectionStatus(err)
+		doc := body.Document(code, checkErr.Message)
+		b, mErr := json.Marshal(doc)
+		if mErr != nil {
+			return resp, err
+		}
+		return &proxy.Response{
+			Data: doc,
+			Metadata: proxy.Metadata{
+				StatusCode: code,
+				Headers:    map[string][]string{contentTypeHeader: {contentTypeJson}},
+			},
+			Io: bytes.NewReader(b),
+		}, err
+	}
+}
+
+// RejectionStatus returns the status code of the rejection of a check: the one declared by its
+// definition or 500, like the routers do with the errors without code. It returns false if the
+// error is not a rejection
+func RejectionStatus(err error) (int, bool) {
+	if _, ok := AsCheckError(err); !ok {
+		return 0, false
+	}
+	if sErr, ok := err.(interface{ StatusCode() int }); ok {
+		return sErr.StatusCode(), true
+	}
+	return http.StatusInternalServerError, true
+}
@@ -0,0 +1,164 @@
+package cel
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestProxyFactory_errorBody(t *testing.T) {
+	defer setErrorStatus(errorStatusRegistered())
+	RegisterErrorStatus()
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	service := config.ExtraConfig{internal.Namespace: map[string]interface{}{
+		"error_body": map[string]interface{}{},
+	}}
+	pf := ProxyFactoryWithDefaults(logging.NoOp, dummyProxyFactory(expectedResponse), service)
+
+	for _, tc := range []struct {
+		name       string
+		errorBody  map[string]interface{}
+		definition internal.InterpretableDefinition
+		headers    map[string][]string
+		data       map[string]interface{}
+		status     int
+	}{
+		{
+			name:       "service default",
+			definition: internal.InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RejectMessage: "missing user", StatusCode: http.StatusForbidden},
+			data:       map[string]interface{}{"error": map[string]interface{}{"code": 403, "message": "missing user"}},
+			status:     http.StatusForbidden,
+		},
+		{
+			name:       "without code",
+			definition: internal.InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RejectMessage: "missing user"},
+			data:       map[string]interface{}{"error": map[string]interface{}{"code": 500, "message": "missing user"}},
+			status:     http.StatusInternalServerError,
+		},
+		{
+			name:       "custom shape",
+			errorBody:  map[string]interface{}{"envelope": "failure", "code_key": "status", "message_key": "reason"},
+			definition: internal.InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RejectMessage: "missing user", StatusCode: http.StatusUnauthorized},
+			data:       map[string]interface{}{"failure": map[string]interface{}{"status": 401, "reason": "missing user"}},
+			status:     http.StatusUnauthorized,
+		},
+		{
+			name:       "flat",
+			errorBody:  map[string]interface{}{"flat": true},
+			definition: internal.InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RejectMessage: "missing user", StatusCode: http.StatusUnauthorized},
+			data:       map[string]interface{}{"code": 401, "message": "missing user"},
+			status:     http.StatusUnauthorized,
+		},
+	} {
+		extra := map[string]interface{}{
+			"definitions": []internal.InterpretableDefinition{tc.definition},
+		}
+		if tc.errorBody != nil {
+			extra["error_body"] = tc.errorBody
+		}
+		prxy, err := pf.New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: extra},
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+			continue
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/", Headers: tc.headers})
+		if _, ok := AsCheckError(err); !ok {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if resp == nil {
+			t.Errorf("%s: nil response", tc.name)
+			continue
+		}
+		if !reflect.DeepEqual(resp.Data, tc.data) {
+			t.Errorf("%s: unexpected data: %v", tc.name, resp.Data)
+		}
+		if resp.Metadata.StatusCode != tc.status {
+			t.Errorf("%s: unexpected status code: %d", tc.name, resp.Metadata.StatusCode)
+		}
+		if ct := resp.Metadata.Headers["Content-Type"]; len(ct) != 1 || ct[0] != "application/json" {
+			t.Errorf("%s: unexpected content type: %v", tc.name, ct)
+		}
+		if b, _ := ioutil.ReadAll(resp.Io); len(b) == 0 {
+			t.Errorf("%s: empty body", tc.name)
+		}
+	}
+
+	prxy, err := pf.New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+			{CheckExpression: "'X-User' in req_headers"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/", Headers: map[string][]string{"X-User": {"a"}}})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if resp != expectedResponse {
+		t.Errorf("unexpected response: %v", resp)
+	}
+}
+
+func TestProxyFactory_errorBody_withoutErrorStatus(t *testing.T) {
+	defer setErrorStatus(errorStatusRegistered())
+	setErrorStatus(false)
+
+	cfg := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{
+			"error_body":  map[string]interface{}{},
+			"definitions": []internal.InterpretableDefinition{{CheckExpression: "'X-User' in req_headers", StatusCode: http.StatusForbidden}},
+		}},
+	}
+	if _, err := ProxyFactory(logging.NoOp, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(cfg); err != errErrorStatus {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if p, err := NewReloadableProxy(logging.NoOp, cfg, proxy.NoopProxy); err != errErrorStatus || p != nil {
+		t.Errorf("unexpected reloadable proxy: %v %v", p, err)
+	}
+
+	RegisterErrorStatus()
+	if _, err := ProxyFactory(logging.NoOp, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(cfg); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
+
+func setErrorStatus(registered bool) {
+	errorStatusMu.Lock()
+	errorStatus = registered
+	errorStatusMu.Unlock()
+}
+
+func TestProxyFactory_errorBody_disabled(t *testing.T) {
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+			{CheckExpression: "'X-User' in req_headers", StatusCode: http.StatusForbidden},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/"})
+	if _, ok := AsCheckError(err); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if resp != nil {
+		t.Errorf("unexpected response: %v", resp)
+	}
+}
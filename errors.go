@@ -0,0 +1,106 @@
+package cel
+
+import "net/http"
+
+// CheckError is the error returned when a check rejects the request or the response, or when its
+// evaluation is aborted. Its message is the reject message of the definition, if any, so it can
+// be returned to the clients, while the rest of fields describe where the check failed.
+type CheckError struct {
+	// Pipe is the name of the endpoint or backend running the check
+	Pipe string
+	// Phase is the phase of the check, internal.PhasePre or internal.PhasePost
+	Phase string
+	// Index is the position of the evaluator in its phase
+	Index int
+	// Expression is the source of the check, as declared in the config
+	Expression string
+	Message    string
+	// Code is the status code declared by the definition, if any
+	Code int
+	// Aborted is true when the evaluation timed out or the request was cancelled
+	Aborted bool
+	// Rejections are all the failed checks, when the report_all option aggregates them
+	Rejections []CheckError
+}
+
+func (c CheckError) Error() string {
+	return c.Message
+}
+
+// withCode returns the error exposing the status code of the definition, if any. The routers set
+// the status code of the response with the errors implementing the StatusCode method, so only
+// the errors with a code can implement it
+func (c CheckError) withCode() error {
+	if c.Code != 0 {
+		return codedCheckError{c}
+	}
+	return c
+}
+
+type codedCheckError struct {
+	CheckError
+}
+
+func (c codedCheckError) StatusCode() int {
+	return c.Code
+}
+
+// AsCheckError returns the CheckError contained in the error, if any, including the ones with a
+// status code and the backend rejections
+func AsCheckError(err error) (CheckError, bool) {
+	switch e := err.(type) {
+	case CheckError:
+		return e, true
+	case codedCheckError:
+		return e.CheckError, true
+	case RedirectError:
+		return e.CheckError, true
+	case ResponseRejectError:
+		return AsCheckError(e.Err)
+	default:
+		return CheckError{}, false
+	}
+}
+
+// RedirectError is the error returned when a pre check with a redirect expression fails. It is
+// kept apart from the rejections, so the routers can redirect the client to its Location instead
+// of returning an error
+type RedirectError struct {
+	CheckError
+	Location string
+}
+
+// StatusCode returns the status code of the definition or, when it does not declare one, 302
+func (r RedirectError) StatusCode() int {
+	if r.Code != 0 {
+		return r.Code
+	}
+	return http.StatusFound
+}
+
+// ResponseRejectError is the error returned by the backends when a post-check rejects the
+// response, so the layers wrapping the backends (i.e. the concurrent calls or a custom retry
+// middleware) can tell a rejected response apart from the rest of errors
+type ResponseRejectError struct {
+	Backend string
+	Err     error
+}
+
+func (r ResponseRejectError) Error() string {
+	return r.Err.Error()
+}
+
+// StatusCode returns the status code of the rejection or, when the check does not declare one,
+// the internal server error used by the routers for the rest of errors
+func (r ResponseRejectError) StatusCode() int {
+	if sErr, ok := r.Err.(interface{ StatusCode() int }); ok {
+		return sErr.StatusCode()
+	}
+	return http.StatusInternalServerError
+}
+
+func backendRejection(backend string) func(error) error {
+	return func(err error) error {
+		return ResponseRejectError{Backend: backend, Err: err}
+	}
+}
@@ -0,0 +1,172 @@
+package cel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestProxyFactory_checkError(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true, Metadata: proxy.Metadata{StatusCode: 200}}
+
+	for _, tc := range []struct {
+		name      string
+		reportAll bool
+		method    string
+		phase     string
+		index     int
+		expr      string
+		code      int
+		msg       string
+		failed    int
+	}{
+		{name: "pre", method: "POST", phase: internal.PhasePre, index: 1, expr: "req_method == 'GET'", code: 405, msg: "invalid method"},
+		{name: "post", method: "GET", phase: internal.PhasePost, index: 0, expr: "resp_metadata_status != 200", msg: "CEL: request aborted by the post evaluator #0 of proxy /: resp_metadata_status != 200"},
+		{name: "report all", reportAll: true, method: "DELETE", phase: internal.PhasePre, index: 0, expr: "req_method != 'DELETE'", code: 405, msg: "no delete; invalid method", failed: 2},
+	} {
+		prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: map[string]interface{}{
+					"report_all": tc.reportAll,
+					"definitions": []internal.InterpretableDefinition{
+						{CheckExpression: "req_method != 'DELETE'", RejectMessage: "no delete"},
+						{CheckExpression: "req_method == 'GET'", RejectMessage: "invalid method", StatusCode: 405},
+						{CheckExpression: "resp_metadata_status != 200"},
+					},
+				},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, err = prxy(context.Background(), &proxy.Request{Method: tc.method, Path: "/some-path", Headers: map[string][]string{}})
+		cErr, ok := AsCheckError(err)
+		if !ok {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if cErr.Pipe != "proxy /" || cErr.Phase != tc.phase || cErr.Index != tc.index || cErr.Expression != tc.expr || cErr.Code != tc.code || cErr.Aborted {
+			t.Errorf("%s: unexpected check error: %+v", tc.name, cErr)
+		}
+		if err.Error() != tc.msg {
+			t.Errorf("%s: unexpected error message: %s", tc.name, err.Error())
+		}
+		if len(cErr.Rejections) != tc.failed {
+			t.Errorf("%s: unexpected rejections: %+v", tc.name, cErr.Rejections)
+		}
+		sErr, ok := err.(interface{ StatusCode() int })
+		if ok != (tc.code != 0) || (ok && sErr.StatusCode() != tc.code) {
+			t.Errorf("%s: unexpected status code", tc.name)
+		}
+	}
+}
+
+func TestAsCheckError(t *testing.T) {
+	cErr := CheckError{Pipe: "backend /", Phase: internal.PhasePost, Index: 2, Message: "ko", Code: 502}
+	for _, err := range []error{cErr, cErr.withCode(), ResponseRejectError{Backend: "/", Err: cErr.withCode()}} {
+		res, ok := AsCheckError(err)
+		if !ok || res.Index != 2 || res.Phase != internal.PhasePost || res.Message != "ko" {
+			t.Errorf("unexpected check error: %+v", res)
+		}
+	}
+	if _, ok := AsCheckError(context.Canceled); ok {
+		t.Error("unexpected check error")
+	}
+}
+
+func TestProxyFactory_redirect(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	login := internal.InterpretableDefinition{
+		CheckExpression:    "'X-User' in req_headers",
+		RedirectExpression: "'https://login.example.com/?next=' + req_path",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		def      internal.InterpretableDefinition
+		headers  map[string][]string
+		code     int
+		location string
+	}{
+		{name: "passed", def: login, headers: map[string][]string{"X-User": {"alice"}}},
+		{name: "redirected", def: login, headers: map[string][]string{}, code: 302, location: "https://login.example.com/?next=/some-path"},
+		{
+			name: "custom code",
+			def: internal.InterpretableDefinition{
+				CheckExpression:    "req_headers['X-User'][0] == 'alice'",
+				RedirectExpression: "'/login'",
+				StatusCode:         307,
+			},
+			headers:  map[string][]string{},
+			code:     307,
+			location: "/login",
+		},
+		{
+			name: "token in the location",
+			def: internal.InterpretableDefinition{
+				CheckExpression:    "'X-User' in req_headers",
+				RedirectExpression: "'/login?u=' + req_jwt.role",
+			},
+			headers: map[string][]string{
+				"Authorization": {"Bearer " + unsignedToken(map[string]interface{}{"alg": "RS256"}, map[string]interface{}{"role": "guest"}) + "sig"},
+			},
+			code:     302,
+			location: "/login?u=guest",
+		},
+		{
+			name: "empty location",
+			def: internal.InterpretableDefinition{
+				CheckExpression:    "'X-User' in req_headers",
+				RedirectExpression: "''",
+				RejectMessage:      "login required",
+			},
+			headers: map[string][]string{},
+		},
+	} {
+		prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: map[string]interface{}{
+					"report_all":  true,
+					"definitions": []internal.InterpretableDefinition{tc.def, {CheckExpression: "req_method == 'GET'"}},
+				},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/some-path", Headers: tc.headers})
+		if tc.name == "passed" {
+			if err != nil || resp != expectedResponse {
+				t.Errorf("%s: unexpected result: %v %+v", tc.name, err, resp)
+			}
+			continue
+		}
+		rErr, ok := err.(RedirectError)
+		if tc.location == "" {
+			if ok || err == nil || err.Error() != "login required" {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if rErr.Location != tc.location || rErr.StatusCode() != tc.code || rErr.Index != 0 || rErr.Phase != internal.PhasePre {
+			t.Errorf("%s: unexpected redirection: %+v", tc.name, rErr)
+		}
+		if _, ok := AsCheckError(err); !ok {
+			t.Errorf("%s: not a check error", tc.name)
+		}
+	}
+}
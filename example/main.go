@@ -17,6 +17,7 @@ import (
 	"github.com/gin-gonic/gin"
 
 	cel "github.com/devopsfaith/krakend-cel"
+	celgin "github.com/devopsfaith/krakend-cel/router/gin"
 )
 
 func main() {
@@ -44,10 +45,11 @@ func main() {
 	// cel backend proxy wrapper
 	bf := cel.BackendFactory(logger, proxy.CustomHTTPProxyFactory(client.NewHTTPClient))
 	// cel proxy wrapper
-	pf := cel.ProxyFactory(logger, proxy.NewDefaultFactory(bf, logger))
+	pf := cel.ProxyFactoryWithDefaults(logger, proxy.NewDefaultFactory(bf, logger), serviceConfig.ExtraConfig)
 
 	routerFactory := krakendgin.NewFactory(krakendgin.Config{
 		Engine:         gin.Default(),
+		Middlewares:    []gin.HandlerFunc{celgin.Redirect(), celgin.ErrorStatus()},
 		ProxyFactory:   pf,
 		Logger:         logger,
 		HandlerFactory: krakendgin.EndpointHandler,
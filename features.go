@@ -0,0 +1,35 @@
+package cel
+
+import (
+	"sync"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+)
+
+// Features are the cel-go options used to compile the expressions. The zero value keeps the
+// default environment
+type Features = internal.Features
+
+// SetFeatures configures the cel-go options of the expressions compiled after the call, so it must
+// be called before building the factories. The features that can not be combined are rejected,
+// keeping the previous ones
+func SetFeatures(f Features) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	featuresMu.Lock()
+	features = f
+	featuresMu.Unlock()
+	return nil
+}
+
+func currentFeatures() Features {
+	featuresMu.RLock()
+	defer featuresMu.RUnlock()
+	return features
+}
+
+var (
+	featuresMu sync.RWMutex
+	features   Features
+)
@@ -0,0 +1,45 @@
+package cel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestSetFeatures(t *testing.T) {
+	defer SetFeatures(Features{})
+
+	if err := SetFeatures(Features{FoldConstants: true, ExhaustiveEval: true}); err != internal.ErrFeatures {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if f := currentFeatures(); f != (Features{}) {
+		t.Errorf("the rejected features were set: %+v", f)
+	}
+
+	cfg := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{
+			"strict":      true,
+			"definitions": []internal.InterpretableDefinition{{CheckExpression: "size([req_method, 1]) == 2"}},
+		}},
+	}
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/"}); err != nil || resp != expectedResponse {
+		t.Errorf("unexpected response: %v %+v", err, resp)
+	}
+
+	if err := SetFeatures(Features{HomogeneousAggregateLiterals: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(cfg); err != internal.ErrChecking {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
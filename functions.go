@@ -0,0 +1,18 @@
+package cel
+
+import "github.com/devopsfaith/krakend-cel/internal"
+
+// Function is a custom function injected by the embedder into the environment of the expressions,
+// like a lookup in an external policy service
+type Function = internal.Function
+
+// RegisterFunction makes the function available to the expressions compiled after the
+// registration, so it must be called before building the factories. The names of the standard
+// and the built-in functions can not be reused.
+//
+// The implementations are shared by all the pipes and they are called concurrently, so they must
+// be safe for concurrent use. They receive the context of the request, cancelled when the timeout
+// of the definition expires, and they must return as soon as it is done
+func RegisterFunction(f Function) error {
+	return internal.RegisterFunction(f)
+}
@@ -0,0 +1,200 @@
+package cel
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+func TestRegisterFunction(t *testing.T) {
+	if err := RegisterFunction(Function{
+		Name:   "ipReputation",
+		Args:   []*exprpb.Type{decls.String},
+		Result: decls.Int,
+		Impl: func(ctx context.Context, args ...ref.Val) ref.Val {
+			if args[0].Equal(types.String("10.0.0.66")) != types.True {
+				return types.Int(100)
+			}
+			// a slow lookup, aborted by the timeout of the definition
+			select {
+			case <-ctx.Done():
+				return types.NewErr("ipReputation: %s", ctx.Err().Error())
+			case <-time.After(time.Second):
+				return types.Int(0)
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+			{CheckExpression: "ipReputation(req_client_ip) > 50", Timeout: "50ms"},
+			{CheckExpression: "resp_data.ok && ipReputation('10.0.0.1') == 100", Type: internal.PhasePost},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ip      string
+		success bool
+	}{
+		{ip: "10.0.0.1", success: true},
+		{ip: "10.0.0.66", success: false},
+	} {
+		start := time.Now()
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "GET",
+			Path:    "/",
+			Headers: map[string][]string{"X-Real-Ip": {tc.ip}},
+		})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.ip)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("%s: the lookup was not aborted: %s", tc.ip, elapsed)
+			}
+			continue
+		}
+		if err != nil || resp != expectedResponse {
+			t.Errorf("%s: unexpected result: %v %+v", tc.ip, err, resp)
+		}
+	}
+}
+
+func TestProxyFactory_abandonedEvaluations(t *testing.T) {
+	if err := RegisterFunction(Function{
+		Name:   "slowLookup",
+		Args:   []*exprpb.Type{decls.String},
+		Result: decls.Bool,
+		Impl: func(_ context.Context, _ ...ref.Val) ref.Val {
+			// a lookup ignoring the context, so the evaluation keeps running after its timeout
+			time.Sleep(5 * time.Millisecond)
+			return types.True
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	lookup := "slowLookup(req_method) && req_headers['X-Tenant'][0] != '' && req_client_ip != '' && req_host != '' && req_cookies.size() >= 0"
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+			{CheckExpression: lookup, Audit: true, Timeout: "1ms"},
+			{CheckExpression: "req_headers['X-Tenant'][0] == 'acme' && req_host != ''"},
+			{Header: "X-Tenant", ModExpression: "'acme-' + req_host"},
+			{Header: "X-Host", ModExpression: "req_headers['X-Tenant'][0] + req_scheme"},
+			{CheckExpression: "req_cookies.size() == 0 && req_authorization == ''"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "GET",
+			Path:    "/",
+			Headers: map[string][]string{"X-Tenant": {"acme"}, "Host": {"example.com"}},
+		})
+		if err != nil || resp != expectedResponse {
+			t.Errorf("unexpected response: %v %+v", err, resp)
+		}
+	}
+	// let the abandoned evaluations finish
+	time.Sleep(20 * time.Millisecond)
+
+	// the evaluations abandoned after the request is passed to the next stages do not resolve it
+	a := newReqActivation(logging.NoOp, &proxy.Request{Method: "GET", Path: "/"}, time.Now(), reqOptions{})
+	if _, ok := a.ResolveName("req_method"); !ok {
+		t.Error("req_method not resolved")
+	}
+	a.close()
+	if v, ok := a.ResolveName("req_method"); !ok || v != types.String("GET") {
+		t.Errorf("the resolved value is lost: %v", v)
+	}
+	if _, ok := a.ResolveName("req_path"); ok {
+		t.Error("the closed activation resolved req_path")
+	}
+}
+
+func TestProxyFactory_abandonedPostEvaluations(t *testing.T) {
+	if err := RegisterFunction(Function{
+		Name:   "slowPostLookup",
+		Args:   []*exprpb.Type{decls.Int},
+		Result: decls.Bool,
+		Impl: func(_ context.Context, _ ...ref.Val) ref.Val {
+			// a lookup ignoring the context, so the evaluation keeps running after its timeout
+			time.Sleep(5 * time.Millisecond)
+			return types.True
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	next := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{
+				Data:       map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": []interface{}{2}}},
+				Metadata:   proxy.Metadata{Headers: map[string][]string{"X-Tenant": {"acme"}}},
+				IsComplete: true,
+			}, nil
+		}, nil
+	})
+	lookup := "slowPostLookup(resp_data.size()) && resp_data.all(k, k != '') && resp_metadata_headers.all(k, k != '') && resp_data_size > 0"
+	prxy, err := ProxyFactory(logging.NoOp, next).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+			{CheckExpression: lookup, Type: internal.PhasePost, Audit: true, Timeout: "1ms"},
+			{CheckExpression: "resp_data.a == 1", Type: internal.PhasePost},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/"})
+		if err != nil || resp == nil {
+			t.Errorf("unexpected response: %v %+v", err, resp)
+			continue
+		}
+		// the next stages, like the merger of the backends, keep writing the response while the
+		// abandoned evaluation is still running
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deadline := time.Now().Add(10 * time.Millisecond); time.Now().Before(deadline); {
+				resp.Data["merged"] = time.Now().UnixNano()
+				resp.Metadata.Headers["X-Merged"] = []string{"true"}
+			}
+		}()
+	}
+	wg.Wait()
+	// let the abandoned evaluations finish
+	time.Sleep(20 * time.Millisecond)
+
+	// the evaluations abandoned after the response is returned do not resolve it
+	a := newRespActivation(&proxy.Response{Data: map[string]interface{}{"a": 1}}, respOptions{})
+	a.close()
+	if _, ok := a.ResolveName("resp_data"); ok {
+		t.Error("the closed activation resolved resp_data")
+	}
+}
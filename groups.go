@@ -0,0 +1,36 @@
+package cel
+
+import (
+	"sync"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+)
+
+// RegisterGroup declares a named group of definitions, so the endpoints and the backends can
+// include it with the include option instead of duplicating the common rules. Register the groups
+// before building the pipes, since they are resolved when the pipes are built or reloaded. A group
+// registered with the name of an existing one replaces it
+func RegisterGroup(name string, definitions []InterpretableDefinition) {
+	registerGroup(name, definitions)
+}
+
+// registerGroup stores a copy of the definitions and returns true if it replaced another group
+func registerGroup(name string, definitions []InterpretableDefinition) bool {
+	groupsMu.Lock()
+	_, replaced := groups[name]
+	groups[name] = append([]InterpretableDefinition{}, definitions...)
+	groupsMu.Unlock()
+	return replaced
+}
+
+// withGroups returns the config with the definitions of its included groups
+func withGroups(cfg internal.Config) (internal.Config, error) {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	return cfg.WithGroups(groups)
+}
+
+var (
+	groupsMu sync.RWMutex
+	groups   = map[string][]InterpretableDefinition{}
+)
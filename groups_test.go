@@ -0,0 +1,109 @@
+package cel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestRegisterGroup(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	RegisterGroup("test-auth", []InterpretableDefinition{{CheckExpression: "'X-User' in req_headers", RejectMessage: "auth"}})
+	service := config.ExtraConfig{internal.Namespace: map[string]interface{}{
+		"definitions": []internal.InterpretableDefinition{{CheckExpression: "req_method == 'GET'", RejectMessage: "default"}},
+		"groups": map[string]interface{}{
+			"test-tenant": []internal.InterpretableDefinition{{CheckExpression: "'X-Tenant' in req_headers", RejectMessage: "tenant"}},
+		},
+	}}
+	pf := ProxyFactoryWithDefaults(logging.NoOp, dummyProxyFactory(expectedResponse), service)
+
+	for _, tc := range []struct {
+		name    string
+		include []string
+		method  string
+		headers map[string][]string
+		message string
+	}{
+		{name: "defaults first", include: []string{"test-auth"}, method: "POST", message: "default"},
+		{name: "registered group", include: []string{"test-auth"}, method: "GET", message: "auth"},
+		{name: "service group", include: []string{"test-tenant", "test-auth"}, method: "GET", message: "tenant"},
+		{name: "include order", include: []string{"test-auth", "test-tenant"}, method: "GET", message: "auth"},
+		{name: "own definitions last", include: []string{"test-auth", "test-auth"}, method: "GET", headers: map[string][]string{"X-User": {"a"}}, message: "endpoint"},
+		{name: "allowed", include: []string{"test-tenant"}, method: "GET", headers: map[string][]string{"X-Tenant": {"a"}, "X-Endpoint": {"1"}}},
+	} {
+		prxy, err := pf.New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{
+				"include":     tc.include,
+				"definitions": []internal.InterpretableDefinition{{CheckExpression: "'X-Endpoint' in req_headers", RejectMessage: "endpoint"}},
+			}},
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+			continue
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{Method: tc.method, Path: "/", Headers: tc.headers})
+		if tc.message == "" {
+			if err != nil || resp != expectedResponse {
+				t.Errorf("%s: unexpected result: %v %+v", tc.name, err, resp)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.message {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+
+	bf := func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return expectedResponse, nil
+		}
+	}
+	prxy := BackendFactory(logging.NoOp, bf)(&config.Backend{
+		URLPattern:  "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{"include": []string{"test-tenant"}}},
+	})
+	if _, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/"}); err == nil || err.Error() != "tenant" {
+		t.Errorf("unexpected backend error: %v", err)
+	}
+}
+
+func TestRegisterGroup_unknown(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	for _, strict := range []bool{false, true} {
+		prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{
+				"strict":      strict,
+				"include":     []string{"test-unknown"},
+				"definitions": []internal.InterpretableDefinition{{CheckExpression: "req_method == 'POST'"}},
+			}},
+		})
+		if strict {
+			if err != internal.ErrGroup {
+				t.Errorf("strict: unexpected error: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/"}); err != nil || resp != expectedResponse {
+			t.Errorf("the fallback proxy should be used: %v %+v", err, resp)
+		}
+	}
+
+	p, err := NewReloadableProxy(logging.NoOp, &config.EndpointConfig{
+		Endpoint:    "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{"include": []string{"test-unknown"}}},
+	}, proxy.NoopProxy)
+	if err != internal.ErrGroup || p != nil {
+		t.Errorf("unexpected reloadable proxy: %v %v", p, err)
+	}
+}
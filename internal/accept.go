@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// mediaRange is a range of the Accept header, like text/* or application/json, with its quality
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// specificity returns how specific the range matching the media type is, or -1 if it does not
+// match it. The exact ranges are more specific than type/* and type/* more than */*
+func (m mediaRange) specificity(typ, subtype string) int {
+	switch {
+	case m.typ == typ && m.subtype == subtype:
+		return 2
+	case m.typ == typ && m.subtype == "*":
+		return 1
+	case m.typ == "*" && m.subtype == "*":
+		return 0
+	}
+	return -1
+}
+
+// acceptsMediaType checks if the Accept header allows the media type, that is, if the most
+// specific range matching it has a quality over 0. Requests without ranges accept anything
+func acceptsMediaType(lhs, rhs ref.Val) ref.Val {
+	ranges, err := acceptRanges("acceptsMediaType", lhs)
+	if err != nil {
+		return err
+	}
+	mt, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("acceptsMediaType: unexpected media type %s", rhs.Type().TypeName())
+	}
+	return types.Bool(quality(ranges, string(mt)) > 0)
+}
+
+// preferredMediaType returns the offered media type with the highest quality in the Accept
+// header, or an empty string if none is acceptable. The ties are resolved by the order of the
+// offers, so the first ones are the preferred by the server
+func preferredMediaType(lhs, rhs ref.Val) ref.Val {
+	ranges, err := acceptRanges("preferredMediaType", lhs)
+	if err != nil {
+		return err
+	}
+	offers, ok := rhs.(traits.Lister)
+	if !ok {
+		return types.NewErr("preferredMediaType: unexpected offers type %s", rhs.Type().TypeName())
+	}
+	best, bestQ := "", 0.0
+	for it := offers.Iterator(); it.HasNext() == types.True; {
+		offer, ok := it.Next().(types.String)
+		if !ok {
+			return types.NewErr("preferredMediaType: unexpected offer type")
+		}
+		if q := quality(ranges, string(offer)); q > bestQ {
+			best, bestQ = string(offer), q
+		}
+	}
+	return types.String(best)
+}
+
+// quality returns the quality of the most specific range matching the media type, ignoring its
+// parameters, or 0 if no range matches it
+func quality(ranges []mediaRange, mt string) float64 {
+	if len(ranges) == 0 {
+		return 1
+	}
+	typ, subtype, ok := splitMediaType(mt)
+	if !ok {
+		return 0
+	}
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		if s := r.specificity(typ, subtype); s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// acceptRanges parses the ranges of all the values of the Accept header. The malformed ranges are
+// skipped, so a header without valid ranges accepts anything, like a missing one
+func acceptRanges(fn string, headers ref.Val) ([]mediaRange, ref.Val) {
+	values, err := headerLookup(fn, headers, types.String("Accept"))
+	if err != nil {
+		return nil, err
+	}
+	if values == nil {
+		return nil, nil
+	}
+	ranges := []mediaRange{}
+	for it := values.Iterator(); it.HasNext() == types.True; {
+		v, ok := it.Next().(types.String)
+		if !ok {
+			return nil, types.NewErr("%s: unexpected value type", fn)
+		}
+		for _, part := range strings.Split(string(v), ",") {
+			if r, ok := parseMediaRange(part); ok {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// parseMediaRange parses a range like "text/html;level=1;q=0.5". The parameters but q are ignored
+func parseMediaRange(s string) (mediaRange, bool) {
+	params := strings.Split(s, ";")
+	typ, subtype, ok := splitMediaType(params[0])
+	if !ok || (typ == "*" && subtype != "*") {
+		return mediaRange{}, false
+	}
+	r := mediaRange{typ: typ, subtype: subtype, q: 1}
+	for _, p := range params[1:] {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || q < 0 || q > 1 {
+			return mediaRange{}, false
+		}
+		r.q = q
+	}
+	return r, true
+}
+
+// splitMediaType returns the lowercased type and subtype of the media type, without parameters
+func splitMediaType(mt string) (string, string, bool) {
+	if i := strings.Index(mt, ";"); i >= 0 {
+		mt = mt[:i]
+	}
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(mt)), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), true
+}
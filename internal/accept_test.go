@@ -0,0 +1,67 @@
+package internal
+
+import "testing"
+
+func TestAcceptsMediaType(t *testing.T) {
+	for _, tc := range []struct {
+		headers   string
+		mediaType string
+		expected  bool
+	}{
+		{headers: "{}", mediaType: "application/json", expected: true},
+		{headers: "{'Accept': ['*/*']}", mediaType: "application/json", expected: true},
+		{headers: "{'Accept': ['application/json']}", mediaType: "application/json", expected: true},
+		{headers: "{'accept': ['Application/JSON']}", mediaType: "application/json", expected: true},
+		{headers: "{'Accept': ['application/json']}", mediaType: "application/json; charset=utf-8", expected: true},
+		{headers: "{'Accept': ['application/json']}", mediaType: "application/xml"},
+		{headers: "{'Accept': ['text/*']}", mediaType: "text/html", expected: true},
+		{headers: "{'Accept': ['text/*']}", mediaType: "application/json"},
+		{headers: "{'Accept': ['application/json;q=0']}", mediaType: "application/json"},
+		{headers: "{'Accept': ['*/*, application/json;q=0']}", mediaType: "application/json"},
+		{headers: "{'Accept': ['*/*, application/json;q=0']}", mediaType: "application/xml", expected: true},
+		{headers: "{'Accept': ['application/*;q=0, application/json;q=0.1']}", mediaType: "application/json", expected: true},
+		{headers: "{'Accept': ['text/html', 'application/json;q=0.5']}", mediaType: "application/json", expected: true},
+		{headers: "{'Accept': ['application/json;q=two, text/html']}", mediaType: "application/json"},
+		{headers: "{'Accept': ['application/json;q=two']}", mediaType: "application/xml", expected: true},
+		{headers: "{'Accept': ['application/vnd.api.v2+json']}", mediaType: "application/vnd.api.v1+json"},
+		{headers: "{'Accept': ['application/json']}", mediaType: "json"},
+	} {
+		expr := "acceptsMediaType(" + tc.headers + ", '" + tc.mediaType + "')"
+		res, err := evalExpr(expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", expr, res)
+		}
+	}
+}
+
+func TestPreferredMediaType(t *testing.T) {
+	offers := "['application/json', 'application/xml', 'text/html']"
+	for _, tc := range []struct {
+		headers  string
+		expected string
+	}{
+		{headers: "{}", expected: "application/json"},
+		{headers: "{'Accept': ['*/*']}", expected: "application/json"},
+		{headers: "{'Accept': ['application/xml']}", expected: "application/xml"},
+		{headers: "{'Accept': ['application/json;q=0.5, application/xml']}", expected: "application/xml"},
+		{headers: "{'Accept': ['application/json;q=0.5', 'application/xml;q=0.9']}", expected: "application/xml"},
+		{headers: "{'Accept': ['text/*;q=0.8, */*;q=0.1']}", expected: "text/html"},
+		{headers: "{'Accept': ['application/*']}", expected: "application/json"},
+		{headers: "{'Accept': ['*/*, application/json;q=0']}", expected: "application/xml"},
+		{headers: "{'Accept': ['image/png']}", expected: ""},
+	} {
+		expr := "preferredMediaType(" + tc.headers + ", " + offers + ")"
+		res, err := evalExpr(expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", expr, res)
+		}
+	}
+}
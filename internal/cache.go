@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// programs keeps the compiled expressions, so the expressions repeated across endpoints and
+// backends are compiled only once. The programs are stateless, so they can be shared by all of them
+var programs = &programCache{programs: map[string]compiled{}}
+
+// compiled is the part of an evaluator not depending on the rest of fields of the definition
+type compiled struct {
+	program    cel.Program
+	refs       map[string]bool
+	keys       map[string]bool
+	resultType *exprpb.Type
+}
+
+type programCache struct {
+	mu       sync.RWMutex
+	programs map[string]compiled
+}
+
+// get returns the compiled expression, calling the compile func on cache misses. The failed
+// compilations are not cached
+func (c *programCache) get(key string, compile func() (compiled, error)) (compiled, error) {
+	c.mu.RLock()
+	res, ok := c.programs[key]
+	c.mu.RUnlock()
+	if ok {
+		return res, nil
+	}
+
+	res, err := compile()
+	if err != nil {
+		return res, err
+	}
+
+	c.mu.Lock()
+	c.programs[key] = res
+	c.mu.Unlock()
+	return res, nil
+}
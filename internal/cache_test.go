@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestParser_compilationCache(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	definitions := []InterpretableDefinition{
+		{CheckExpression: "req_method == 'GET' && now_unix > 0"},
+		{CheckExpression: "  req_method == 'GET' && now_unix > 0\n", StatusCode: 403},
+		{CheckExpression: "req_method == 'POST'"},
+	}
+
+	pre, err := p.ParsePre(definitions)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(pre) != 3 {
+		t.Errorf("unexpected evaluators: %+v", pre)
+		return
+	}
+	if pre[0].Program != pre[1].Program {
+		t.Error("the repeated expression was compiled twice")
+	}
+	if pre[0].Program == pre[2].Program {
+		t.Error("different expressions share the program")
+	}
+	if pre[1].Definition.StatusCode != 403 {
+		t.Errorf("unexpected definition: %+v", pre[1].Definition)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := p.ParsePre(definitions)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if out, _, err := res[0].Eval(map[string]interface{}{"req_method": "GET", "now_unix": 1}); err != nil || out.Value() != true {
+				t.Errorf("unexpected result: %v %v", out, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestParser_compilationCache_errors(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	for i := 0; i < 2; i++ {
+		if _, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "req_method == "}}); err != ErrParsing {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
@@ -6,34 +6,370 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/devopsfaith/krakend/config"
 	"github.com/devopsfaith/krakend/logging"
+	"github.com/golang/protobuf/proto"
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
 )
 
 type InterpretableDefinition struct {
 	CheckExpression string `json:"check_expr"`
 	ModExpression   string `json:"mod_expr"`
+	// StatusCode is the status code of the error returned when the check rejects the request
+	StatusCode int `json:"status_code,omitempty"`
+	// RejectMessage is the message of the error returned when the check rejects the request
+	RejectMessage string `json:"reject_message,omitempty"`
+	// FailPolicy defines what to do when the evaluation of the expression fails: abort the request
+	// (FailPolicyClosed, the default) or skip the check (FailPolicyOpen)
+	FailPolicy string `json:"fail_policy,omitempty"`
+	// Header is the name of the request header set with the result of the mod expression
+	Header string `json:"header,omitempty"`
+	// Timeout is the maximum duration of each evaluation of the expression. Default: 1s
+	Timeout string `json:"timeout,omitempty"`
+	// Type is the phase of the definition (PhasePre or PhasePost). When empty, the phase is
+	// inferred from the identifiers in the expression
+	Type string `json:"type,omitempty"`
+	// File is the path of a file containing the check expression, used instead of an inline one
+	File string `json:"file,omitempty"`
+	// RespHeaders marks the mod expression as a mutation of the response headers. The expression
+	// returns a map with the headers to set (and the ones to remove, with null or empty values)
+	RespHeaders bool `json:"resp_headers,omitempty"`
+	// RespStatus marks the mod expression as a mutation of the status code of the response. The
+	// expression returns an int between 100 and 599
+	RespStatus bool `json:"resp_status,omitempty"`
+	// Critical makes the pipe reject all the requests when its definitions can not be parsed,
+	// instead of falling back to the next proxy without any check
+	Critical bool `json:"critical,omitempty"`
+	// Priority sorts the checks of each phase: the higher ones are evaluated first and the ties
+	// keep the order of the config. Default: 0
+	Priority int `json:"priority,omitempty"`
+	// LogLevel is the level of the message logged when the check rejects the request (LogLevelDebug,
+	// LogLevelInfo, LogLevelWarning or LogLevelError, ignoring the case). Default: LogLevelInfo
+	LogLevel string `json:"log_level,omitempty"`
+	// RedirectExpression computes the Location of the redirection returned instead of the
+	// rejection when the pre check fails. It must return a string
+	RedirectExpression string `json:"redirect_expr,omitempty"`
+	// When is the guard of the check: the check is only evaluated when the guard returns true.
+	// It is evaluated with the same activation, so it uses the identifiers of the same phase
+	When string `json:"when,omitempty"`
+	// Store is the name of the request-scoped value set with the result of the mod expression,
+	// evaluated with the request and exposed to the post expressions as pre.<name>
+	Store string `json:"store,omitempty"`
+	// Audit logs and counts the rejections of the check without aborting the request, so a new
+	// rule can be observed against the real traffic before enforcing it
+	Audit bool `json:"audit,omitempty"`
+	// Negate declares a deny rule: the check rejects the request when its expression returns
+	// true and accepts it when it returns false. The failed evaluations still reject it
+	Negate bool `json:"negate,omitempty"`
 }
 
-func ConfigGetter(e config.ExtraConfig) ([]InterpretableDefinition, bool) {
-	def := []InterpretableDefinition{}
+const (
+	FailPolicyClosed = "closed"
+	FailPolicyOpen   = "open"
+
+	PhasePre  = "pre"
+	PhasePost = "post"
+)
+
+const (
+	LogLevelDebug   = "DEBUG"
+	LogLevelInfo    = "INFO"
+	LogLevelWarning = "WARNING"
+	LogLevelError   = "ERROR"
+)
+
+// validLogLevel returns true if the level is empty or one of the supported ones
+func validLogLevel(level string) bool {
+	switch strings.ToUpper(level) {
+	case "", LogLevelDebug, LogLevelInfo, LogLevelWarning, LogLevelError:
+		return true
+	}
+	return false
+}
+
+// DefaultLogRedact are the identifiers redacted from the logs when the config does not declare them.
+// JwtKey is the token of the rejecter, the same one exposed as req_jwt
+var DefaultLogRedact = []string{PreKey + "_jwt", PreKey + "_authorization", PreKey + "_body", JwtKey}
+
+// LogRedactKeys returns the identifiers and the keys redacted from the logs
+func (c Config) LogRedactKeys() []string {
+	if c.LogRedact == nil {
+		return DefaultLogRedact
+	}
+	return c.LogRedact
+}
+
+// DefaultTimeout is the maximum duration of the evaluations of the definitions without timeout
+const DefaultTimeout = time.Second
+
+// FailOpen returns true if the evaluation errors of the definition must be ignored
+func (i InterpretableDefinition) FailOpen() bool {
+	return i.FailPolicy == FailPolicyOpen
+}
+
+// AnyCritical returns true if any of the definitions is critical
+func AnyCritical(definitions []InterpretableDefinition) bool {
+	for _, def := range definitions {
+		if def.Critical {
+			return true
+		}
+	}
+	return false
+}
+
+// EvalTimeout returns the maximum duration of each evaluation of the definition
+func (i InterpretableDefinition) EvalTimeout() time.Duration {
+	if d, err := time.ParseDuration(i.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return DefaultTimeout
+}
+
+// Evaluator is the compiled version of a definition
+type Evaluator struct {
+	cel.Program
+	Definition InterpretableDefinition
+	// Redirect is the evaluator of the redirect expression of the definition, if any
+	Redirect *Evaluator
+	// Guard is the evaluator of the when expression of the definition, if any
+	Guard *Evaluator
+	// Redacted is true when the expression references a redacted identifier or selects a redacted
+	// key, so its results are masked in the logs
+	Redacted   bool
+	refs       map[string]bool
+	resultType *exprpb.Type
+	source     string
+}
+
+// Source returns the text of the compiled expression, as declared in the config (or its file),
+// so the errors and the logs can show the rule instead of the program
+func (e Evaluator) Source() string {
+	return e.source
+}
+
+// References returns true if the expression uses any of the identifiers
+func (e Evaluator) References(idents ...string) bool {
+	for _, ident := range idents {
+		if e.refs[ident] {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns returns true if the expression evaluates to values of the type. Expressions with a
+// dynamic result, like the ones accessing the fields of req_jwt, are accepted too
+func (e Evaluator) Returns(t *exprpb.Type) bool {
+	return proto.Equal(e.resultType, t) || proto.Equal(e.resultType, decls.Dyn)
+}
+
+// AnyReferences returns true if any of the evaluators uses any of the identifiers
+func AnyReferences(evaluators []Evaluator, idents ...string) bool {
+	for _, e := range evaluators {
+		if e.References(idents...) {
+			return true
+		}
+	}
+	return false
+}
+
+// Config contains the definitions and the options declared under the namespace of the module.
+// The extra config accepts either a plain list of definitions or an object like:
+//
+//	{
+//		"definitions": [{"check_expr": "..."}],
+//		"jwk_url": "https://idp.example.com/.well-known/jwks.json",
+//		"jwk_cache_ttl": "15m"
+//	}
+type Config struct {
+	Definitions []InterpretableDefinition `json:"definitions"`
+	// JWKURL enables the signature verification of the JWT exposed as req_jwt
+	JWKURL string `json:"jwk_url"`
+	// JWKCacheTTL is the time the keys fetched from the JWKURL are cached
+	JWKCacheTTL string `json:"jwk_cache_ttl"`
+	// Issuers select the verification of the tokens by their iss claim, for the gateways fronting
+	// several identity providers. When declared, the tokens of other issuers are not decoded
+	Issuers map[string]Issuer `json:"issuers"`
+	// JWTHeader is the name of the header carrying the token. Default: Authorization
+	JWTHeader string `json:"jwt_header"`
+	// JWTPrefix is the prefix to remove from the header value. An empty prefix reads the raw
+	// token from the header. Default: "Bearer "
+	JWTPrefix *string `json:"jwt_prefix"`
+	// JWTCookie is the name of the cookie carrying the token. When the cookie is not present,
+	// the token is read from the JWTHeader
+	JWTCookie string `json:"jwt_cookie"`
+	// TrustedProxies is the number of proxies in front of the gateway appending their entries to
+	// the X-Forwarded-For header
+	TrustedProxies int `json:"trusted_proxies"`
+	// MaxBodySize is the maximum size in bytes of the request bodies to parse. Default: 8MB
+	MaxBodySize int64 `json:"max_body_size"`
+	// MaxDecompressedSize is the maximum size in bytes of a compressed request body once it is
+	// decompressed. Default: 8MB
+	MaxDecompressedSize int64 `json:"max_decompressed_size"`
+	// MultipartMaxMemory is the maximum size in bytes of the values of the fields of a multipart
+	// body, excluding the uploaded files. Default: 32MB
+	MultipartMaxMemory int64 `json:"multipart_max_memory"`
+	// ReqBodyB64 enables the req_body_b64 variable, the body encoded in base64
+	ReqBodyB64 bool `json:"req_body_b64"`
+	// MaxBodyB64Size is the maximum number of bytes of the body encoded in req_body_b64. The bigger
+	// bodies are truncated. Default: 64KB
+	MaxBodyB64Size int64 `json:"max_body_b64_size"`
+	// ReportAll evaluates all the checks of a phase, instead of stopping at the first rejection,
+	// and returns a single error with the messages of all the failed ones
+	ReportAll bool `json:"report_all"`
+	// Audit sets the audit mode of all the checks of the config
+	Audit bool `json:"audit"`
+	// Strict makes the factories fail when the definitions are invalid, instead of logging the
+	// error and falling back to the next proxy without any check
+	Strict bool `json:"strict"`
+	// RejectIncomplete rejects the incomplete responses before evaluating the post definitions
+	RejectIncomplete bool `json:"reject_incomplete"`
+	// RespBodyRaw enables the resp_body_raw variable, the response data serialized as JSON
+	RespBodyRaw bool `json:"resp_body_raw"`
+	// Vars are constants declared as identifiers for all the expressions, so the same expression
+	// can be reused with different values: {"allowed_tenants": ["acme", "globex"]}
+	Vars map[string]interface{} `json:"vars"`
+	// Lists are named sets of values for the membership checks of inList, in constant time
+	Lists map[string][]interface{} `json:"lists"`
+	// Schemas are the named JSON schemas (draft-07) of matchesSchema and schemaErrors, declared
+	// inline or as the path of a file
+	Schemas map[string]interface{} `json:"schemas"`
+	// DebugActivation logs, at debug level, the values available to the expressions when a check
+	// rejects the request
+	DebugActivation bool `json:"debug_activation"`
+	// DebugRedact are the identifiers and the keys (like the header names) redacted from the
+	// activation logged with DebugActivation, besides the ones carrying credentials
+	DebugRedact []string `json:"debug_redact"`
+	// LogRedact are the identifiers and the keys (like the claim names) redacted from all the logs.
+	// The results of the expressions referencing them are masked, and so are the keys of the
+	// logged maps and activations. Default: DefaultLogRedact. An empty list disables it
+	LogRedact []string `json:"log_redact"`
+	// SkipDefaults opts the endpoint out of the default definitions declared at the service level
+	SkipDefaults bool `json:"skip_defaults"`
+	// Skip is a boolean expression evaluated against the request. When it is true, none of the
+	// definitions are evaluated: "'X-Probe' in req_headers"
+	Skip string `json:"skip"`
+	// Include are the names of the definition groups whose definitions are prepended to the ones of
+	// the pipe, in the order of the list
+	Include []string `json:"include"`
+	// Groups are named sets of definitions, declared at the service level, that the pipes can
+	// include by name
+	Groups map[string][]InterpretableDefinition `json:"groups"`
+	// ErrorBody formats the rejections of the checks of the endpoint as JSON documents, instead of
+	// returning the bare errors to the router. Disabled when nil
+	ErrorBody *ErrorBody `json:"error_body"`
+}
+
+// Issuer is the verification of the tokens of an issuer
+type Issuer struct {
+	// JWKURL is the source of the keys verifying the signatures of the tokens of the issuer. It is
+	// required, since the claims of the tokens can not be trusted otherwise
+	JWKURL string `json:"jwk_url"`
+	// JWKCacheTTL is the time the keys fetched from the JWKURL are cached
+	JWKCacheTTL string `json:"jwk_cache_ttl"`
+	// Audience, when not empty, requires the aud claim to contain any of its values
+	Audience []string `json:"audience"`
+}
+
+// ErrorBody is the shape of the JSON documents describing the rejections: by default,
+// {"error": {"code": 403, "message": "..."}}
+type ErrorBody struct {
+	// Envelope is the key wrapping the code and the message. Default: error
+	Envelope string `json:"envelope"`
+	// Flat places the code and the message at the root of the document, without envelope
+	Flat bool `json:"flat"`
+	// CodeKey is the key of the status code. Default: code
+	CodeKey string `json:"code_key"`
+	// MessageKey is the key of the message. Default: message
+	MessageKey string `json:"message_key"`
+}
+
+// Document returns the JSON document describing the rejection
+func (e ErrorBody) Document(code int, message string) map[string]interface{} {
+	codeKey, messageKey, envelope := e.CodeKey, e.MessageKey, e.Envelope
+	if codeKey == "" {
+		codeKey = "code"
+	}
+	if messageKey == "" {
+		messageKey = "message"
+	}
+	if envelope == "" {
+		envelope = "error"
+	}
+	doc := map[string]interface{}{codeKey: code, messageKey: message}
+	if e.Flat {
+		return doc
+	}
+	return map[string]interface{}{envelope: doc}
+}
+
+// WithDefaults returns a copy of the config with the default definitions prepended to its own
+// ones, unless the config opts out of them
+func (c Config) WithDefaults(defaults []InterpretableDefinition) Config {
+	if c.SkipDefaults || len(defaults) == 0 {
+		return c
+	}
+	c.Definitions = append(append([]InterpretableDefinition{}, defaults...), c.Definitions...)
+	return c
+}
+
+// WithGroups returns a copy of the config with the definitions of the included groups prepended to
+// its own ones, in the order of the includes. Every group is included once, and the unknown ones
+// return ErrGroup
+func (c Config) WithGroups(groups map[string][]InterpretableDefinition) (Config, error) {
+	if len(c.Include) == 0 {
+		return c, nil
+	}
+	res := []InterpretableDefinition{}
+	included := map[string]bool{}
+	for _, name := range c.Include {
+		if included[name] {
+			continue
+		}
+		group, ok := groups[name]
+		if !ok {
+			return c, ErrGroup
+		}
+		included[name] = true
+		res = append(res, group...)
+	}
+	c.Definitions = append(res, c.Definitions...)
+	return c, nil
+}
+
+func ConfigGetter(e config.ExtraConfig) (Config, bool) {
+	cfg := Config{Definitions: []InterpretableDefinition{}}
 	v, ok := e[Namespace]
 	if !ok {
-		return def, ok
+		return cfg, ok
 	}
 	buf := new(bytes.Buffer)
 	if err := json.NewEncoder(buf).Encode(&v); err != nil {
-		return def, false
+		return cfg, false
 	}
 
-	if err := json.NewDecoder(buf).Decode(&def); err != nil {
-		return def, false
+	if bytes.HasPrefix(buf.Bytes(), []byte("[")) {
+		if err := json.NewDecoder(buf).Decode(&cfg.Definitions); err != nil {
+			return cfg, false
+		}
+		return cfg, true
+	}
+
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, false
 	}
-	return def, true
+	return cfg, true
 }
 
 const Namespace = "github.com/devopsfaith/krakend-cel"
@@ -42,8 +378,47 @@ var (
 	ErrParsing  = errors.New("cel: error parsing the expression")
 	ErrChecking = errors.New("cel: error checking the expression and its param definition")
 	ErrNoExpr   = errors.New("cel: no expression")
+	ErrStatus   = errors.New("cel: invalid status code")
+	ErrPolicy   = errors.New("cel: invalid fail policy")
+	ErrResult   = errors.New("cel: invalid result type for the mod expression")
+	ErrTimeout  = errors.New("cel: invalid timeout")
+	ErrType     = errors.New("cel: invalid definition type")
+	ErrFile     = errors.New("cel: the definition declares both a check expression and a file")
+	ErrSkip     = errors.New("cel: the skip expression must return a bool")
+	ErrLogLevel = errors.New("cel: invalid log level")
+	ErrRedirect = errors.New("cel: the redirect expression must return a string and it is only available for the pre checks")
+	ErrWhen     = errors.New("cel: the when expression must return a bool and use the identifiers of the phase of the check")
+	ErrGroup    = errors.New("cel: unknown definition group")
+	ErrStore    = errors.New("cel: the store definitions need a unique name and they can not set headers nor belong to the post phase")
 )
 
+// RejectError is the error returned when a check with a custom status code rejects the request.
+// It implements the interface the KrakenD routers use for setting the status code of the response.
+type RejectError struct {
+	Code int
+	Msg  string
+}
+
+func (r RejectError) Error() string {
+	return r.Msg
+}
+
+func (r RejectError) StatusCode() int {
+	return r.Code
+}
+
+// PhaseError is the error returned when the expression of a definition with an explicit type
+// references an identifier of the other phase
+type PhaseError struct {
+	Expr  string
+	Type  string
+	Ident string
+}
+
+func (p PhaseError) Error() string {
+	return fmt.Sprintf("cel: the %s expression '%s' references %s, only available in the other phase", p.Type, p.Expr, p.Ident)
+}
+
 func NewCheckExpressionParser(l logging.Logger) Parser {
 	return Parser{
 		extractor: extractCheckExpr,
@@ -61,53 +436,331 @@ func NewModExpressionParser(l logging.Logger) Parser {
 type Parser struct {
 	extractor func(InterpretableDefinition) string
 	w         io.Writer
+	vars      Vars
+	lists     Lists
+	schemas   Schemas
+	redacted  map[string]bool
+	features  Features
+}
+
+// WithVars returns a copy of the parser declaring the vars in the environment of the expressions
+func (p Parser) WithVars(vars Vars) Parser {
+	p.vars = vars
+	return p
+}
+
+// WithLists returns a copy of the parser checking the membership of inList against the lists
+func (p Parser) WithLists(lists Lists) Parser {
+	p.lists = lists
+	return p
+}
+
+// WithFeatures returns a copy of the parser compiling the expressions with the cel-go features
+func (p Parser) WithFeatures(f Features) Parser {
+	p.features = f
+	return p
+}
+
+// WithRedacted returns a copy of the parser marking the evaluators referencing the identifiers or
+// selecting the keys as redacted. The names are compared ignoring their case
+func (p Parser) WithRedacted(keys []string) Parser {
+	p.redacted = make(map[string]bool, len(keys))
+	for _, k := range keys {
+		p.redacted[strings.ToLower(k)] = true
+	}
+	return p
+}
+
+// WithSchemas returns a copy of the parser validating the values of matchesSchema and schemaErrors
+// against the schemas
+func (p Parser) WithSchemas(schemas Schemas) Parser {
+	p.schemas = schemas
+	return p
 }
 
 func (p Parser) Parse(definition InterpretableDefinition) (cel.Program, error) {
-	expr := p.extractor(definition)
+	e, err := p.compile(definition)
+	return e.Program, err
+}
+
+// compile returns the evaluator of the definition, including the set of identifiers referenced by
+// its expression and the type of its result. The compiled expressions are cached, so a repeated
+// one is only compiled once
+func (p Parser) compile(definition InterpretableDefinition) (Evaluator, error) {
+	source := strings.TrimSpace(p.extractor(definition))
+	expr, missing := interpolateEnv(source)
+	if len(missing) > 0 {
+		fmt.Fprintln(p.w, "undefined environment variables:", strings.Join(missing, ", "))
+		return Evaluator{}, ErrEnv
+	}
 	if expr == "" {
-		return nil, ErrNoExpr
+		return Evaluator{}, ErrNoExpr
 	}
-	fmt.Println(expr)
-	env, err := cel.NewEnv(defaultDeclarations())
+	if err := p.features.Validate(); err != nil {
+		return Evaluator{}, err
+	}
+	c, err := programs.get(environmentKey+registry.key()+"\x00"+p.vars.key+"\x00"+p.lists.key+"\x00"+p.schemas.key+"\x00"+p.features.key()+"\x00"+expr, func() (compiled, error) {
+		return p.compileExpr(expr, source)
+	})
 	if err != nil {
-		fmt.Println(err.Error())
-		return nil, err
+		return Evaluator{}, err
 	}
+	return Evaluator{
+		Program:    c.program,
+		Definition: definition,
+		Redacted:   p.redacts(c),
+		refs:       c.refs,
+		resultType: c.resultType,
+		source:     source,
+	}, nil
+}
+
+// redacts returns true if the compiled expression references any redacted identifier or key
+func (p Parser) redacts(c compiled) bool {
+	for ident := range c.refs {
+		if p.redacted[strings.ToLower(ident)] {
+			return true
+		}
+	}
+	for key := range c.keys {
+		if p.redacted[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// environmentKey identifies the default declarations of the environment. Along with the keys of
+// the registered functions, the vars, the lists, the schemas and the features, it ensures the
+// cached programs are only shared by the expressions of the same environment
+const environmentKey = "default\x00"
 
-	ast, iss := env.Parse(p.extractor(definition))
+// compileExpr compiles the expression, already interpolated from the source. The issues found are
+// written to the writer of the parser
+func (p Parser) compileExpr(expr, source string) (compiled, error) {
+	opts := append([]cel.EnvOption{defaultDeclarations(), cel.Declarations(functionDeclarations()...), cel.Declarations(p.vars.decls...)}, p.features.envOptions()...)
+	env, err := cel.NewEnv(append(opts, cel.Macros(coalesceMacros...))...)
+	if err != nil {
+		return compiled{}, err
+	}
+
+	ast, iss := env.Parse(expr)
 	if iss != nil && iss.Err() != nil {
-		fmt.Println(iss.Err())
-		return nil, ErrParsing
+		p.report(iss, expr, source)
+		return compiled{}, ErrParsing
+	}
+	if ast, err = injectContext(ast); err != nil {
+		return compiled{}, err
 	}
 	c, iss := env.Check(ast)
 	if iss != nil && iss.Err() != nil {
-		fmt.Fprintln(p.w, iss.Err())
-		return nil, ErrChecking
+		p.report(iss, expr, source)
+		return compiled{}, ErrChecking
+	}
+
+	checked, err := cel.AstToCheckedExpr(c)
+	if err != nil {
+		return compiled{}, err
+	}
+	if err := validatePatterns(checked.Expr); err != nil {
+		return compiled{}, err
+	}
+	if err := p.lists.validate(checked.Expr); err != nil {
+		return compiled{}, err
+	}
+	if err := p.schemas.validate(checked.Expr); err != nil {
+		return compiled{}, err
+	}
+	refs := map[string]bool{}
+	for _, ref := range checked.ReferenceMap {
+		if len(ref.OverloadId) == 0 && ref.Name != "" {
+			refs[ref.Name] = true
+		}
+	}
+
+	prgOpts := append(p.features.programOptions(), cel.Functions(append(append(functionOverloads(), p.lists.overload()), p.schemas.overloads()...)...))
+	prg, err := env.Program(c, prgOpts...)
+	if err != nil {
+		return compiled{}, err
+	}
+	return compiled{
+		program:    prg,
+		refs:       refs,
+		keys:       selectedKeys(checked.Expr),
+		resultType: checked.TypeMap[checked.Expr.Id],
+	}, nil
+}
+
+// report writes the issues of the expression. They quote the expression, so the ones of the
+// expressions interpolating environment variables are not written, since they would leak their
+// values, and only the source is
+func (p Parser) report(iss cel.Issues, expr, source string) {
+	if expr != source {
+		fmt.Fprintln(p.w, "invalid expression with environment variables:", source)
+		return
+	}
+	fmt.Fprintln(p.w, iss.Err())
+}
+
+// selectedKeys returns the lowercased names of the fields selected by the expression and the
+// string constants used as indexes or as keys of the maps it builds, like the sub of req_jwt.sub,
+// req_jwt['sub'] or {'sub': resp_data.id}
+func selectedKeys(e *exprpb.Expr) map[string]bool {
+	keys := map[string]bool{}
+	walkExpr(e, func(e *exprpb.Expr) {
+		switch k := e.ExprKind.(type) {
+		case *exprpb.Expr_SelectExpr:
+			keys[strings.ToLower(k.SelectExpr.Field)] = true
+		case *exprpb.Expr_StructExpr:
+			for _, entry := range k.StructExpr.Entries {
+				if c := entry.GetMapKey().GetConstExpr(); c != nil {
+					if _, ok := c.ConstantKind.(*exprpb.Constant_StringValue); ok {
+						keys[strings.ToLower(c.GetStringValue())] = true
+					}
+				}
+			}
+		case *exprpb.Expr_CallExpr:
+			if k.CallExpr.Function != operators.Index || len(k.CallExpr.Args) != 2 {
+				return
+			}
+			if c := k.CallExpr.Args[1].GetConstExpr(); c != nil {
+				if _, ok := c.ConstantKind.(*exprpb.Constant_StringValue); ok {
+					keys[strings.ToLower(c.GetStringValue())] = true
+				}
+			}
+		}
+	})
+	return keys
+}
+
+// ParsePre returns the evaluators of the pre checks, sorted by priority
+func (p Parser) ParsePre(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	res, err := p.parseByKey(definitions, PreKey)
+	if err != nil {
+		return sortByPriority(res), err
+	}
+	for i, e := range res {
+		if res[i].Guard, err = p.parseGuard(e.Definition, PreKey); err != nil {
+			return sortByPriority(res), err
+		}
+		if e.Definition.RedirectExpression == "" {
+			continue
+		}
+		if res[i].Redirect, err = p.parseRedirect(e.Definition); err != nil {
+			return sortByPriority(res), err
+		}
+	}
+	return sortByPriority(res), nil
+}
+
+// ParsePost returns the evaluators of the post checks, sorted by priority
+func (p Parser) ParsePost(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	res, err := p.parseByKey(definitions, PostKey)
+	if err != nil {
+		return sortByPriority(res), err
+	}
+	for i, e := range res {
+		if e.Definition.RedirectExpression != "" {
+			return sortByPriority(res), ErrRedirect
+		}
+		if res[i].Guard, err = p.parseGuard(e.Definition, PostKey); err != nil {
+			return sortByPriority(res), err
+		}
 	}
+	return sortByPriority(res), nil
+}
 
-	return env.Program(c)
+// parseGuard returns the evaluator of the when expression of the definition, or nil when it does
+// not declare one. The guard shares the activation of the check, so it can not reference the
+// identifiers of the other phase
+func (p Parser) parseGuard(def InterpretableDefinition, key string) (*Evaluator, error) {
+	if strings.TrimSpace(def.When) == "" {
+		return nil, nil
+	}
+	p.extractor = extractWhen
+	e, err := p.compile(def)
+	if err != nil {
+		return nil, err
+	}
+	if !e.Returns(decls.Bool) {
+		return nil, ErrWhen
+	}
+	foreign := PostKey + "_"
+	if key == PostKey {
+		foreign = PreKey + "_"
+	}
+	for ident := range e.refs {
+		if strings.HasPrefix(ident, foreign) {
+			return nil, ErrWhen
+		}
+	}
+	return &e, nil
 }
 
-func (p Parser) ParsePre(definitions []InterpretableDefinition) ([]cel.Program, error) {
-	return p.parseByKey(definitions, PreKey)
+// parseRedirect returns the evaluator of the redirect expression of the definition. The
+// redirections replace the rejections of the pre checks, so the expression can only use the
+// request identifiers and the status code, when declared, must be a redirection one
+func (p Parser) parseRedirect(def InterpretableDefinition) (*Evaluator, error) {
+	if def.StatusCode != 0 && (def.StatusCode < 300 || def.StatusCode > 399) {
+		return nil, ErrStatus
+	}
+	p.extractor = extractRedirectExpr
+	e, err := p.compile(def)
+	if err != nil {
+		return nil, err
+	}
+	if !e.Returns(decls.String) {
+		return nil, ErrRedirect
+	}
+	for ident := range e.refs {
+		if strings.HasPrefix(ident, PostKey+"_") {
+			return nil, ErrRedirect
+		}
+	}
+	return &e, nil
 }
 
-func (p Parser) ParsePost(definitions []InterpretableDefinition) ([]cel.Program, error) {
-	return p.parseByKey(definitions, PostKey)
+// sortByPriority sorts the evaluators by the priority of their definitions, keeping the order of
+// the ones with the same priority
+func sortByPriority(evaluators []Evaluator) []Evaluator {
+	sort.SliceStable(evaluators, func(i, j int) bool {
+		return evaluators[i].Definition.Priority > evaluators[j].Definition.Priority
+	})
+	return evaluators
 }
 
-func (p Parser) ParseJWT(definitions []InterpretableDefinition) ([]cel.Program, error) {
+func (p Parser) ParseJWT(definitions []InterpretableDefinition) ([]Evaluator, error) {
 	return p.parseByKey(definitions, JwtKey)
 }
 
-func (p Parser) parseByKey(definitions []InterpretableDefinition, key string) ([]cel.Program, error) {
-	res := []cel.Program{}
+func (p Parser) parseByKey(definitions []InterpretableDefinition, key string) ([]Evaluator, error) {
+	res := []Evaluator{}
 	for _, def := range definitions {
-		if !strings.Contains(p.extractor(def), key) {
+		def, err := loadFile(def)
+		if err != nil {
+			return res, err
+		}
+		if def.Type != "" && def.Type != PhasePre && def.Type != PhasePost {
+			return res, ErrType
+		}
+		if !inPhase(def, p.extractor(def), key) {
 			continue
 		}
-		v, err := p.Parse(def)
+		if def.StatusCode != 0 && (def.StatusCode < 100 || def.StatusCode > 599) {
+			return res, ErrStatus
+		}
+		if def.FailPolicy != "" && def.FailPolicy != FailPolicyClosed && def.FailPolicy != FailPolicyOpen {
+			return res, ErrPolicy
+		}
+		if def.Timeout != "" {
+			if d, err := time.ParseDuration(def.Timeout); err != nil || d <= 0 {
+				return res, ErrTimeout
+			}
+		}
+		if !validLogLevel(def.LogLevel) {
+			return res, ErrLogLevel
+		}
+		e, err := p.compile(def)
 		if err == ErrNoExpr {
 			continue
 		}
@@ -115,42 +768,359 @@ func (p Parser) parseByKey(definitions []InterpretableDefinition, key string) ([
 		if err != nil {
 			return res, err
 		}
-		res = append(res, v)
+		if err := checkPhase(e, p.extractor(def), key); err != nil {
+			return res, err
+		}
+		if key == PreKey && e.refs[StoreKey] {
+			return res, PhaseError{Expr: p.extractor(def), Type: PhasePre, Ident: StoreKey}
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// loadFile replaces the check expression of the definitions declaring a file with its contents
+func loadFile(def InterpretableDefinition) (InterpretableDefinition, error) {
+	if def.File == "" {
+		return def, nil
+	}
+	if def.CheckExpression != "" {
+		return def, ErrFile
+	}
+	b, err := ioutil.ReadFile(def.File)
+	if err != nil {
+		return def, fmt.Errorf("cel: reading the expression file: %s", err.Error())
+	}
+	def.CheckExpression = strings.TrimSpace(string(b))
+	return def, nil
+}
+
+// inPhase returns true if the definition belongs to the phase of the key. The definitions
+// without type are selected if their expression contains the key, followed by an underscore for
+// the request and response keys, so req_prev_resp does not select the post phase
+func inPhase(def InterpretableDefinition, expr, key string) bool {
+	switch def.Type {
+	case PhasePre:
+		return key == PreKey
+	case PhasePost:
+		return key == PostKey
+	}
+	if key == PreKey || key == PostKey {
+		key += "_"
+	}
+	return strings.Contains(expr, key)
+}
+
+// checkPhase verifies the expressions of the definitions with an explicit type do not reference
+// the identifiers of the other phase
+func checkPhase(e Evaluator, expr, key string) error {
+	if e.Definition.Type == "" {
+		return nil
+	}
+	foreign := PostKey + "_"
+	if key == PostKey {
+		foreign = PreKey + "_"
+	}
+	idents := make([]string, 0, len(e.refs))
+	for ident := range e.refs {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+	for _, ident := range idents {
+		if strings.HasPrefix(ident, foreign) {
+			return PhaseError{Expr: expr, Type: e.Definition.Type, Ident: ident}
+		}
+	}
+	return nil
+}
+
+// ParseSkip returns the evaluator of the skip condition, or no evaluators if the expression is
+// empty. The condition is evaluated against the request, so it can not reference the response.
+// The parser must be built with NewCheckExpressionParser
+func (p Parser) ParseSkip(expr string) ([]Evaluator, error) {
+	def := InterpretableDefinition{CheckExpression: expr, Type: PhasePre}
+	e, err := p.compile(def)
+	if err == ErrNoExpr {
+		return []Evaluator{}, nil
+	}
+	if err != nil {
+		return []Evaluator{}, err
+	}
+	if err := checkPhase(e, expr, PreKey); err != nil {
+		return []Evaluator{}, err
+	}
+	if !e.Returns(decls.Bool) {
+		return []Evaluator{}, ErrSkip
+	}
+	return []Evaluator{e}, nil
+}
+
+// ParseHeaderMutations returns the evaluators of the mod expressions setting a request header.
+// The parser must be built with NewModExpressionParser
+func (p Parser) ParseHeaderMutations(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	definitions, err := filterByHeader(definitions, true)
+	if err != nil {
+		return []Evaluator{}, err
+	}
+	res, err := p.parseByKey(definitions, PreKey)
+	if err != nil {
+		return res, err
+	}
+	for _, e := range res {
+		if !e.Returns(decls.String) {
+			return res, ErrResult
+		}
 	}
 	return res, nil
 }
 
+// ParseDataMutations returns the evaluators of the mod expressions replacing the data of the
+// response, the ones without header. The parser must be built with NewModExpressionParser
+func (p Parser) ParseDataMutations(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	definitions, err := filterByHeader(definitions, false)
+	if err != nil {
+		return []Evaluator{}, err
+	}
+	res, err := p.parseByKey(definitions, PostKey)
+	if err != nil {
+		return res, err
+	}
+	for _, e := range res {
+		if !e.Returns(decls.Dyn) && !isObjectType(e.resultType) {
+			return res, ErrResult
+		}
+	}
+	return res, nil
+}
+
+// ParseRespHeaderMutations returns the evaluators of the mod expressions mutating the headers of
+// the response. They always belong to the post phase, so their type can be omitted. The parser
+// must be built with NewModExpressionParser
+func (p Parser) ParseRespHeaderMutations(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	defs := []InterpretableDefinition{}
+	for _, def := range definitions {
+		if !def.RespHeaders {
+			continue
+		}
+		if def.Header != "" || def.Type == PhasePre || def.Store != "" || def.RespStatus {
+			return []Evaluator{}, ErrType
+		}
+		def.Type = PhasePost
+		defs = append(defs, def)
+	}
+	res, err := p.parseByKey(defs, PostKey)
+	if err != nil {
+		return res, err
+	}
+	for _, e := range res {
+		if !e.Returns(decls.Dyn) && !isObjectType(e.resultType) {
+			return res, ErrResult
+		}
+	}
+	return res, nil
+}
+
+// ParseRespStatusMutations returns the evaluators of the mod expressions replacing the status code
+// of the response. They always belong to the post phase, so their type can be omitted. The parser
+// must be built with NewModExpressionParser
+func (p Parser) ParseRespStatusMutations(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	defs := []InterpretableDefinition{}
+	for _, def := range definitions {
+		if !def.RespStatus {
+			continue
+		}
+		if def.Header != "" || def.Type == PhasePre || def.Store != "" || def.RespHeaders {
+			return []Evaluator{}, ErrType
+		}
+		def.Type = PhasePost
+		defs = append(defs, def)
+	}
+	res, err := p.parseByKey(defs, PostKey)
+	if err != nil {
+		return res, err
+	}
+	for _, e := range res {
+		if !e.Returns(decls.Int) {
+			return res, ErrResult
+		}
+	}
+	return res, nil
+}
+
+// ParseStoreMutations returns the evaluators of the mod expressions storing their result for the
+// post phase. They always belong to the pre phase, so their type can be omitted, and each one
+// needs a different name. The parser must be built with NewModExpressionParser
+func (p Parser) ParseStoreMutations(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	defs := []InterpretableDefinition{}
+	names := map[string]bool{}
+	for _, def := range definitions {
+		if def.Store == "" {
+			continue
+		}
+		if names[def.Store] || def.Header != "" || def.RespHeaders || def.RespStatus || def.Type == PhasePost {
+			return []Evaluator{}, ErrStore
+		}
+		names[def.Store] = true
+		def.Type = PhasePre
+		defs = append(defs, def)
+	}
+	return p.parseByKey(defs, PreKey)
+}
+
+// filterByHeader returns the definitions with (or without) header. The header mutations can only
+// be applied to the requests and the data mutations to the responses, so the mod definitions
+// with the type of the other phase are invalid
+func filterByHeader(definitions []InterpretableDefinition, withHeader bool) ([]InterpretableDefinition, error) {
+	invalidType := PhasePre
+	if withHeader {
+		invalidType = PhasePost
+	}
+	res := []InterpretableDefinition{}
+	for _, def := range definitions {
+		if (def.Header != "") != withHeader || def.RespHeaders || def.RespStatus || def.Store != "" {
+			continue
+		}
+		if def.ModExpression != "" && def.Type == invalidType {
+			return res, ErrType
+		}
+		res = append(res, def)
+	}
+	return res, nil
+}
+
+// isObjectType returns true for the maps with string (or dynamic) keys
+func isObjectType(t *exprpb.Type) bool {
+	m := t.GetMapType()
+	if m == nil {
+		return false
+	}
+	return proto.Equal(m.KeyType, decls.String) || proto.Equal(m.KeyType, decls.Dyn)
+}
+
+// NativeValue converts the CEL value into its native representation, turning the maps and lists
+// into map[string]interface{} and []interface{}. The lists are checked first, since they also
+// implement the traits.Mapper interface
+func NativeValue(v ref.Val) interface{} {
+	switch val := v.(type) {
+	case traits.Lister:
+		res := []interface{}{}
+		for it := val.Iterator(); it.HasNext() == types.True; {
+			res = append(res, NativeValue(it.Next()))
+		}
+		return res
+	case traits.Mapper:
+		res := map[string]interface{}{}
+		for it := val.Iterator(); it.HasNext() == types.True; {
+			k := it.Next()
+			res[fmt.Sprintf("%v", k.Value())] = NativeValue(val.Get(k))
+		}
+		return res
+	case types.Null:
+		return nil
+	default:
+		return v.Value()
+	}
+}
+
 func defaultDeclarations() cel.EnvOption {
-	return cel.Declarations(
-		decls.NewIdent(NowKey, decls.String, nil),
+	return cel.Declarations(defaultIdents()...)
+}
+
+// Identifiers returns the names of the identifiers declared by the module, but not the vars
+func Identifiers() []string {
+	idents := defaultIdents()
+	res := make([]string, len(idents))
+	for i, ident := range idents {
+		res[i] = ident.Name
+	}
+	return res
+}
 
+func defaultIdents() []*exprpb.Decl {
+	return []*exprpb.Decl{
+		decls.NewIdent(NowKey, decls.Timestamp, nil),
+		// same instant as now, in seconds since the epoch: int(req_jwt.exp) - now_unix < 60
+		decls.NewIdent(NowUnixKey, decls.Int, nil),
+		// endpoint (or url pattern of the backend) of the pipe: endpoint.startsWith('/admin')
+		decls.NewIdent(EndpointKey, decls.String, nil),
+
+		// uppercased method of the request: req_method == 'POST'
 		decls.NewIdent(PreKey+"_method", decls.String, nil),
 		decls.NewIdent(PreKey+"_path", decls.String, nil),
+		// non-empty, decoded segments of the path: req_path_segments[1] == req_jwt.sub
+		decls.NewIdent(PreKey+"_path_segments", decls.NewListType(decls.String), nil),
 		decls.NewIdent(PreKey+"_params", decls.NewMapType(decls.String, decls.String), nil),
 		decls.NewIdent(PreKey+"_headers", decls.NewMapType(decls.String, decls.NewListType(decls.String)), nil),
 		decls.NewIdent(PreKey+"_querystring", decls.NewMapType(decls.String, decls.NewListType(decls.String)), nil),
+		decls.NewIdent(PreKey+"_client_ip", decls.String, nil),
+		decls.NewIdent(PreKey+"_host", decls.String, nil),
+		decls.NewIdent(PreKey+"_scheme", decls.String, nil),
+		// transport security declared by the proxies terminating TLS: req_tls && req_tls_version == 'TLSv1.3'
+		decls.NewIdent(PreKey+"_tls", decls.Bool, nil),
+		decls.NewIdent(PreKey+"_tls_version", decls.String, nil),
+		// media type of the body, lowercased and without parameters: req_content_type == 'application/json'
+		decls.NewIdent(PreKey+"_content_type", decls.String, nil),
+		decls.NewIdent(PreKey+"_cookies", decls.NewMapType(decls.String, decls.String), nil),
+		// first value of the Authorization header, as received: req_authorization.startsWith('Basic ')
+		decls.NewIdent(PreKey+"_authorization", decls.String, nil),
+		// metadata forwarded to the gRPC backends, by lowercase key: req_grpc_metadata['x-tenant'][0] == 'acme'
+		decls.NewIdent(PreKey+"_grpc_metadata", decls.NewMapType(decls.String, decls.NewListType(decls.String)), nil),
+		// merged data of the previous backends of a sequential endpoint: req_prev_resp.status == 'active'
+		decls.NewIdent(PreKey+"_prev_resp", decls.NewMapType(decls.String, decls.Dyn), nil),
 		// jwt is part of the "pre" values; now it's possible to do something like: req_jwt.userID == req_params.userID
 		decls.NewIdent(PreKey+"_jwt", decls.NewMapType(decls.String, decls.Dyn), nil),
+		// header of the same token, so rules can check its alg or kid: req_jwt_header.alg == "RS256"
+		decls.NewIdent(PreKey+"_jwt_header", decls.NewMapType(decls.String, decls.Dyn), nil),
 		// body contains "application/json" or "multipart/form-data" data as map[string]interface{}
 		decls.NewIdent(PreKey+"_body", decls.NewMapType(decls.String, decls.Dyn), nil),
+		// metadata of the files uploaded with a multipart body: req_body_files.avatar[0].size < 1048576
+		decls.NewIdent(PreKey+"_body_files", decls.NewMapType(decls.String, decls.NewListType(decls.NewMapType(decls.String, decls.Dyn))), nil),
+		// verbatim body, for checking its signature: hmacSHA256('secret', req_body_raw)
+		decls.NewIdent(PreKey+"_body_raw", decls.String, nil),
+		// size in bytes of the body, for any content type: req_body_size <= 1048576
+		decls.NewIdent(PreKey+"_body_size", decls.Int, nil),
+		// body encoded in base64, only available with the req_body_b64 option: req_body_b64.startsWith('iVBORw0KGgo')
+		decls.NewIdent(PreKey+"_body_b64", decls.String, nil),
 
 		decls.NewIdent(PostKey+"_completed", decls.Bool, nil),
 		decls.NewIdent(PostKey+"_metadata_status", decls.Int, nil),
 		decls.NewIdent(PostKey+"_metadata_headers", decls.NewMapType(decls.String, decls.NewListType(decls.String)), nil),
+		decls.NewIdent(PostKey+"_content_type", decls.String, nil),
 		decls.NewIdent(PostKey+"_data", decls.NewMapType(decls.String, decls.Dyn), nil),
+		// time spent by the backends (or the next stages of the pipe): resp_duration_ms < 500
+		decls.NewIdent(PostKey+"_duration_ms", decls.Int, nil),
+		// number of backends of the endpoint and how many of them returned a complete response:
+		// resp_backends_completed == resp_backends
+		decls.NewIdent(PostKey+"_backends", decls.Int, nil),
+		decls.NewIdent(PostKey+"_backends_completed", decls.Int, nil),
+		// size in bytes of the data serialized as JSON: resp_data_size < 1048576
+		decls.NewIdent(PostKey+"_data_size", decls.Int, nil),
+		// data serialized as JSON, only available with the resp_body_raw option
+		decls.NewIdent(PostKey+"_body_raw", decls.String, nil),
+
+		decls.NewIdent(StoreKey, decls.NewMapType(decls.String, decls.Dyn), nil),
 
 		decls.NewIdent(JwtKey, decls.NewMapType(decls.String, decls.Dyn), nil),
-	)
+	}
 }
 
 func extractCheckExpr(i InterpretableDefinition) string { return i.CheckExpression }
 func extractModExpr(i InterpretableDefinition) string   { return i.ModExpression }
+func extractRedirectExpr(i InterpretableDefinition) string {
+	return i.RedirectExpression
+}
+func extractWhen(i InterpretableDefinition) string { return i.When }
 
 const (
-	PreKey  = "req"
-	PostKey = "resp"
-	JwtKey  = "JWT"
-	NowKey  = "now"
+	PreKey      = "req"
+	PostKey     = "resp"
+	JwtKey      = "JWT"
+	NowKey      = "now"
+	NowUnixKey  = "now_unix"
+	EndpointKey = "endpoint"
+	// StoreKey is the identifier of the values stored by the pre phase, only available to the post
+	// expressions: pre.tenant == resp_data.tenant
+	StoreKey = "pre"
 )
 
 type logger struct {
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func BenchmarkParser_compile(b *testing.B) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	expr := "req_method == 'GET' && 'admin' in req_jwt.roles && inCIDR(req_client_ip, '10.0.0.0/8')"
+
+	b.Run("cold", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			def := InterpretableDefinition{CheckExpression: fmt.Sprintf("%s && now_unix > %d", expr, i)}
+			if _, err := p.compile(def); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("warm", func(b *testing.B) {
+		def := InterpretableDefinition{CheckExpression: expr}
+		if _, err := p.compile(def); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := p.compile(def); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,499 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestParser_ParseHeaderMutations(t *testing.T) {
+	p := NewModExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		def InterpretableDefinition
+		err error
+	}{
+		{def: InterpretableDefinition{ModExpression: "req_jwt.tenant", Header: "X-Tenant-Id"}, err: nil},
+		{def: InterpretableDefinition{ModExpression: "req_path + '!'", Header: "X-Path"}, err: nil},
+		{def: InterpretableDefinition{ModExpression: "req_method == 'GET'", Header: "X-Get"}, err: ErrResult},
+		{def: InterpretableDefinition{ModExpression: "req_headers", Header: "X-Headers"}, err: ErrResult},
+		{def: InterpretableDefinition{CheckExpression: "req_method == 'GET'"}, err: nil},
+		{def: InterpretableDefinition{ModExpression: "req_path", Header: "X-Path", Type: PhasePre}, err: nil},
+		{def: InterpretableDefinition{ModExpression: "req_path", Header: "X-Path", Type: PhasePost}, err: ErrType},
+	} {
+		if _, err := p.ParseHeaderMutations([]InterpretableDefinition{tc.def}); err != tc.err {
+			t.Errorf("%+v: unexpected error: %v", tc.def, err)
+		}
+	}
+}
+
+func TestParser_ParseDataMutations(t *testing.T) {
+	p := NewModExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		def      InterpretableDefinition
+		expected int
+		err      error
+	}{
+		{def: InterpretableDefinition{ModExpression: "{'id': resp_data.id}"}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "resp_data"}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "resp_data.user"}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "{'total': size(resp_data)}"}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "resp_data.user", Header: "X-User"}, expected: 0},
+		{def: InterpretableDefinition{ModExpression: "size(resp_data)"}, err: ErrResult},
+		{def: InterpretableDefinition{ModExpression: "[resp_data]"}, err: ErrResult},
+		{def: InterpretableDefinition{ModExpression: "{1: resp_data}"}, err: ErrResult},
+		{def: InterpretableDefinition{ModExpression: "resp_data", Type: PhasePost}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "resp_data", Type: PhasePre}, err: ErrType},
+	} {
+		res, err := p.ParseDataMutations([]InterpretableDefinition{tc.def})
+		if err != tc.err {
+			t.Errorf("%+v: unexpected error: %v", tc.def, err)
+			continue
+		}
+		if err == nil && len(res) != tc.expected {
+			t.Errorf("%+v: unexpected number of evaluators: %d", tc.def, len(res))
+		}
+	}
+}
+
+func TestParser_ParseRespHeaderMutations(t *testing.T) {
+	p := NewModExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		def      InterpretableDefinition
+		expected int
+		err      error
+	}{
+		{def: InterpretableDefinition{ModExpression: "{'Cache-Control': 'no-store'}", RespHeaders: true}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "{'X-Id': string(resp_data.id), 'Server': null}", RespHeaders: true}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "resp_metadata_headers", RespHeaders: true}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "{'Cache-Control': 'no-store'}"}, expected: 0},
+		{def: InterpretableDefinition{ModExpression: "'no-store'", RespHeaders: true}, err: ErrResult},
+		{def: InterpretableDefinition{ModExpression: "{1: 'no-store'}", RespHeaders: true}, err: ErrResult},
+		{def: InterpretableDefinition{ModExpression: "{'A': 'b'}", RespHeaders: true, Type: PhasePre}, err: ErrType},
+		{def: InterpretableDefinition{ModExpression: "{'A': 'b'}", RespHeaders: true, Header: "X-A"}, err: ErrType},
+	} {
+		res, err := p.ParseRespHeaderMutations([]InterpretableDefinition{tc.def})
+		if err != tc.err {
+			t.Errorf("%+v: unexpected error: %v", tc.def, err)
+			continue
+		}
+		if err == nil && len(res) != tc.expected {
+			t.Errorf("%+v: unexpected number of evaluators: %d", tc.def, len(res))
+		}
+	}
+
+	// the response header mutations are not data mutations
+	res, err := p.ParseDataMutations([]InterpretableDefinition{{ModExpression: "{'Cache-Control': resp_data.cache}", RespHeaders: true}})
+	if err != nil || len(res) != 0 {
+		t.Errorf("unexpected data mutations: %v %v", res, err)
+	}
+}
+
+func TestParser_ParseRespStatusMutations(t *testing.T) {
+	p := NewModExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		def      InterpretableDefinition
+		expected int
+		err      error
+	}{
+		{def: InterpretableDefinition{ModExpression: "resp_metadata_status == 418 ? 400 : resp_metadata_status", RespStatus: true}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "resp_data.code", RespStatus: true}, expected: 1},
+		{def: InterpretableDefinition{ModExpression: "resp_metadata_status"}, expected: 0},
+		{def: InterpretableDefinition{ModExpression: "'400'", RespStatus: true}, err: ErrResult},
+		{def: InterpretableDefinition{ModExpression: "400.0", RespStatus: true}, err: ErrResult},
+		{def: InterpretableDefinition{ModExpression: "400", RespStatus: true, Type: PhasePre}, err: ErrType},
+		{def: InterpretableDefinition{ModExpression: "400", RespStatus: true, Header: "X-A"}, err: ErrType},
+		{def: InterpretableDefinition{ModExpression: "400", RespStatus: true, RespHeaders: true}, err: ErrType},
+	} {
+		res, err := p.ParseRespStatusMutations([]InterpretableDefinition{tc.def})
+		if err != tc.err {
+			t.Errorf("%+v: unexpected error: %v", tc.def, err)
+			continue
+		}
+		if err == nil && len(res) != tc.expected {
+			t.Errorf("%+v: unexpected number of evaluators: %d", tc.def, len(res))
+		}
+	}
+
+	// the response status mutations are not data mutations
+	res, err := p.ParseDataMutations([]InterpretableDefinition{{ModExpression: "400", RespStatus: true}})
+	if err != nil || len(res) != 0 {
+		t.Errorf("unexpected data mutations: %v %v", res, err)
+	}
+}
+
+func TestParser_ParseStoreMutations(t *testing.T) {
+	p := NewModExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		defs     []InterpretableDefinition
+		expected int
+		err      error
+	}{
+		{defs: []InterpretableDefinition{{ModExpression: "req_jwt.tenant", Store: "tenant"}}, expected: 1},
+		{defs: []InterpretableDefinition{{ModExpression: "size(req_path_segments)", Store: "depth"}, {ModExpression: "now_unix", Store: "start"}}, expected: 2},
+		{defs: []InterpretableDefinition{{ModExpression: "req_method", Header: "X-Method"}}, expected: 0},
+		{defs: []InterpretableDefinition{{ModExpression: "req_method", Store: "a"}, {ModExpression: "req_path", Store: "a"}}, err: ErrStore},
+		{defs: []InterpretableDefinition{{ModExpression: "req_method", Store: "a", Header: "X-A"}}, err: ErrStore},
+		{defs: []InterpretableDefinition{{ModExpression: "{'A': 'b'}", Store: "a", RespHeaders: true}}, err: ErrStore},
+		{defs: []InterpretableDefinition{{ModExpression: "resp_completed", Store: "a", Type: PhasePost}}, err: ErrStore},
+		{defs: []InterpretableDefinition{{ModExpression: "resp_completed", Store: "a"}}, err: PhaseError{Expr: "resp_completed", Type: PhasePre, Ident: "resp_completed"}},
+		{defs: []InterpretableDefinition{{ModExpression: "pre.a", Store: "b"}}, err: PhaseError{Expr: "pre.a", Type: PhasePre, Ident: StoreKey}},
+	} {
+		res, err := p.ParseStoreMutations(tc.defs)
+		if err != tc.err {
+			t.Errorf("%+v: unexpected error: %v", tc.defs, err)
+			continue
+		}
+		if err == nil && len(res) != tc.expected {
+			t.Errorf("%+v: unexpected number of evaluators: %d", tc.defs, len(res))
+		}
+	}
+
+	// the store mutations are neither header nor data mutations
+	defs := []InterpretableDefinition{{ModExpression: "req_jwt.tenant", Store: "tenant", Type: PhasePre}}
+	if res, err := p.ParseHeaderMutations(defs); err != nil || len(res) != 0 {
+		t.Errorf("unexpected header mutations: %v %v", res, err)
+	}
+	if res, err := p.ParseDataMutations(defs); err != nil || len(res) != 0 {
+		t.Errorf("unexpected data mutations: %v %v", res, err)
+	}
+
+	c := NewCheckExpressionParser(logging.NoOp)
+	if res, err := c.ParsePost([]InterpretableDefinition{{CheckExpression: "pre.tenant == resp_data.tenant"}}); err != nil || len(res) != 1 {
+		t.Errorf("unexpected post checks: %v %v", res, err)
+	}
+	if _, err := c.ParsePre([]InterpretableDefinition{{CheckExpression: "pre.tenant == req_jwt.tenant"}}); err == nil {
+		t.Error("expecting error for the pre check referencing the store")
+	}
+}
+
+func TestParser_ParseSkip(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		expr     string
+		expected int
+		err      error
+	}{
+		{expr: "", expected: 0},
+		{expr: "'X-Probe' in req_headers", expected: 1},
+		{expr: "req_path.startsWith('/__health')", expected: 1},
+		{expr: "req_method", err: ErrSkip},
+		{expr: "resp_completed", err: PhaseError{Expr: "resp_completed", Type: PhasePre, Ident: "resp_completed"}},
+		{expr: "req_method ==", err: ErrParsing},
+	} {
+		res, err := p.ParseSkip(tc.expr)
+		if err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+			continue
+		}
+		if err == nil && len(res) != tc.expected {
+			t.Errorf("%s: unexpected number of evaluators: %d", tc.expr, len(res))
+		}
+	}
+}
+
+func TestParser_priority(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	definitions := []InterpretableDefinition{
+		{CheckExpression: "size(req_body) < 10", RejectMessage: "body"},
+		{CheckExpression: "'X-Key' in req_headers", RejectMessage: "header", Priority: 10},
+		{CheckExpression: "req_method == 'GET'", RejectMessage: "method"},
+		{CheckExpression: "req_path != '/'", RejectMessage: "path", Priority: 10},
+		{CheckExpression: "now_unix > 0", Type: PhasePre, RejectMessage: "last", Priority: -1},
+		{CheckExpression: "resp_completed", RejectMessage: "completed"},
+		{CheckExpression: "resp_data_size < 100", RejectMessage: "size", Priority: 1},
+	}
+
+	for _, tc := range []struct {
+		parse    func([]InterpretableDefinition) ([]Evaluator, error)
+		expected []string
+	}{
+		{parse: p.ParsePre, expected: []string{"header", "path", "body", "method", "last"}},
+		{parse: p.ParsePost, expected: []string{"size", "completed"}},
+	} {
+		res, err := tc.parse(definitions)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		order := make([]string, len(res))
+		for i, e := range res {
+			order[i] = e.Definition.RejectMessage
+		}
+		if strings.Join(order, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("unexpected order: %v", order)
+		}
+	}
+}
+
+func TestParser_timeout(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		timeout string
+		err     error
+	}{
+		{timeout: "", err: nil},
+		{timeout: "150ms", err: nil},
+		{timeout: "0s", err: ErrTimeout},
+		{timeout: "-1s", err: ErrTimeout},
+		{timeout: "fast", err: ErrTimeout},
+	} {
+		_, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "req_method == 'GET'", Timeout: tc.timeout}})
+		if err != tc.err {
+			t.Errorf("'%s': unexpected error: %v", tc.timeout, err)
+		}
+	}
+	if d := (InterpretableDefinition{}).EvalTimeout(); d != DefaultTimeout {
+		t.Errorf("unexpected default timeout: %s", d)
+	}
+	if d := (InterpretableDefinition{Timeout: "150ms"}).EvalTimeout(); d != 150*time.Millisecond {
+		t.Errorf("unexpected timeout: %s", d)
+	}
+}
+
+func TestParser_logLevel(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		level string
+		err   error
+	}{
+		{level: "", err: nil},
+		{level: LogLevelWarning, err: nil},
+		{level: "debug", err: nil},
+		{level: "Error", err: nil},
+		{level: "verbose", err: ErrLogLevel},
+		{level: "CRITICAL", err: ErrLogLevel},
+	} {
+		_, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "req_method == 'GET'", LogLevel: tc.level}})
+		if err != tc.err {
+			t.Errorf("'%s': unexpected error: %v", tc.level, err)
+		}
+	}
+}
+
+func TestParser_redirect(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		def InterpretableDefinition
+		err error
+	}{
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RedirectExpression: "'/login?next=' + req_path"}},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RedirectExpression: "req_querystring.back[0]"}},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RedirectExpression: "'/login'", StatusCode: 303}},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RedirectExpression: "'/login'", StatusCode: 403}, err: ErrStatus},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RedirectExpression: "size(req_path)"}, err: ErrRedirect},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RedirectExpression: "resp_data.url"}, err: ErrRedirect},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", RedirectExpression: "'/login' +"}, err: ErrParsing},
+	} {
+		res, err := p.ParsePre([]InterpretableDefinition{tc.def})
+		if err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.def.RedirectExpression, err)
+			continue
+		}
+		if err == nil && (len(res) != 1 || res[0].Redirect == nil) {
+			t.Errorf("%s: unexpected evaluators: %+v", tc.def.RedirectExpression, res)
+		}
+	}
+
+	if _, err := p.ParsePost([]InterpretableDefinition{{CheckExpression: "resp_completed", RedirectExpression: "'/login'"}}); err != ErrRedirect {
+		t.Errorf("unexpected error for the post check: %v", err)
+	}
+	res, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "'X-User' in req_headers"}})
+	if err != nil || len(res) != 1 || res[0].Redirect != nil {
+		t.Errorf("unexpected evaluators: %+v %v", res, err)
+	}
+}
+
+func TestParser_redacted(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp).WithRedacted(append(DefaultLogRedact, "Email"))
+	for _, tc := range []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: "has(req_jwt.sub)", expected: true},
+		{expr: "req_authorization.startsWith('Basic ')", expected: true},
+		{expr: "req_body.name == 'alice'", expected: true},
+		{expr: "req_method == 'GET'"},
+		{expr: "req_headers['X-Email'][0] != ''"},
+		{expr: "resp_data.email != ''", expected: true},
+		{expr: "resp_data['EMAIL'] != ''", expected: true},
+		{expr: "size({'email': resp_data.id}) > 0", expected: true},
+		{expr: "resp_data.id > 0"},
+	} {
+		e, err := p.compile(InterpretableDefinition{CheckExpression: tc.expr})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if e.Redacted != tc.expected {
+			t.Errorf("%s: unexpected redaction %v", tc.expr, e.Redacted)
+		}
+	}
+
+	cfg := Config{}
+	if keys := cfg.LogRedactKeys(); len(keys) != len(DefaultLogRedact) {
+		t.Errorf("unexpected default keys: %v", keys)
+	}
+	cfg.LogRedact = []string{}
+	if keys := cfg.LogRedactKeys(); len(keys) != 0 {
+		t.Errorf("the empty list does not disable the redaction: %v", keys)
+	}
+}
+
+func TestConfig_WithGroups(t *testing.T) {
+	groups := map[string][]InterpretableDefinition{
+		"a": {{CheckExpression: "a1"}, {CheckExpression: "a2"}},
+		"b": {{CheckExpression: "b1"}},
+	}
+	cfg, err := Config{Include: []string{"b", "a", "b"}, Definitions: []InterpretableDefinition{{CheckExpression: "own"}}}.WithGroups(groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exprs []string
+	for _, def := range cfg.Definitions {
+		exprs = append(exprs, def.CheckExpression)
+	}
+	if strings.Join(exprs, ",") != "b1,a1,a2,own" {
+		t.Errorf("unexpected definitions: %v", exprs)
+	}
+
+	if _, err := (Config{Include: []string{"a", "c"}}).WithGroups(groups); err != ErrGroup {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if cfg, err := (Config{}).WithGroups(groups); err != nil || len(cfg.Definitions) != 0 {
+		t.Errorf("unexpected config: %+v %v", cfg, err)
+	}
+}
+
+func TestParser_when(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		def InterpretableDefinition
+		err error
+	}{
+		{def: InterpretableDefinition{CheckExpression: "size(req_body.items) > 0", When: "req_method == 'POST'"}},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", When: "req_path.startsWith('/admin')", Type: PhasePre}},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", When: "req_path"}, err: ErrWhen},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", When: "resp_completed"}, err: ErrWhen},
+		{def: InterpretableDefinition{CheckExpression: "'X-User' in req_headers", When: "req_method =="}, err: ErrParsing},
+	} {
+		res, err := p.ParsePre([]InterpretableDefinition{tc.def})
+		if err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.def.When, err)
+			continue
+		}
+		if err == nil && (len(res) != 1 || res[0].Guard == nil) {
+			t.Errorf("%s: unexpected evaluators: %+v", tc.def.When, res)
+		}
+	}
+
+	res, err := p.ParsePost([]InterpretableDefinition{{CheckExpression: "resp_data.ok", When: "resp_completed"}})
+	if err != nil || len(res) != 1 || res[0].Guard == nil {
+		t.Errorf("unexpected post evaluators: %+v %v", res, err)
+	}
+	if _, err := p.ParsePost([]InterpretableDefinition{{CheckExpression: "resp_data.ok", When: "req_method == 'GET'"}}); err != ErrWhen {
+		t.Errorf("unexpected error for the post guard: %v", err)
+	}
+	res, err = p.ParsePre([]InterpretableDefinition{{CheckExpression: "'X-User' in req_headers"}})
+	if err != nil || len(res) != 1 || res[0].Guard != nil {
+		t.Errorf("unexpected evaluators: %+v %v", res, err)
+	}
+}
+
+func TestParser_type(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	definitions := []InterpretableDefinition{
+		{CheckExpression: "req_method == 'GET'"},
+		{CheckExpression: "now_unix > 0", Type: PhasePre},
+		{CheckExpression: "resp_completed", Type: PhasePost},
+		{CheckExpression: "req_params.Kind == 'response'", Type: PhasePre},
+		{CheckExpression: "now_unix > 0", Type: PhasePost},
+	}
+
+	pre, err := p.ParsePre(definitions)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(pre) != 3 || pre[1].Definition.Type != PhasePre || pre[2].Definition.Type != PhasePre {
+		t.Errorf("unexpected pre evaluators: %+v", pre)
+	}
+
+	post, err := p.ParsePost(definitions)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(post) != 2 || post[0].Definition.Type != PhasePost || post[1].Definition.Type != PhasePost {
+		t.Errorf("unexpected post evaluators: %+v", post)
+	}
+}
+
+func TestParser_typeErrors(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+
+	if _, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "req_method == 'GET'", Type: "before"}}); err != ErrType {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "req_method == 'GET' && resp_completed", Type: PhasePre}})
+	if perr, ok := err.(PhaseError); !ok || perr.Ident != "resp_completed" || perr.Type != PhasePre {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = p.ParsePost([]InterpretableDefinition{{CheckExpression: "resp_completed || req_method == 'GET'", Type: PhasePost}})
+	if perr, ok := err.(PhaseError); !ok || perr.Ident != "req_method" || perr.Type != PhasePost {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err != nil && err.Error() != "cel: the post expression 'resp_completed || req_method == 'GET'' references req_method, only available in the other phase" {
+		t.Errorf("unexpected message: %s", err.Error())
+	}
+}
+
+func TestParser_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "krakend-cel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "admin.cel")
+	if err := ioutil.WriteFile(file, []byte("req_method == 'GET' &&\n  'admin' in req_jwt.roles\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewCheckExpressionParser(logging.NoOp)
+	pre, err := p.ParsePre([]InterpretableDefinition{{File: file}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(pre) != 1 || !pre[0].References(PreKey+"_jwt") {
+		t.Errorf("unexpected pre evaluators: %+v", pre)
+	}
+	if expr := pre[0].Definition.CheckExpression; expr != "req_method == 'GET' &&\n  'admin' in req_jwt.roles" {
+		t.Errorf("unexpected expression: %s", expr)
+	}
+
+	post, err := p.ParsePost([]InterpretableDefinition{{File: file}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(post) != 0 {
+		t.Errorf("unexpected post evaluators: %+v", post)
+	}
+
+	if _, err := p.ParsePre([]InterpretableDefinition{{File: file, CheckExpression: "req_method == 'GET'"}}); err != ErrFile {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = p.ParsePre([]InterpretableDefinition{{File: filepath.Join(dir, "missing.cel")}})
+	if err == nil || !strings.Contains(err.Error(), "missing.cel") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// jwsParts is the number of segments of a signed token (JWS) in compact form
+const jwsParts = 3
+
+// DecodeJWTSegment decodes a base64url encoded segment of a token, unpadded as the RFC 7515
+// requires, into the JSON object it contains
+func DecodeJWTSegment(segment string) (map[string]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// decodeJWT returns the claims of a signed token found anywhere in the request, decoded like the
+// ones of req_jwt. The signature is not verified
+func decodeJWT(val ref.Val) ref.Val {
+	s, ok := val.(types.String)
+	if !ok {
+		return types.NewErr("decodeJWT: unexpected token type %s", val.Type().TypeName())
+	}
+	parts := strings.Split(string(s), ".")
+	if len(parts) != jwsParts {
+		return types.NewErr("decodeJWT: token with %d parts", len(parts))
+	}
+	claims, err := DecodeJWTSegment(parts[1])
+	if err != nil {
+		return types.NewErr("decodeJWT: decoding the payload: %s", err.Error())
+	}
+	return types.DefaultTypeAdapter.NativeToValue(claims)
+}
+
+// jwtAudienceContains checks if the audience of the claims includes the value. As stated by the
+// RFC 7519, the aud claim can be either a single string or a list of them. Tokens without
+// audience (or without claims at all) do not contain any
+func jwtAudienceContains(lhs, rhs ref.Val) ref.Val {
+	audience, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("jwtAudienceContains: unexpected audience type %s", rhs.Type().TypeName())
+	}
+	aud, err := claim("jwtAudienceContains", lhs, "aud")
+	if err != nil || aud == nil {
+		return orFalse(err)
+	}
+
+	switch v := aud.(type) {
+	case types.String:
+		return types.Bool(v == audience)
+	case traits.Lister:
+		for it := v.Iterator(); it.HasNext() == types.True; {
+			if s, ok := it.Next().(types.String); ok && s == audience {
+				return types.True
+			}
+		}
+		return types.False
+	default:
+		return types.False
+	}
+}
+
+// scopeClaims are the claims granting the OAuth scopes: scope is a space-delimited string, as the
+// RFC 8693 defines it, while some providers send scp, sometimes as a list of strings
+var scopeClaims = []string{"scope", "scp"}
+
+// hasScope checks if any of the scope claims grants the scope, whether they are space-delimited
+// strings or lists of strings. Tokens without scopes (or without claims at all) do not grant any,
+// and neither does an empty scope
+func hasScope(lhs, rhs ref.Val) ref.Val {
+	scope, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("hasScope: unexpected scope type %s", rhs.Type().TypeName())
+	}
+	if strings.TrimSpace(string(scope)) == "" {
+		return types.False
+	}
+	for _, name := range scopeClaims {
+		granted, err := claim("hasScope", lhs, name)
+		if err != nil {
+			return err
+		}
+		if grantsScope(granted, string(scope)) {
+			return types.True
+		}
+	}
+	return types.False
+}
+
+func grantsScope(granted ref.Val, scope string) bool {
+	switch v := granted.(type) {
+	case types.String:
+		for _, s := range strings.Fields(string(v)) {
+			if s == scope {
+				return true
+			}
+		}
+	case traits.Lister:
+		for it := v.Iterator(); it.HasNext() == types.True; {
+			if s, ok := it.Next().(types.String); ok && string(s) == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtIssuer returns the iss claim, or an empty string if the claims do not have a string issuer
+func jwtIssuer(val ref.Val) ref.Val {
+	iss, err := claim("jwtIssuer", val, "iss")
+	if err != nil {
+		return err
+	}
+	if s, ok := iss.(types.String); ok {
+		return s
+	}
+	return types.String("")
+}
+
+// claim returns the value of the claim, nil if the claims are missing or they do not include it
+func claim(fn string, val ref.Val, name string) (ref.Val, ref.Val) {
+	if val == types.NullValue {
+		return nil, nil
+	}
+	claims, ok := val.(traits.Mapper)
+	if !ok {
+		return nil, types.NewErr("%s: unexpected claims type %s", fn, val.Type().TypeName())
+	}
+	key := types.String(name)
+	if claims.Contains(key) != types.True {
+		return nil, nil
+	}
+	return claims.Get(key), nil
+}
+
+func orFalse(err ref.Val) ref.Val {
+	if err != nil {
+		return err
+	}
+	return types.False
+}
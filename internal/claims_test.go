@@ -0,0 +1,74 @@
+package internal
+
+import "testing"
+
+func TestJWTClaims(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "jwtAudienceContains({'aud': 'my-api'}, 'my-api')", expected: true},
+		{expr: "jwtAudienceContains({'aud': 'other-api'}, 'my-api')", expected: false},
+		{expr: "jwtAudienceContains({'aud': ['other-api', 'my-api']}, 'my-api')", expected: true},
+		{expr: "jwtAudienceContains({'aud': ['other-api']}, 'my-api')", expected: false},
+		{expr: "jwtAudienceContains({'aud': []}, 'my-api')", expected: false},
+		{expr: "jwtAudienceContains({'sub': 'alice'}, 'my-api')", expected: false},
+		{expr: "jwtAudienceContains({'aud': 42}, 'my-api')", expected: false},
+		{expr: "hasScope({'scope': 'openid read:orders write:orders'}, 'read:orders')", expected: true},
+		{expr: "hasScope({'scope': 'read:orders'}, 'read:orders')", expected: true},
+		{expr: "hasScope({'scope': 'read:orders-archive'}, 'read:orders')", expected: false},
+		{expr: "hasScope({'scope': ''}, 'read:orders')", expected: false},
+		{expr: "hasScope({'scp': ['openid', 'read:orders']}, 'read:orders')", expected: true},
+		{expr: "hasScope({'scp': ['openid', 'read']}, 'read:orders')", expected: false},
+		{expr: "hasScope({'scp': 'openid read:orders'}, 'read:orders')", expected: true},
+		{expr: "hasScope({'scope': 'openid', 'scp': ['read:orders']}, 'read:orders')", expected: true},
+		{expr: "hasScope({'scope': 'read:orders'}, '')", expected: false},
+		{expr: "hasScope({'scope': 42}, 'read:orders')", expected: false},
+		{expr: "hasScope({'sub': 'alice'}, 'read:orders')", expected: false},
+		{expr: "jwtIssuer({'iss': 'https://idp.example.com/'}) == 'https://idp.example.com/'", expected: true},
+		{expr: "jwtIssuer({'sub': 'alice'})", expected: ""},
+		{expr: "jwtIssuer({'iss': 42})", expected: ""},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestDecodeJWT(t *testing.T) {
+	token := "eyJhbGciOiJub25lIn0.eyJzdWIiOiJhbGljZSIsImF1ZCI6WyJteS1hcGkiXSwiZXhwIjoxNzAwMDAwMDAwfQ.sig"
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "decodeJWT('" + token + "').sub", expected: "alice"},
+		{expr: "decodeJWT('" + token + "').exp == 1700000000.0", expected: true},
+		{expr: "jwtAudienceContains(decodeJWT('" + token + "'), 'my-api')", expected: true},
+		{expr: "jwtIssuer(decodeJWT('" + token + "'))", expected: ""},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+
+	for _, expr := range []string{
+		"decodeJWT('') == {}",
+		"decodeJWT('a.b') == {}",
+		"decodeJWT('eyJhbGciOiJub25lIn0.!!!.sig') == {}",
+		"decodeJWT('eyJhbGciOiJub25lIn0.bm90IGpzb24.sig') == {}",
+	} {
+		if _, err := evalExpr(expr); err == nil {
+			t.Errorf("%s: expecting error", expr)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/parser"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// presentFunction is the internal function testing the keys navigated by the null-safe helpers.
+// Like the operators of CEL, it can not be called from the expressions
+const presentFunction = "@present"
+
+// coalesceMacros are expanded when parsing the expressions instead of being implemented as
+// functions, since a call fails as soon as any of its arguments does, so the missing keys could
+// not be replaced by the fallback at runtime:
+//
+//	coalesce(req_jwt.nickname, req_jwt.name, 'anonymous')
+//	get(req_body, 'tenant', 'default')
+var coalesceMacros = []parser.Macro{
+	parser.NewGlobalVarArgMacro("coalesce", expandCoalesce),
+	parser.NewGlobalMacro("get", 3, expandGet),
+}
+
+// expandCoalesce returns the first argument whose keys are all present and not null, testing them
+// level by level, or the last one. The arguments not navigating a map or a list are returned as
+// they are, so any argument after them is never evaluated
+func expandCoalesce(eh parser.ExprHelper, target *exprpb.Expr, args []*exprpb.Expr) (*exprpb.Expr, *common.Error) {
+	if len(args) < 2 {
+		return nil, &common.Error{Message: "coalesce requires at least two arguments"}
+	}
+	res := args[len(args)-1]
+	for i := len(args) - 2; i >= 0; i-- {
+		cond := presence(eh, args[i])
+		if cond == nil {
+			res = args[i]
+			continue
+		}
+		res = eh.GlobalCall(operators.Conditional, cond, cloneExpr(args[i]), res)
+	}
+	return res, nil
+}
+
+// expandGet is coalesce(m[key], fallback)
+func expandGet(eh parser.ExprHelper, target *exprpb.Expr, args []*exprpb.Expr) (*exprpb.Expr, *common.Error) {
+	return expandCoalesce(eh, target, []*exprpb.Expr{eh.GlobalCall(operators.Index, args[0], args[1]), args[2]})
+}
+
+// presence returns the condition testing every key navigated by the expression, or nil if it does
+// not navigate any
+func presence(eh parser.ExprHelper, e *exprpb.Expr) *exprpb.Expr {
+	var operand, key *exprpb.Expr
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_SelectExpr:
+		if k.SelectExpr.TestOnly {
+			return nil
+		}
+		operand, key = k.SelectExpr.Operand, eh.LiteralString(k.SelectExpr.Field)
+	case *exprpb.Expr_CallExpr:
+		call := k.CallExpr
+		if call.Function != operators.Index || len(call.Args) != 2 {
+			return nil
+		}
+		operand, key = call.Args[0], cloneExpr(call.Args[1])
+	default:
+		return nil
+	}
+
+	test := eh.GlobalCall(presentFunction, cloneExpr(operand), key)
+	if parent := presence(eh, operand); parent != nil {
+		return eh.GlobalCall(operators.LogicalAnd, parent, test)
+	}
+	return test
+}
+
+// cloneExpr copies the expressions used more than once by the expansions, so the rewrites of the
+// AST, like the injection of the context, do not apply twice to the same node
+func cloneExpr(e *exprpb.Expr) *exprpb.Expr {
+	return proto.Clone(e).(*exprpb.Expr)
+}
+
+// present checks if the map contains the key or the list the index, with a value other than null.
+// The lists are tested first, since they implement the traits of the maps too
+func present(container, key ref.Val) ref.Val {
+	switch c := container.(type) {
+	case traits.Lister:
+		i, ok := key.(types.Int)
+		if !ok {
+			return types.False
+		}
+		if i < 0 || i >= c.Size().(types.Int) {
+			return types.False
+		}
+		v := c.Get(i)
+		return types.Bool(!types.IsUnknownOrError(v) && v.Type() != types.NullType)
+	case traits.Mapper:
+		if c.Contains(key) != types.True {
+			return types.False
+		}
+		v := c.Get(key)
+		return types.Bool(!types.IsUnknownOrError(v) && v.Type() != types.NullType)
+	default:
+		return types.False
+	}
+}
@@ -0,0 +1,57 @@
+package internal
+
+import "testing"
+
+func TestCoalesce(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "coalesce({'a': 1}.a, 2)", expected: int64(1)},
+		{expr: "coalesce({'a': 1}.b, 2)", expected: int64(2)},
+		{expr: "coalesce({'a': {'b': 'x'}}.a.b, 'y')", expected: "x"},
+		{expr: "coalesce({'a': {'b': 'x'}}.c.b, 'y')", expected: "y"},
+		{expr: `coalesce(jsonParse('{"a": null}').a, 'y')`, expected: "y"},
+		{expr: "coalesce({'a': 1}.b, {'c': 3}.c, 4)", expected: int64(3)},
+		{expr: "coalesce({'a': 1}.b, {'c': 3}.d, 4)", expected: int64(4)},
+		{expr: "coalesce({'a': ['x']}.a[0], 'y')", expected: "x"},
+		{expr: "coalesce({'a': ['x']}.a[1], 'y')", expected: "y"},
+		{expr: "coalesce({'a': ['x']}['a'][-1], 'y')", expected: "y"},
+		{expr: `coalesce(jsonParse('{"a": "x"}').a.b, 'y')`, expected: "y"},
+		{expr: `coalesce(jsonParse('{"a": [1.0]}').a[0], 2.0)`, expected: 1.0},
+		{expr: "coalesce('x', {'a': 1}.b)", expected: "x"},
+		{expr: "get({'tenant': 'acme'}, 'tenant', 'default')", expected: "acme"},
+		{expr: "get({'tenant': 'acme'}, 'role', 'default')", expected: "default"},
+		{expr: "get({'a': {'b': 1}}.c, 'b', 0)", expected: int64(0)},
+		{expr: "get({'a': 1}, 'a', 0) + 1", expected: int64(2)},
+		{expr: "get({'a': 1}, 'b', 0) > 0", expected: false},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestCoalesce_errors(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		err  error
+	}{
+		{expr: "coalesce({'a': 1}.b) == 1", err: ErrParsing},
+		{expr: "get({'a': 1}, 'b') == 1", err: ErrChecking},
+		{expr: "@present({'a': 1}, 'a')", err: ErrParsing},
+	} {
+		if _, err := evalExpr(tc.expr); err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+		}
+	}
+
+	if _, err := evalExpr("coalesce({'a': 1}.b, {'c': 1}.d) == 1"); err == nil {
+		t.Error("expecting error for the missing fallback")
+	}
+}
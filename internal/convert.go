@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// maxSafeInteger is the biggest integer a double represents without ambiguity. The bigger integers
+// decoded from JSON could have been rounded, like 2^53 + 1, decoded as 2^53
+const maxSafeInteger = 1<<53 - 1
+
+// toInt converts the numbers and the numeric strings to ints. The doubles must be integral and
+// exactly representable, so the rounded integers of a JSON document fail instead of being compared
+// with a different value
+func toInt(val ref.Val) ref.Val {
+	switch v := val.(type) {
+	case types.Int:
+		return v
+	case types.Uint:
+		if uint64(v) > math.MaxInt64 {
+			return types.NewErr("toInt: %d overflows int", uint64(v))
+		}
+		return types.Int(v)
+	case types.Double:
+		f := float64(v)
+		if f != math.Trunc(f) {
+			return types.NewErr("toInt: %v is not an integer", f)
+		}
+		if math.Abs(f) > maxSafeInteger {
+			return types.NewErr("toInt: %v can not be converted without losing precision", f)
+		}
+		return types.Int(int64(f))
+	case types.String:
+		i, err := strconv.ParseInt(strings.TrimSpace(string(v)), 10, 64)
+		if err != nil {
+			return types.NewErr("toInt: invalid integer '%s'", v)
+		}
+		return types.Int(i)
+	default:
+		return types.NewErr("toInt: unexpected type %s", val.Type().TypeName())
+	}
+}
+
+// toDouble converts the numbers and the numeric strings to doubles
+func toDouble(val ref.Val) ref.Val {
+	switch v := val.(type) {
+	case types.Double:
+		return v
+	case types.Int:
+		return types.Double(v)
+	case types.Uint:
+		return types.Double(v)
+	case types.String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 64)
+		if err != nil {
+			return types.NewErr("toDouble: invalid number '%s'", v)
+		}
+		return types.Double(f)
+	default:
+		return types.NewErr("toDouble: unexpected type %s", val.Type().TypeName())
+	}
+}
+
+// toBool converts the bools and their string representations, like the 'true' of a form field
+func toBool(val ref.Val) ref.Val {
+	switch v := val.(type) {
+	case types.Bool:
+		return v
+	case types.String:
+		b, err := strconv.ParseBool(strings.TrimSpace(string(v)))
+		if err != nil {
+			return types.NewErr("toBool: invalid bool '%s'", v)
+		}
+		return types.Bool(b)
+	default:
+		return types.NewErr("toBool: unexpected type %s", val.Type().TypeName())
+	}
+}
@@ -0,0 +1,54 @@
+package internal
+
+import "testing"
+
+func TestConversions(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "toInt(jsonParse('{\"count\": 5}').count) == 5", expected: true},
+		{expr: "toInt(jsonParse('{\"count\": -5.0}').count)", expected: int64(-5)},
+		{expr: "toInt(jsonParse('{\"id\": 9007199254740991}').id)", expected: int64(9007199254740991)},
+		{expr: "toInt('9007199254740993')", expected: int64(9007199254740993)},
+		{expr: "toInt(' 42 ')", expected: int64(42)},
+		{expr: "toInt(42)", expected: int64(42)},
+		{expr: "toInt(42u)", expected: int64(42)},
+		{expr: "toDouble(jsonParse('{\"price\": 9.5}').price) < 10.0", expected: true},
+		{expr: "toDouble('9.5')", expected: 9.5},
+		{expr: "toDouble(3)", expected: 3.0},
+		{expr: "toBool(jsonParse('{\"subscribe\": true}').subscribe)", expected: true},
+		{expr: "toBool('false')", expected: false},
+		{expr: "toBool('1')", expected: true},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestConversions_errors(t *testing.T) {
+	for _, expr := range []string{
+		// rounded to 9007199254740992 when decoded as a double
+		"toInt(jsonParse('{\"id\": 9007199254740993}').id)",
+		"toInt(jsonParse('{\"id\": 12345678901234567890}').id)",
+		"toInt(jsonParse('{\"count\": 5.5}').count)",
+		"toInt('9223372036854775808')",
+		"toInt(18446744073709551615u)",
+		"toInt('five')",
+		"toInt(true)",
+		"toDouble('cheap')",
+		"toDouble(jsonParse('{\"price\": null}').price)",
+		"toBool('yes')",
+		"toBool(1)",
+	} {
+		if _, err := evalExpr(expr); err == nil {
+			t.Errorf("%s: expecting error", expr)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// sha256Hex returns the lowercase hex encoded SHA-256 digest of the string
+func sha256Hex(val ref.Val) ref.Val {
+	s, ok := val.(types.String)
+	if !ok {
+		return types.NewErr("sha256: unexpected string type %s", val.Type().TypeName())
+	}
+	sum := sha256.Sum256([]byte(s))
+	return types.String(hex.EncodeToString(sum[:]))
+}
+
+// hmacSHA256 returns the lowercase hex encoded HMAC-SHA256 of the string (rhs) with the key (lhs)
+func hmacSHA256(lhs, rhs ref.Val) ref.Val {
+	key, ok := lhs.(types.String)
+	if !ok {
+		return types.NewErr("hmacSHA256: unexpected key type %s", lhs.Type().TypeName())
+	}
+	s, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("hmacSHA256: unexpected string type %s", rhs.Type().TypeName())
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(s))
+	return types.String(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// secureCompare checks if both strings are equal in constant time, so comparing signatures does
+// not leak how many of their leading bytes are right
+func secureCompare(lhs, rhs ref.Val) ref.Val {
+	a, ok := lhs.(types.String)
+	if !ok {
+		return types.NewErr("secureCompare: unexpected string type %s", lhs.Type().TypeName())
+	}
+	b, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("secureCompare: unexpected string type %s", rhs.Type().TypeName())
+	}
+	return types.Bool(subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1)
+}
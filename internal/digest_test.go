@@ -0,0 +1,29 @@
+package internal
+
+import "testing"
+
+func TestDigests(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "sha256('')", expected: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{expr: "sha256('abc')", expected: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		// RFC 4231, test case 2
+		{expr: "hmacSHA256('Jefe', 'what do ya want for nothing?')", expected: "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{expr: "hmacSHA256('key', 'The quick brown fox jumps over the lazy dog')", expected: "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{expr: "secureCompare(sha256('abc'), 'ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad')", expected: true},
+		{expr: "secureCompare(sha256('abc'), 'BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD')", expected: false},
+		{expr: "secureCompare('abc', 'ab')", expected: false},
+		{expr: "secureCompare('', '')", expected: true},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// Alphabets accepted by the base64 functions
+const (
+	base64Std = "std"
+	base64URL = "url"
+)
+
+func base64Encode(args ...ref.Val) ref.Val {
+	s, enc, err := base64Args("base64Encode", args)
+	if err != nil {
+		return err
+	}
+	return types.String(enc.EncodeToString([]byte(s)))
+}
+
+// base64Decode accepts both padded and unpadded inputs
+func base64Decode(args ...ref.Val) ref.Val {
+	s, enc, err := base64Args("base64Decode", args)
+	if err != nil {
+		return err
+	}
+	if len(s)%4 != 0 {
+		enc = enc.WithPadding(base64.NoPadding)
+	}
+	b, decodeErr := enc.DecodeString(s)
+	if decodeErr != nil {
+		return types.NewErr("base64Decode: %s", decodeErr.Error())
+	}
+	return types.String(b)
+}
+
+func base64Args(name string, args []ref.Val) (string, *base64.Encoding, ref.Val) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", nil, types.NewErr("%s: unexpected number of arguments", name)
+	}
+	s, ok := args[0].(types.String)
+	if !ok {
+		return "", nil, types.NewErr("%s: unexpected string type %s", name, args[0].Type().TypeName())
+	}
+	if len(args) == 1 {
+		return string(s), base64.StdEncoding, nil
+	}
+	alphabet, ok := args[1].(types.String)
+	if !ok {
+		return "", nil, types.NewErr("%s: unexpected alphabet type %s", name, args[1].Type().TypeName())
+	}
+	switch alphabet {
+	case base64Std:
+		return string(s), base64.StdEncoding, nil
+	case base64URL:
+		return string(s), base64.URLEncoding, nil
+	default:
+		return "", nil, types.NewErr("%s: unknown alphabet '%s'", name, alphabet)
+	}
+}
+
+func jsonParse(val ref.Val) ref.Val {
+	s, ok := val.(types.String)
+	if !ok {
+		return types.NewErr("jsonParse: unexpected string type %s", val.Type().TypeName())
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return types.NewErr("jsonParse: %s", err.Error())
+	}
+	return types.DefaultTypeAdapter.NativeToValue(v)
+}
+
+// jsonGet returns the value at the dotted path of the JSON document. The numeric segments of the
+// path are the indexes of the lists, so 'users.0.name' is the name of the first user
+func jsonGet(lhs, rhs ref.Val) ref.Val {
+	s, ok := lhs.(types.String)
+	if !ok {
+		return types.NewErr("jsonGet: unexpected string type %s", lhs.Type().TypeName())
+	}
+	path, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("jsonGet: unexpected path type %s", rhs.Type().TypeName())
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return types.NewErr("jsonGet: %s", err.Error())
+	}
+	if path == "" {
+		return types.DefaultTypeAdapter.NativeToValue(v)
+	}
+
+	for _, key := range strings.Split(string(path), ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[key]
+			if !ok {
+				return types.NewErr("jsonGet: no such key '%s'", key)
+			}
+			v = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return types.NewErr("jsonGet: invalid index '%s'", key)
+			}
+			v = node[i]
+		default:
+			return types.NewErr("jsonGet: no such key '%s'", key)
+		}
+	}
+	return types.DefaultTypeAdapter.NativeToValue(v)
+}
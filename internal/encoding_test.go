@@ -0,0 +1,97 @@
+package internal
+
+import "testing"
+
+func TestBase64(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected string
+	}{
+		{expr: "base64Encode('krakend')", expected: "a3Jha2VuZA=="},
+		{expr: "base64Encode('krakend', 'std')", expected: "a3Jha2VuZA=="},
+		{expr: "base64Encode('krak')", expected: "a3Jhaw=="},
+		{expr: "base64Encode('kra')", expected: "a3Jh"},
+		{expr: "base64Encode('')", expected: ""},
+		{expr: "base64Encode('áé')", expected: "w6HDqQ=="},
+		{expr: "base64Encode('??>>', 'std')", expected: "Pz8+Pg=="},
+		{expr: "base64Encode('??>>', 'url')", expected: "Pz8-Pg=="},
+		{expr: "base64Decode('a3Jha2VuZA==')", expected: "krakend"},
+		{expr: "base64Decode('a3Jha2VuZA')", expected: "krakend"},
+		{expr: "base64Decode('a3Jh')", expected: "kra"},
+		{expr: "base64Decode('w6HDqQ==')", expected: "áé"},
+		{expr: "base64Decode('Pz8+Pg==')", expected: "??>>"},
+		{expr: "base64Decode('Pz8-Pg==', 'url')", expected: "??>>"},
+		{expr: "base64Decode('Pz8-Pg', 'url')", expected: "??>>"},
+		{expr: "base64Decode(base64Encode('áé', 'url'), 'url')", expected: "áé"},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestBase64_errors(t *testing.T) {
+	for _, expr := range []string{
+		"base64Decode('not base64!')",
+		"base64Decode('a3Jha2VuZA=')",
+		"base64Decode('Pz8-Pg==')",
+		"base64Decode('Pz8+Pg==', 'url')",
+		"base64Decode('a3Jh', 'hex')",
+		"base64Encode('kra', 'hex')",
+	} {
+		if _, err := evalExpr(expr); err == nil {
+			t.Errorf("%s: expecting error", expr)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	doc := `'{"user": {"name": "alice", "roles": ["admin", "editor"], "age": 42, "active": true, "manager": null}}'`
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "jsonParse(" + doc + ").user.name", expected: "alice"},
+		{expr: "'admin' in jsonParse(" + doc + ").user.roles", expected: true},
+		{expr: "jsonParse(" + doc + ").user.age == 42.0", expected: true},
+		{expr: "size(jsonParse('[1, 2, 3]'))", expected: int64(3)},
+		{expr: "jsonParse('\"plain\"')", expected: "plain"},
+		{expr: "jsonGet(" + doc + ", 'user.name')", expected: "alice"},
+		{expr: "jsonGet(" + doc + ", 'user.roles.1')", expected: "editor"},
+		{expr: "jsonGet(" + doc + ", 'user.age')", expected: 42.0},
+		{expr: "jsonGet(" + doc + ", 'user.active')", expected: true},
+		{expr: "size(jsonGet(" + doc + ", 'user.roles'))", expected: int64(2)},
+		{expr: "size(jsonGet(" + doc + ", ''))", expected: int64(1)},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestJSON_errors(t *testing.T) {
+	doc := `'{"user": {"name": "alice", "roles": ["admin"]}}'`
+	for _, expr := range []string{
+		"jsonParse('{not json}') == null",
+		"jsonParse('') == null",
+		"jsonGet('{not json}', 'user') == null",
+		"jsonGet(" + doc + ", 'user.email') == null",
+		"jsonGet(" + doc + ", 'user.roles.1') == null",
+		"jsonGet(" + doc + ", 'user.roles.first') == null",
+		"jsonGet(" + doc + ", 'user.name.first') == null",
+	} {
+		if _, err := evalExpr(expr); err == nil {
+			t.Errorf("%s: expecting error", expr)
+		}
+	}
+}
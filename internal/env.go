@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"regexp"
+)
+
+// ErrEnv is returned when an expression references an unset environment variable without default
+var ErrEnv = errors.New("cel: undefined environment variable")
+
+// envPattern matches the ${NAME} and ${NAME:-default} references
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolateEnv replaces the references to environment variables in the expression with their
+// values. Like in the shell, the default is used when the variable is unset or empty. It returns
+// the names of the variables without value nor default
+func interpolateEnv(expr string) (string, []string) {
+	var missing []string
+	res := envPattern.ReplaceAllStringFunc(expr, func(ref string) string {
+		m := envPattern.FindStringSubmatch(ref)
+		if v := os.Getenv(m[1]); v != "" {
+			return v
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		if _, ok := os.LookupEnv(m[1]); !ok {
+			missing = append(missing, m[1])
+		}
+		return ""
+	})
+	return res, missing
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	os.Setenv("CEL_TEST_TENANT", "acme")
+	os.Setenv("CEL_TEST_EMPTY", "")
+	os.Unsetenv("CEL_TEST_MISSING")
+	defer os.Unsetenv("CEL_TEST_TENANT")
+	defer os.Unsetenv("CEL_TEST_EMPTY")
+
+	for _, tc := range []struct {
+		expr     string
+		expected string
+		missing  []string
+	}{
+		{expr: "req_method == 'GET'", expected: "req_method == 'GET'"},
+		{expr: "req_params.Tenant == '${CEL_TEST_TENANT}'", expected: "req_params.Tenant == 'acme'"},
+		{expr: "'${CEL_TEST_TENANT:-other}' == '${CEL_TEST_TENANT}'", expected: "'acme' == 'acme'"},
+		{expr: "size(req_path) < ${CEL_TEST_MISSING:-100}", expected: "size(req_path) < 100"},
+		{expr: "'${CEL_TEST_EMPTY:-default}'", expected: "'default'"},
+		{expr: "'${CEL_TEST_EMPTY}' == ''", expected: "'' == ''"},
+		{expr: "'${CEL_TEST_MISSING:-}' == ''", expected: "'' == ''"},
+		{expr: "'$CEL_TEST_TENANT' + '${not valid}'", expected: "'$CEL_TEST_TENANT' + '${not valid}'"},
+		{expr: "'${CEL_TEST_MISSING}' == '${CEL_TEST_TENANT}'", expected: "'' == 'acme'", missing: []string{"CEL_TEST_MISSING"}},
+	} {
+		res, missing := interpolateEnv(tc.expr)
+		if res != tc.expected {
+			t.Errorf("%s: unexpected expression %s", tc.expr, res)
+		}
+		if len(missing) != len(tc.missing) || (len(missing) > 0 && missing[0] != tc.missing[0]) {
+			t.Errorf("%s: unexpected missing variables %v", tc.expr, missing)
+		}
+	}
+}
+
+func TestParser_env(t *testing.T) {
+	os.Setenv("CEL_TEST_API_KEY", "s3cr3t")
+	os.Unsetenv("CEL_TEST_MISSING")
+	defer os.Unsetenv("CEL_TEST_API_KEY")
+
+	p := NewCheckExpressionParser(logging.NoOp)
+	for _, tc := range []struct {
+		expr     string
+		expected bool
+		err      error
+	}{
+		{expr: "'s3cr3t' == '${CEL_TEST_API_KEY}'", expected: true},
+		{expr: "'guest' == '${CEL_TEST_MISSING:-guest}'", expected: true},
+		{expr: "'s3cr3t' == '${CEL_TEST_MISSING}'", err: ErrEnv},
+	} {
+		def := InterpretableDefinition{CheckExpression: tc.expr}
+		prg, err := p.compile(def)
+		if err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if prg.Definition.CheckExpression != tc.expr {
+			t.Errorf("%s: the definition was modified: %s", tc.expr, prg.Definition.CheckExpression)
+		}
+		res, _, err := prg.Eval(map[string]interface{}{})
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err.Error())
+			continue
+		}
+		if res.Value() != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestParser_envIssues(t *testing.T) {
+	os.Setenv("CEL_TEST_API_KEY", "s3cr3t")
+	defer os.Unsetenv("CEL_TEST_API_KEY")
+
+	for _, tc := range []struct {
+		expr string
+		err  error
+	}{
+		{expr: "'${CEL_TEST_API_KEY}' == (", err: ErrParsing},
+		{expr: "${CEL_TEST_API_KEY} == 'x'", err: ErrChecking},
+	} {
+		buff := new(bytes.Buffer)
+		logger, err := logging.NewLogger("DEBUG", buff, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewCheckExpressionParser(logger).compile(InterpretableDefinition{CheckExpression: tc.expr}); err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+		}
+		if strings.Contains(buff.String(), "s3cr3t") {
+			t.Errorf("%s: the value of the variable was logged: %s", tc.expr, buff.String())
+		}
+		if !strings.Contains(buff.String(), tc.expr) {
+			t.Errorf("%s: the source was not logged: %s", tc.expr, buff.String())
+		}
+	}
+
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("DEBUG", buff, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCheckExpressionParser(logger).compile(InterpretableDefinition{CheckExpression: "s3cr3t == 'x'"}); err != ErrChecking {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buff.String(), "undeclared reference") {
+		t.Errorf("the issues were not logged: %s", buff.String())
+	}
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"errors"
+
+	"github.com/google/cel-go/cel"
+)
+
+// ErrFeatures is the error returned when the features enabled can not be combined
+var ErrFeatures = errors.New("cel: constant folding can not be combined with the exhaustive evaluation")
+
+// Features are the cel-go options of the environment and the programs of the expressions. The
+// zero value is the default environment, with the dynamic aggregate literals, the standard macros
+// and the short-circuited evaluation
+type Features struct {
+	// HomogeneousAggregateLiterals rejects the list and map literals mixing the types of their
+	// elements, keys or values, like [1, 'a']
+	HomogeneousAggregateLiterals bool `json:"homogeneous_aggregate_literals"`
+	// DisableMacros removes the standard macros (has, all, exists, exists_one, map and filter).
+	// The coalesce and get macros of the module are still available
+	DisableMacros bool `json:"disable_macros"`
+	// FoldConstants computes the list and map literals made of constants when the expression is
+	// compiled, instead of on every evaluation
+	FoldConstants bool `json:"fold_constants"`
+	// ExhaustiveEval evaluates both sides of the logical operators and both branches of the
+	// conditionals, instead of short-circuiting them
+	ExhaustiveEval bool `json:"exhaustive_eval"`
+}
+
+// Validate returns an error if the features can not be combined. The exhaustive programs are
+// rebuilt for every evaluation, so the constants would be folded on every request
+func (f Features) Validate() error {
+	if f.FoldConstants && f.ExhaustiveEval {
+		return ErrFeatures
+	}
+	return nil
+}
+
+// key identifies the features in the keys of the cached programs
+func (f Features) key() string {
+	k := []byte("----")
+	for i, enabled := range []bool{f.HomogeneousAggregateLiterals, f.DisableMacros, f.FoldConstants, f.ExhaustiveEval} {
+		if enabled {
+			k[i] = '+'
+		}
+	}
+	return string(k)
+}
+
+// envOptions returns the options of the environment enabling the features. They go before the
+// macros of the module, so clearing the standard ones keeps them
+func (f Features) envOptions() []cel.EnvOption {
+	var opts []cel.EnvOption
+	if f.HomogeneousAggregateLiterals {
+		opts = append(opts, cel.HomogeneousAggregateLiterals())
+	}
+	if f.DisableMacros {
+		opts = append(opts, cel.ClearMacros())
+	}
+	return opts
+}
+
+// programOptions returns the options of the programs enabling the features
+func (f Features) programOptions() []cel.ProgramOption {
+	var opts []cel.EvalOption
+	if f.FoldConstants {
+		opts = append(opts, cel.OptFoldConstants)
+	}
+	if f.ExhaustiveEval {
+		opts = append(opts, cel.OptExhaustiveEval)
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return []cel.ProgramOption{cel.EvalOptions(opts...)}
+}
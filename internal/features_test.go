@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestFeatures_Validate(t *testing.T) {
+	for _, f := range []Features{
+		{},
+		{HomogeneousAggregateLiterals: true, DisableMacros: true},
+		{FoldConstants: true},
+		{ExhaustiveEval: true},
+	} {
+		if err := f.Validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %s", f, err.Error())
+		}
+	}
+	if err := (Features{FoldConstants: true, ExhaustiveEval: true}).Validate(); err != ErrFeatures {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	p := NewCheckExpressionParser(logging.NoOp).WithFeatures(Features{FoldConstants: true, ExhaustiveEval: true})
+	if _, err := p.Parse(InterpretableDefinition{CheckExpression: "true"}); err != ErrFeatures {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParser_WithFeatures(t *testing.T) {
+	for _, tc := range []struct {
+		features Features
+		expr     string
+		err      error
+	}{
+		{expr: "[1, 'a'].size() == 2"},
+		{features: Features{HomogeneousAggregateLiterals: true}, expr: "[1, 'a'].size() == 2", err: ErrChecking},
+		{features: Features{HomogeneousAggregateLiterals: true}, expr: "[1, 2].size() == 2"},
+		{expr: "[1, 2].exists(x, x == 2)"},
+		{features: Features{DisableMacros: true}, expr: "[1, 2].exists(x, x == 2)", err: ErrChecking},
+		{features: Features{DisableMacros: true}, expr: "coalesce(req_jwt.sub, '') != ''"},
+		{features: Features{FoldConstants: true}, expr: "'b' in ['a', 'b']"},
+		{features: Features{ExhaustiveEval: true}, expr: "true || 1 / 0 == 1"},
+	} {
+		p := NewCheckExpressionParser(logging.NoOp).WithFeatures(tc.features)
+		prg, err := p.Parse(InterpretableDefinition{CheckExpression: tc.expr})
+		if err != tc.err {
+			t.Errorf("%+v %s: unexpected error: %v", tc.features, tc.expr, err)
+			continue
+		}
+		if err != nil || tc.features.DisableMacros {
+			continue
+		}
+		res, details, err := prg.Eval(map[string]interface{}{})
+		if err != nil {
+			t.Errorf("%+v %s: unexpected error: %s", tc.features, tc.expr, err.Error())
+			continue
+		}
+		if v, ok := res.Value().(bool); !ok || !v {
+			t.Errorf("%+v %s: unexpected result %v", tc.features, tc.expr, res)
+		}
+		if tracked := details != nil && details.State() != nil; tracked != tc.features.ExhaustiveEval {
+			t.Errorf("%+v %s: unexpected evaluation state %v", tc.features, tc.expr, tracked)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package internal
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/interpreter/functions"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// function pairs the declaration of a custom function, required by the checker, with its
+// implementation, required by the program. The implementation is optional for the functions
+// only adding overloads to the standard ones
+type function struct {
+	decl     *exprpb.Decl
+	overload *functions.Overload
+}
+
+func customFunctions() []function {
+	return []function{
+		{
+			// inCIDR(ip, "10.0.0.0/8") or inCIDR(ip, ["10.0.0.0/8", "fc00::/7"])
+			decl: decls.NewFunction("inCIDR",
+				decls.NewOverload("inCIDR_string_string",
+					[]*exprpb.Type{decls.String, decls.String}, decls.Bool),
+				decls.NewOverload("inCIDR_string_list_string",
+					[]*exprpb.Type{decls.String, decls.NewListType(decls.String)}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "inCIDR", Binary: inCIDR},
+		},
+		{
+			// isExpired(req_jwt.exp)
+			decl: decls.NewFunction("isExpired",
+				decls.NewOverload("isExpired_int", []*exprpb.Type{decls.Int}, decls.Bool),
+				decls.NewOverload("isExpired_double", []*exprpb.Type{decls.Double}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "isExpired", Unary: isExpired},
+		},
+		{
+			// matches(req_path, '^/users/[0-9]+$'), same as req_path.matches('^/users/[0-9]+$'). The
+			// functions are dispatched by name, so the standard implementation is used
+			decl: decls.NewFunction("matches",
+				decls.NewOverload("matches_string_string", []*exprpb.Type{decls.String, decls.String}, decls.Bool),
+			),
+		},
+		{
+			// lowerAscii(req_params.Kind) == 'admin' or req_params.Kind.lowerAscii() == 'admin'
+			decl: decls.NewFunction("lowerAscii",
+				decls.NewOverload("lowerAscii_string", []*exprpb.Type{decls.String}, decls.String),
+				decls.NewInstanceOverload("string_lowerAscii", []*exprpb.Type{decls.String}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "lowerAscii", Unary: lowerASCII},
+		},
+		{
+			// upperAscii(req_params.Country) == 'ES' or req_params.Country.upperAscii() == 'ES'
+			decl: decls.NewFunction("upperAscii",
+				decls.NewOverload("upperAscii_string", []*exprpb.Type{decls.String}, decls.String),
+				decls.NewInstanceOverload("string_upperAscii", []*exprpb.Type{decls.String}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "upperAscii", Unary: upperASCII},
+		},
+		{
+			// trim(req_headers['X-Tenant'][0]) != '' or req_headers['X-Tenant'][0].trim() != ''
+			decl: decls.NewFunction("trim",
+				decls.NewOverload("trim_string", []*exprpb.Type{decls.String}, decls.String),
+				decls.NewInstanceOverload("string_trim", []*exprpb.Type{decls.String}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "trim", Unary: trim},
+		},
+		{
+			// jwtAudienceContains(req_jwt, 'my-api'), for both the string and the list forms of aud
+			decl: decls.NewFunction("jwtAudienceContains",
+				decls.NewOverload("jwtAudienceContains_map_string",
+					[]*exprpb.Type{decls.NewMapType(decls.String, decls.Dyn), decls.String}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "jwtAudienceContains", Binary: jwtAudienceContains},
+		},
+		{
+			// hasScope(req_jwt, 'read:orders'), for both the space-delimited scope and the scp list
+			decl: decls.NewFunction("hasScope",
+				decls.NewOverload("hasScope_map_string",
+					[]*exprpb.Type{decls.NewMapType(decls.String, decls.Dyn), decls.String}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "hasScope", Binary: hasScope},
+		},
+		{
+			// decodeJWT(req_body.id_token).sub == req_jwt.sub
+			decl: decls.NewFunction("decodeJWT",
+				decls.NewOverload("decodeJWT_string", []*exprpb.Type{decls.String}, decls.NewMapType(decls.String, decls.Dyn)),
+			),
+			overload: &functions.Overload{Operator: "decodeJWT", Unary: decodeJWT},
+		},
+		{
+			// inList('allowed_tenants', req_jwt.tenant), implemented by the Lists of each parser
+			decl: decls.NewFunction("inList",
+				decls.NewOverload("inList_string_dyn", []*exprpb.Type{decls.String, decls.Dyn}, decls.Bool),
+			),
+		},
+		{
+			// matchesSchema(req_body, 'order'), implemented by the Schemas of each parser
+			decl: decls.NewFunction("matchesSchema",
+				decls.NewOverload("matchesSchema_dyn_string", []*exprpb.Type{decls.Dyn, decls.String}, decls.Bool),
+			),
+		},
+		{
+			// schemaErrors(req_body, 'order'), the failures of matchesSchema
+			decl: decls.NewFunction("schemaErrors",
+				decls.NewOverload("schemaErrors_dyn_string", []*exprpb.Type{decls.Dyn, decls.String}, decls.NewListType(decls.String)),
+			),
+		},
+		{
+			// jwtIssuer(req_jwt) == 'https://idp.example.com/'
+			decl: decls.NewFunction("jwtIssuer",
+				decls.NewOverload("jwtIssuer_map", []*exprpb.Type{decls.NewMapType(decls.String, decls.Dyn)}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "jwtIssuer", Unary: jwtIssuer},
+		},
+		{
+			// extract(req_path, '^/users/([0-9]+)$')
+			decl: decls.NewFunction("extract",
+				decls.NewOverload("extract_string_string", []*exprpb.Type{decls.String, decls.String}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "extract", Binary: extract},
+		},
+		{
+			// header(req_headers, 'content-type') == 'application/json'
+			decl: decls.NewFunction("header",
+				decls.NewOverload("header_map_string",
+					[]*exprpb.Type{decls.NewMapType(decls.String, decls.NewListType(decls.String)), decls.String}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "header", Binary: header},
+		},
+		{
+			// hasHeader(req_headers, 'x-api-key')
+			decl: decls.NewFunction("hasHeader",
+				decls.NewOverload("hasHeader_map_string",
+					[]*exprpb.Type{decls.NewMapType(decls.String, decls.NewListType(decls.String)), decls.String}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "hasHeader", Binary: hasHeader},
+		},
+		{
+			// acceptsMediaType(req_headers, 'application/vnd.api.v2+json')
+			decl: decls.NewFunction("acceptsMediaType",
+				decls.NewOverload("acceptsMediaType_map_string",
+					[]*exprpb.Type{decls.NewMapType(decls.String, decls.NewListType(decls.String)), decls.String}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "acceptsMediaType", Binary: acceptsMediaType},
+		},
+		{
+			// preferredMediaType(req_headers, ['application/json', 'application/xml']) == 'application/json'
+			decl: decls.NewFunction("preferredMediaType",
+				decls.NewOverload("preferredMediaType_map_list",
+					[]*exprpb.Type{decls.NewMapType(decls.String, decls.NewListType(decls.String)), decls.NewListType(decls.String)}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "preferredMediaType", Binary: preferredMediaType},
+		},
+		{
+			// param(req_params, 'id') == req_jwt.sub, whatever the casing of the parameter
+			decl: decls.NewFunction("param",
+				decls.NewOverload("param_map_string",
+					[]*exprpb.Type{decls.NewMapType(decls.String, decls.String), decls.String}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "param", Binary: param},
+		},
+		{
+			// isSuccess(resp_metadata_status) for the 2xx status codes
+			decl: decls.NewFunction("isSuccess",
+				decls.NewOverload("isSuccess_int", []*exprpb.Type{decls.Int}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "isSuccess", Unary: isSuccess},
+		},
+		{
+			// isClientError(resp_metadata_status) for the 4xx status codes
+			decl: decls.NewFunction("isClientError",
+				decls.NewOverload("isClientError_int", []*exprpb.Type{decls.Int}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "isClientError", Unary: isClientError},
+		},
+		{
+			// isServerError(resp_metadata_status) for the 5xx status codes
+			decl: decls.NewFunction("isServerError",
+				decls.NewOverload("isServerError_int", []*exprpb.Type{decls.Int}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "isServerError", Unary: isServerError},
+		},
+		{
+			// sha256(req_body_raw) == req_headers['X-Checksum'][0]
+			decl: decls.NewFunction("sha256",
+				decls.NewOverload("sha256_string", []*exprpb.Type{decls.String}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "sha256", Unary: sha256Hex},
+		},
+		{
+			// secureCompare(hmacSHA256('secret', req_body_raw), header(req_headers, 'X-Signature'))
+			decl: decls.NewFunction("hmacSHA256",
+				decls.NewOverload("hmacSHA256_string_string", []*exprpb.Type{decls.String, decls.String}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "hmacSHA256", Binary: hmacSHA256},
+		},
+		{
+			// secureCompare(a, b), like a == b but taking the same time wherever the strings differ
+			decl: decls.NewFunction("secureCompare",
+				decls.NewOverload("secureCompare_string_string", []*exprpb.Type{decls.String, decls.String}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "secureCompare", Binary: secureCompare},
+		},
+		{
+			// base64Decode(req_headers['X-Data'][0]) or base64Decode(req_jwt.data, 'url')
+			decl: decls.NewFunction("base64Decode",
+				decls.NewOverload("base64Decode_string", []*exprpb.Type{decls.String}, decls.String),
+				decls.NewOverload("base64Decode_string_string", []*exprpb.Type{decls.String, decls.String}, decls.String),
+			),
+			overload: &functions.Overload{
+				Operator: "base64Decode",
+				Unary:    func(v ref.Val) ref.Val { return base64Decode(v) },
+				Binary:   func(lhs, rhs ref.Val) ref.Val { return base64Decode(lhs, rhs) },
+			},
+		},
+		{
+			// base64Encode(req_jwt.sub) or base64Encode(req_jwt.sub, 'url')
+			decl: decls.NewFunction("base64Encode",
+				decls.NewOverload("base64Encode_string", []*exprpb.Type{decls.String}, decls.String),
+				decls.NewOverload("base64Encode_string_string", []*exprpb.Type{decls.String, decls.String}, decls.String),
+			),
+			overload: &functions.Overload{
+				Operator: "base64Encode",
+				Unary:    func(v ref.Val) ref.Val { return base64Encode(v) },
+				Binary:   func(lhs, rhs ref.Val) ref.Val { return base64Encode(lhs, rhs) },
+			},
+		},
+		{
+			// jsonParse(req_headers['X-User'][0]).roles
+			decl: decls.NewFunction("jsonParse",
+				decls.NewOverload("jsonParse_string", []*exprpb.Type{decls.String}, decls.Dyn),
+			),
+			overload: &functions.Overload{Operator: "jsonParse", Unary: jsonParse},
+		},
+		{
+			// urlParse(req_querystring.redirect[0]).host in ['example.com', 'www.example.com']
+			decl: decls.NewFunction("urlParse",
+				decls.NewOverload("urlParse_string", []*exprpb.Type{decls.String}, decls.NewMapType(decls.String, decls.Dyn)),
+			),
+			overload: &functions.Overload{Operator: "urlParse", Unary: urlParse},
+		},
+		{
+			// parseTime(header(req_headers, 'Date')) or parseTime(req_body.created, '2006-01-02')
+			decl: decls.NewFunction("parseTime",
+				decls.NewOverload("parseTime_string", []*exprpb.Type{decls.String}, decls.Timestamp),
+				decls.NewOverload("parseTime_string_string", []*exprpb.Type{decls.String, decls.String}, decls.Timestamp),
+			),
+			overload: &functions.Overload{
+				Operator: "parseTime",
+				Unary:    func(v ref.Val) ref.Val { return parseTime(v) },
+				Binary:   func(lhs, rhs ref.Val) ref.Val { return parseTime(lhs, rhs) },
+			},
+		},
+		{
+			// durationSeconds(parseTime(req_body.created), now) < 300
+			decl: decls.NewFunction("durationSeconds",
+				decls.NewOverload("durationSeconds_timestamp_timestamp", []*exprpb.Type{decls.Timestamp, decls.Timestamp}, decls.Int),
+			),
+			overload: &functions.Overload{Operator: "durationSeconds", Binary: durationSeconds},
+		},
+		{
+			// uuid(), a random correlation id for a header mutation
+			decl: decls.NewFunction("uuid",
+				decls.NewOverload("uuid", []*exprpb.Type{}, decls.String),
+			),
+			overload: &functions.Overload{Operator: "uuid", Function: randUUID},
+		},
+		{
+			// log('checking the tenant') && req_jwt.tenant == 'acme', the context is injected
+			// as the first argument when compiling the call
+			decl: decls.NewFunction("log",
+				decls.NewOverload("log_string", []*exprpb.Type{decls.Dyn, decls.String}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "log", Binary: logMessage},
+		},
+		{
+			// randInt(100) < 10, sampling the 10% of the requests
+			decl: decls.NewFunction("randInt",
+				decls.NewOverload("randInt_int", []*exprpb.Type{decls.Int}, decls.Int),
+			),
+			overload: &functions.Overload{Operator: "randInt", Unary: randInt},
+		},
+		{
+			// jsonGet(req_body.metadata, 'user.roles.0') == 'admin'
+			decl: decls.NewFunction("jsonGet",
+				decls.NewOverload("jsonGet_string_string", []*exprpb.Type{decls.String, decls.String}, decls.Dyn),
+			),
+			overload: &functions.Overload{Operator: "jsonGet", Binary: jsonGet},
+		},
+		{
+			// toInt(req_body.count) == 5, since the JSON numbers are doubles
+			decl: decls.NewFunction("toInt",
+				decls.NewOverload("toInt_dyn", []*exprpb.Type{decls.Dyn}, decls.Int),
+			),
+			overload: &functions.Overload{Operator: "toInt", Unary: toInt},
+		},
+		{
+			// toDouble(req_params.Price) < 100.0
+			decl: decls.NewFunction("toDouble",
+				decls.NewOverload("toDouble_dyn", []*exprpb.Type{decls.Dyn}, decls.Double),
+			),
+			overload: &functions.Overload{Operator: "toDouble", Unary: toDouble},
+		},
+		{
+			// toBool(req_body.subscribe), for both the JSON bools and the form values
+			decl: decls.NewFunction("toBool",
+				decls.NewOverload("toBool_dyn", []*exprpb.Type{decls.Dyn}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: "toBool", Unary: toBool},
+		},
+		{
+			// the key tests of the coalesce and get macros
+			decl: decls.NewFunction(presentFunction,
+				decls.NewOverload("present_dyn_dyn", []*exprpb.Type{decls.Dyn, decls.Dyn}, decls.Bool),
+			),
+			overload: &functions.Overload{Operator: presentFunction, Binary: present},
+		},
+	}
+}
+
+func functionDeclarations() []*exprpb.Decl {
+	fs := append(customFunctions(), registry.list()...)
+	res := make([]*exprpb.Decl, len(fs), len(fs)+1)
+	for i, f := range fs {
+		res[i] = f.decl
+	}
+	return append(res, decls.NewIdent(ContextKey, decls.Dyn, nil))
+}
+
+func functionOverloads() []*functions.Overload {
+	fs := append(customFunctions(), registry.list()...)
+	res := make([]*functions.Overload, 0, len(fs))
+	for _, f := range fs {
+		if f.overload != nil {
+			res = append(res, f.overload)
+		}
+	}
+	return res
+}
+
+func inCIDR(lhs, rhs ref.Val) ref.Val {
+	s, ok := lhs.(types.String)
+	if !ok {
+		return types.NewErr("inCIDR: unexpected ip type %s", lhs.Type().TypeName())
+	}
+	ip := net.ParseIP(string(s))
+	if ip == nil {
+		return types.NewErr("inCIDR: invalid ip '%s'", s)
+	}
+
+	switch cidrs := rhs.(type) {
+	case types.String:
+		return cidrContains(string(cidrs), ip)
+	case traits.Lister:
+		for it := cidrs.Iterator(); it.HasNext() == types.True; {
+			cidr, ok := it.Next().(types.String)
+			if !ok {
+				return types.NewErr("inCIDR: unexpected cidr type")
+			}
+			if res := cidrContains(string(cidr), ip); res != types.False {
+				return res
+			}
+		}
+		return types.False
+	default:
+		return types.NewErr("inCIDR: unexpected cidr type %s", rhs.Type().TypeName())
+	}
+}
+
+func cidrContains(cidr string, ip net.IP) ref.Val {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return types.NewErr("inCIDR: %s", err.Error())
+	}
+	return types.Bool(network.Contains(ip))
+}
+
+var timeNow = time.Now
+
+// isExpired checks if the epoch (in seconds) is not in the future. As stated by the RFC 7519, a
+// token must not be accepted on or after its expiration time, so an epoch equal to the current
+// second is already expired
+func isExpired(val ref.Val) ref.Val {
+	var exp int64
+	switch v := val.(type) {
+	case types.Int:
+		exp = int64(v)
+	case types.Double:
+		exp = int64(v)
+	default:
+		return types.NewErr("isExpired: unexpected epoch type %s", val.Type().TypeName())
+	}
+	return types.Bool(exp <= timeNow().Unix())
+}
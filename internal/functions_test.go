@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestInCIDR(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: "inCIDR('10.1.2.3', '10.0.0.0/8')", expected: true},
+		{expr: "inCIDR('11.1.2.3', '10.0.0.0/8')", expected: false},
+		{expr: "inCIDR('192.168.1.1', ['10.0.0.0/8', '192.168.0.0/16'])", expected: true},
+		{expr: "inCIDR('172.16.0.1', ['10.0.0.0/8', '192.168.0.0/16'])", expected: false},
+		{expr: "inCIDR('fd00::1', 'fc00::/7')", expected: true},
+		{expr: "inCIDR('2001:db8::1', 'fc00::/7')", expected: false},
+		{expr: "inCIDR('::ffff:10.0.0.1', '10.0.0.0/8')", expected: true},
+		{expr: "inCIDR('::ffff:11.0.0.1', '10.0.0.0/8')", expected: false},
+		{expr: "inCIDR('10.0.0.1', '::ffff:10.0.0.0/104')", expected: true},
+		{expr: "inCIDR('10.0.0.1', [])", expected: false},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestInCIDR_errors(t *testing.T) {
+	for _, expr := range []string{
+		"inCIDR('not an ip', '10.0.0.0/8')",
+		"inCIDR('10.0.0.1', '10.0.0.0/33')",
+		"inCIDR('10.0.0.1', 'garbage')",
+		"inCIDR('10.0.0.1', ['garbage'])",
+	} {
+		if _, err := evalExpr(expr); err == nil {
+			t.Errorf("%s: expecting error", expr)
+		}
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	timeNow = func() time.Time {
+		loc, _ := time.LoadLocation("Europe/Madrid")
+		return time.Date(2018, 12, 10, 1, 0, 0, 0, loc)
+	}
+	defer func() { timeNow = time.Now }()
+
+	for _, tc := range []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: "isExpired(1544399999)", expected: true},
+		{expr: "isExpired(1544400000)", expected: true},
+		{expr: "isExpired(1544400001)", expected: false},
+		{expr: "isExpired(1544400000.0)", expected: true},
+		{expr: "isExpired(1544400000.5)", expected: true},
+		{expr: "isExpired(1544400001.0)", expected: false},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func evalExpr(expr string) (interface{}, error) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	prg, err := p.Parse(InterpretableDefinition{CheckExpression: expr})
+	if err != nil {
+		return nil, err
+	}
+	res, _, err := prg.Eval(map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	return res.Value(), nil
+}
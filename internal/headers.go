@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// header returns the first value of the header, looked up ignoring the case of its name, or an
+// empty string if the header is missing or it has no values
+func header(lhs, rhs ref.Val) ref.Val {
+	values, err := headerLookup("header", lhs, rhs)
+	if err != nil {
+		return err
+	}
+	if values == nil || values.Size() == types.IntZero {
+		return types.String("")
+	}
+	v, ok := values.Get(types.IntZero).(types.String)
+	if !ok {
+		return types.NewErr("header: unexpected value type")
+	}
+	return v
+}
+
+// hasHeader checks if the header is present, looking it up ignoring the case of its name
+func hasHeader(lhs, rhs ref.Val) ref.Val {
+	values, err := headerLookup("hasHeader", lhs, rhs)
+	if err != nil {
+		return err
+	}
+	return types.Bool(values != nil)
+}
+
+// headerLookup returns the values of the first header matching the name, nil if there is none
+func headerLookup(fn string, lhs, rhs ref.Val) (traits.Lister, ref.Val) {
+	headers, ok := lhs.(traits.Mapper)
+	if !ok {
+		return nil, types.NewErr("%s: unexpected headers type %s", fn, lhs.Type().TypeName())
+	}
+	name, ok := rhs.(types.String)
+	if !ok {
+		return nil, types.NewErr("%s: unexpected name type %s", fn, rhs.Type().TypeName())
+	}
+
+	for it := headers.Iterator(); it.HasNext() == types.True; {
+		k := it.Next()
+		key, ok := k.(types.String)
+		if !ok || !strings.EqualFold(string(key), string(name)) {
+			continue
+		}
+		values, ok := headers.Get(k).(traits.Lister)
+		if !ok {
+			return nil, types.NewErr("%s: unexpected values type", fn)
+		}
+		return values, nil
+	}
+	return nil, nil
+}
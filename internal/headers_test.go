@@ -0,0 +1,31 @@
+package internal
+
+import "testing"
+
+func TestHeader(t *testing.T) {
+	headers := "{'Content-Type': ['application/json', 'text/plain'], 'x-api-key': ['secret'], 'X-Empty': []}"
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "header(" + headers + ", 'Content-Type')", expected: "application/json"},
+		{expr: "header(" + headers + ", 'content-type')", expected: "application/json"},
+		{expr: "header(" + headers + ", 'CONTENT-TYPE')", expected: "application/json"},
+		{expr: "header(" + headers + ", 'X-Api-Key')", expected: "secret"},
+		{expr: "header(" + headers + ", 'X-Empty')", expected: ""},
+		{expr: "header(" + headers + ", 'Authorization')", expected: ""},
+		{expr: "hasHeader(" + headers + ", 'x-API-key')", expected: true},
+		{expr: "hasHeader(" + headers + ", 'x-empty')", expected: true},
+		{expr: "hasHeader(" + headers + ", 'Authorization')", expected: false},
+		{expr: "hasHeader({}, 'Authorization')", expected: false},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+var (
+	ErrListName = errors.New("cel: invalid list name")
+	ErrListType = errors.New("cel: invalid list value, only strings, numbers and bools are supported")
+	ErrNoList   = errors.New("cel: the expression references an undeclared list")
+)
+
+// Lists are the named sets of values declared in the config, so the expressions of the pipe can
+// check the membership of a value with inList(name, value) in constant time, regardless of the
+// size of the list
+type Lists struct {
+	sets map[string]map[interface{}]bool
+	key  string
+}
+
+// NewLists validates the lists and builds their sets. Like with the vars, the JSON numbers
+// without decimals are stored as ints and the rest as doubles
+func NewLists(lists map[string][]interface{}) (Lists, error) {
+	res := Lists{sets: make(map[string]map[interface{}]bool, len(lists))}
+	names := make([]string, 0, len(lists))
+	for name := range lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		if name == "" {
+			return Lists{}, ErrListName
+		}
+		set := make(map[interface{}]bool, len(lists[name]))
+		for _, elem := range lists[name] {
+			v, _, ok := scalarValue(elem)
+			if !ok {
+				return Lists{}, ErrListType
+			}
+			set[v] = true
+		}
+		res.sets[name] = set
+		fmt.Fprintf(h, "%q:%v\n", name, lists[name])
+	}
+	if len(names) > 0 {
+		res.key = hex.EncodeToString(h.Sum(nil))
+	}
+	return res, nil
+}
+
+// overload returns the implementation of inList, bound to the sets of the lists
+func (l Lists) overload() *functions.Overload {
+	return &functions.Overload{Operator: "inList", Binary: func(lhs, rhs ref.Val) ref.Val {
+		name, ok := lhs.(types.String)
+		if !ok {
+			return types.NewErr("inList: unexpected name type %s", lhs.Type().TypeName())
+		}
+		set, ok := l.sets[string(name)]
+		if !ok {
+			return types.NewErr("inList: undeclared list '%s'", name)
+		}
+		v, ok := setKey(rhs)
+		return types.Bool(ok && set[v])
+	}}
+}
+
+// setKey returns the key of the value in the sets, following the normalization of NewLists
+func setKey(val ref.Val) (interface{}, bool) {
+	switch v := val.(type) {
+	case types.String:
+		return string(v), true
+	case types.Bool:
+		return bool(v), true
+	case types.Int:
+		return int64(v), true
+	case types.Uint:
+		if v > math.MaxInt64 {
+			return nil, false
+		}
+		return int64(v), true
+	case types.Double:
+		k, _, ok := scalarValue(float64(v))
+		return k, ok
+	default:
+		return nil, false
+	}
+}
+
+// validateLists checks the literal names of the lists referenced by the expression, so the typos
+// are detected when parsing the definitions instead of failing every evaluation
+func (l Lists) validate(e *exprpb.Expr) error {
+	var err error
+	walkExpr(e, func(e *exprpb.Expr) {
+		call, ok := e.ExprKind.(*exprpb.Expr_CallExpr)
+		if !ok || call.CallExpr.Function != "inList" || len(call.CallExpr.Args) != 2 {
+			return
+		}
+		c, ok := call.CallExpr.Args[0].ExprKind.(*exprpb.Expr_ConstExpr)
+		if !ok {
+			return
+		}
+		if name, ok := c.ConstExpr.ConstantKind.(*exprpb.Constant_StringValue); ok {
+			if _, ok := l.sets[name.StringValue]; !ok && err == nil {
+				err = ErrNoList
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestNewLists(t *testing.T) {
+	for _, tc := range []struct {
+		lists map[string][]interface{}
+		err   error
+	}{
+		{lists: nil},
+		{lists: map[string][]interface{}{"tenants": {"acme", "globex"}, "ids": {1.0, 2.5, true}}},
+		{lists: map[string][]interface{}{"": {"acme"}}, err: ErrListName},
+		{lists: map[string][]interface{}{"nested": {[]interface{}{"acme"}}}, err: ErrListType},
+		{lists: map[string][]interface{}{"objects": {map[string]interface{}{}}}, err: ErrListType},
+	} {
+		if _, err := NewLists(tc.lists); err != tc.err {
+			t.Errorf("%v: unexpected error: %v", tc.lists, err)
+		}
+	}
+}
+
+func TestParser_inList(t *testing.T) {
+	tenants := make([]interface{}, 5000)
+	for i := range tenants {
+		tenants[i] = fmt.Sprintf("tenant-%d", i)
+	}
+	lists, err := NewLists(map[string][]interface{}{
+		"tenants": tenants,
+		"codes":   {200.0, 204.0, 1.5},
+		"flags":   {true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewCheckExpressionParser(logging.NoOp).WithLists(lists)
+
+	for _, tc := range []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: "inList('tenants', 'tenant-0')", expected: true},
+		{expr: "inList('tenants', 'tenant-4999')", expected: true},
+		{expr: "inList('tenants', 'tenant-5000')", expected: false},
+		{expr: "inList('tenants', 42)", expected: false},
+		{expr: "inList('codes', 204)", expected: true},
+		{expr: "inList('codes', 204u)", expected: true},
+		{expr: "inList('codes', 200.0)", expected: true},
+		{expr: "inList('codes', 1.5)", expected: true},
+		{expr: "inList('codes', '200')", expected: false},
+		{expr: "inList('flags', true)", expected: true},
+		{expr: "inList('flags', false)", expected: false},
+	} {
+		prg, err := p.Parse(InterpretableDefinition{CheckExpression: tc.expr})
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err.Error())
+			continue
+		}
+		res, _, err := prg.Eval(map[string]interface{}{})
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err.Error())
+			continue
+		}
+		if res.Value() != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+
+	if _, err := p.Parse(InterpretableDefinition{CheckExpression: "inList('tenant', 'tenant-0')"}); err != ErrNoList {
+		t.Errorf("unexpected error for an undeclared list: %v", err)
+	}
+	prg, err := p.Parse(InterpretableDefinition{CheckExpression: "inList('ten' + 'ant', 'tenant-0')"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := prg.Eval(map[string]interface{}{}); err == nil {
+		t.Error("expecting error for an undeclared list")
+	}
+
+	// the programs are cached, but every parser checks the membership against its own lists
+	other, err := NewLists(map[string][]interface{}{"tenants": {"acme"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prg, err = NewCheckExpressionParser(logging.NoOp).WithLists(other).Parse(InterpretableDefinition{CheckExpression: "inList('tenants', 'tenant-0')"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _, err := prg.Eval(map[string]interface{}{}); err != nil || res.Value() != false {
+		t.Errorf("unexpected result: %v %v", res, err)
+	}
+}
+
+func BenchmarkInList(b *testing.B) {
+	for _, size := range []int{10, 1000, 100000} {
+		values := make([]interface{}, size)
+		for i := range values {
+			values[i] = fmt.Sprintf("tenant-%d", i)
+		}
+		lists, err := NewLists(map[string][]interface{}{"tenants": values})
+		if err != nil {
+			b.Fatal(err)
+		}
+		prg, err := NewCheckExpressionParser(logging.NoOp).WithLists(lists).Parse(InterpretableDefinition{
+			CheckExpression: fmt.Sprintf("inList('tenants', 'tenant-%d')", size-1),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				prg.Eval(map[string]interface{}{})
+			}
+		})
+	}
+}
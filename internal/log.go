@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// MaxLogsPerSecond is the maximum number of messages of the log function sent to the sinks each
+// second, across all the expressions. The rest are dropped and counted
+const MaxLogsPerSecond = 10
+
+// RedactedMessage replaces the messages of the log function called by the redacted evaluators
+const RedactedMessage = "[REDACTED]"
+
+type logSinkKey struct{}
+
+type logRedactKey struct{}
+
+// LogSink receives the messages of the log function, along with the number of messages dropped
+// since the previous one
+type LogSink func(msg string, dropped int)
+
+// WithLogSink returns a copy of the context sending the messages of the log function to the sink
+func WithLogSink(ctx context.Context, sink LogSink) context.Context {
+	return context.WithValue(ctx, logSinkKey{}, sink)
+}
+
+// WithRedactedLogs returns a copy of the context replacing the messages of the log function with
+// RedactedMessage, for the evaluators referencing the redacted identifiers or keys
+func WithRedactedLogs(ctx context.Context) context.Context {
+	return context.WithValue(ctx, logRedactKey{}, true)
+}
+
+// logMessage sends the message to the sink of the evaluation context and returns true, so the
+// calls can be chained with the rest of the expression. The messages are sent only while the
+// limiter allows it, and the evaluations without a sink just return true
+func logMessage(ctx, msg ref.Val) ref.Val {
+	c, ok := ctx.(contextVal)
+	if !ok {
+		return types.NewErr("log: missing evaluation context")
+	}
+	m, ok := msg.(types.String)
+	if !ok {
+		return types.NewErr("log: unexpected message type %s", msg.Type().TypeName())
+	}
+	sink, ok := c.Context.Value(logSinkKey{}).(LogSink)
+	if !ok {
+		return types.True
+	}
+	if redacted, _ := c.Context.Value(logRedactKey{}).(bool); redacted {
+		m = RedactedMessage
+	}
+	if allowed, dropped := logs.allow(timeNow()); allowed {
+		sink(string(m), dropped)
+	}
+	return types.True
+}
+
+var logs = &logLimiter{}
+
+// logLimiter allows MaxLogsPerSecond messages in each window of a second
+type logLimiter struct {
+	mu      sync.Mutex
+	window  time.Time
+	count   int
+	dropped int
+}
+
+// allow returns true if the message can be sent, along with the number of messages dropped since
+// the last one allowed
+func (l *logLimiter) allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.window) >= time.Second {
+		l.window = now
+		l.count = 0
+	}
+	if l.count >= MaxLogsPerSecond {
+		l.dropped++
+		return false, 0
+	}
+	l.count++
+	dropped := l.dropped
+	l.dropped = 0
+	return true, dropped
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/google/cel-go/common/types"
+)
+
+func TestLogMessage(t *testing.T) {
+	logs = &logLimiter{}
+	defer func() { logs = &logLimiter{} }()
+
+	p := NewCheckExpressionParser(logging.NoOp)
+	evals, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "log('checking ' + req_method) && req_method == 'GET'"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !evals[0].References(ContextKey) {
+		t.Error("the context is not referenced")
+	}
+
+	messages := []string{}
+	ctx := WithLogSink(context.Background(), func(msg string, _ int) { messages = append(messages, msg) })
+	for _, method := range []string{"GET", "POST"} {
+		res, _, err := evals[0].Eval(WithContext(ctx, map[string]interface{}{PreKey + "_method": method}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != types.Bool(method == "GET") {
+			t.Errorf("%s: unexpected result: %v", method, res)
+		}
+	}
+	if len(messages) != 2 || messages[0] != "checking GET" || messages[1] != "checking POST" {
+		t.Errorf("unexpected messages: %v", messages)
+	}
+
+	// without a sink, the messages are discarded
+	res, _, err := evals[0].Eval(WithContext(context.Background(), map[string]interface{}{PreKey + "_method": "GET"}))
+	if err != nil || res != types.True {
+		t.Errorf("unexpected result without sink: %v %v", res, err)
+	}
+
+	// type checked as any other function
+	if _, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "log(req_method == 'GET')"}}); err != ErrChecking {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	l := &logLimiter{}
+	now := time.Date(2018, 12, 10, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < MaxLogsPerSecond; i++ {
+		if ok, _ := l.allow(now.Add(time.Duration(i) * time.Millisecond)); !ok {
+			t.Fatalf("message #%d not allowed", i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow(now.Add(999 * time.Millisecond)); ok {
+			t.Errorf("message over the limit allowed")
+		}
+	}
+	ok, dropped := l.allow(now.Add(time.Second))
+	if !ok || dropped != 3 {
+		t.Errorf("unexpected result of the next window: %v %d", ok, dropped)
+	}
+	if ok, dropped := l.allow(now.Add(time.Second)); !ok || dropped != 0 {
+		t.Errorf("the dropped messages are reported twice: %v %d", ok, dropped)
+	}
+}
@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// param returns the value of the path parameter, looked up ignoring the case of its name, or an
+// empty string if it is missing. KrakenD titles the names of the parameters ({id} is exposed as
+// Id and {user_id} as User_id), so the exact name is tried first and the rest of keys after it
+func param(lhs, rhs ref.Val) ref.Val {
+	params, ok := lhs.(traits.Mapper)
+	if !ok {
+		return types.NewErr("param: unexpected params type %s", lhs.Type().TypeName())
+	}
+	name, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("param: unexpected name type %s", rhs.Type().TypeName())
+	}
+
+	if params.Contains(name) == types.True {
+		return params.Get(name)
+	}
+	for it := params.Iterator(); it.HasNext() == types.True; {
+		k := it.Next()
+		if key, ok := k.(types.String); ok && strings.EqualFold(string(key), string(name)) {
+			return params.Get(k)
+		}
+	}
+	return types.String("")
+}
@@ -0,0 +1,34 @@
+package internal
+
+import "testing"
+
+func TestParam(t *testing.T) {
+	// the keys as titled by KrakenD for the route /users/{id}/orders/{order_id}/{tenant-id}/{ID}
+	params := "{'Id': '42', 'Order_id': '7', 'Tenant-Id': 'acme', 'ID': 'upper'}"
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "param(" + params + ", 'Id')", expected: "42"},
+		{expr: "param(" + params + ", 'ID')", expected: "upper"},
+		{expr: "param(" + params + ", 'order_id')", expected: "7"},
+		{expr: "param(" + params + ", 'ORDER_ID')", expected: "7"},
+		{expr: "param(" + params + ", 'tenant-id')", expected: "acme"},
+		{expr: "param(" + params + ", 'missing')", expected: ""},
+		{expr: "param({}, 'id')", expected: ""},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+
+	// id is lowercased, so it matches both Id and ID: any of them is returned
+	if res, err := evalExpr("param(" + params + ", 'id') in ['42', 'upper']"); err != nil || res != true {
+		t.Errorf("unexpected result for the ambiguous name: %v %v", res, err)
+	}
+}
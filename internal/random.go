@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// randUUID returns a random (version 4) UUID, in its canonical form. As randInt, it reads from the
+// crypto source, so the values can not be predicted from the previous ones
+func randUUID(_ ...ref.Val) ref.Val {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return types.NewErr("uuid: %s", err.Error())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return types.String(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+}
+
+// randInt returns a uniformly distributed int in [0, n)
+func randInt(val ref.Val) ref.Val {
+	n, ok := val.(types.Int)
+	if !ok {
+		return types.NewErr("randInt: unexpected bound type %s", val.Type().TypeName())
+	}
+	if n <= 0 {
+		return types.NewErr("randInt: the bound must be positive, got %d", n)
+	}
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return types.NewErr("randInt: %s", err.Error())
+	}
+	return types.Int(v.Int64())
+}
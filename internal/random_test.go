@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRandUUID(t *testing.T) {
+	uuidV4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		res, err := evalExpr("uuid()")
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+			return
+		}
+		id, _ := res.(string)
+		if !uuidV4.MatchString(id) {
+			t.Errorf("unexpected uuid %v", res)
+		}
+		if seen[id] {
+			t.Errorf("repeated uuid %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestRandInt(t *testing.T) {
+	seen := map[int64]bool{}
+	for i := 0; i < 1000; i++ {
+		res, err := evalExpr("randInt(10)")
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+			return
+		}
+		n, _ := res.(int64)
+		if n < 0 || n >= 10 {
+			t.Errorf("out of range result %v", res)
+		}
+		seen[n] = true
+	}
+	if len(seen) != 10 {
+		t.Errorf("unexpected number of distinct results: %d", len(seen))
+	}
+
+	for _, expr := range []string{"randInt(0)", "randInt(-1)"} {
+		if _, err := evalExpr(expr); err == nil {
+			t.Errorf("%s: expecting error", expr)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// ErrPattern is returned when an expression contains an invalid regular expression literal
+var ErrPattern = errors.New("cel: invalid regular expression")
+
+// maxCachedPatterns limits the size of the pattern cache, since the patterns are not always
+// literals and could be built from the request data
+const maxCachedPatterns = 1000
+
+var patterns = &patternCache{patterns: map[string]*regexp.Regexp{}}
+
+type patternCache struct {
+	mu       sync.RWMutex
+	patterns map[string]*regexp.Regexp
+}
+
+func (c *patternCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.RLock()
+	re, ok := c.patterns[pattern]
+	c.mu.RUnlock()
+	if ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.patterns) < maxCachedPatterns {
+		c.patterns[pattern] = re
+	}
+	c.mu.Unlock()
+	return re, nil
+}
+
+// extract returns the first capture group of the pattern in the string, the whole match if the
+// pattern has no groups or an empty string if the pattern does not match
+func extract(lhs, rhs ref.Val) ref.Val {
+	s, ok := lhs.(types.String)
+	if !ok {
+		return types.NewErr("extract: unexpected string type %s", lhs.Type().TypeName())
+	}
+	pattern, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("extract: unexpected pattern type %s", rhs.Type().TypeName())
+	}
+	re, err := patterns.compile(string(pattern))
+	if err != nil {
+		return types.NewErr("extract: %s", err.Error())
+	}
+
+	match := re.FindStringSubmatch(string(s))
+	switch len(match) {
+	case 0:
+		return types.String("")
+	case 1:
+		return types.String(match[0])
+	default:
+		return types.String(match[1])
+	}
+}
+
+// patternFunctions are the functions receiving a regular expression as their last argument
+var patternFunctions = map[string]bool{
+	"matches": true,
+	"extract": true,
+}
+
+// validatePatterns compiles every literal pattern of the expression, so the invalid ones are
+// detected when parsing the definitions instead of failing every evaluation
+func validatePatterns(e *exprpb.Expr) error {
+	if e == nil {
+		return nil
+	}
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_SelectExpr:
+		return validatePatterns(k.SelectExpr.Operand)
+	case *exprpb.Expr_CallExpr:
+		call := k.CallExpr
+		if args := call.Args; patternFunctions[call.Function] && len(args) > 0 {
+			if c, ok := args[len(args)-1].ExprKind.(*exprpb.Expr_ConstExpr); ok {
+				if pattern, ok := c.ConstExpr.ConstantKind.(*exprpb.Constant_StringValue); ok {
+					if _, err := patterns.compile(pattern.StringValue); err != nil {
+						return ErrPattern
+					}
+				}
+			}
+		}
+		if err := validatePatterns(call.Target); err != nil {
+			return err
+		}
+		for _, arg := range call.Args {
+			if err := validatePatterns(arg); err != nil {
+				return err
+			}
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, elem := range k.ListExpr.Elements {
+			if err := validatePatterns(elem); err != nil {
+				return err
+			}
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range k.StructExpr.Entries {
+			if err := validatePatterns(entry.GetMapKey()); err != nil {
+				return err
+			}
+			if err := validatePatterns(entry.Value); err != nil {
+				return err
+			}
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		comp := k.ComprehensionExpr
+		for _, sub := range []*exprpb.Expr{comp.IterRange, comp.AccuInit, comp.LoopCondition, comp.LoopStep, comp.Result} {
+			if err := validatePatterns(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestMatches(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: "matches('/users/42', '^/users/[0-9]+$')", expected: true},
+		{expr: "matches('/users/42/posts', '^/users/[0-9]+$')", expected: false},
+		{expr: "matches('/v1/users/42/posts', 'users/[0-9]+')", expected: true},
+		{expr: "matches('/v1/users/me', 'users/[0-9]+')", expected: false},
+		{expr: "'/users/42'.matches('^/users/[0-9]+$')", expected: true},
+		{expr: "['/users/1', '/users/2'].all(p, matches(p, '^/users/[0-9]$'))", expected: true},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected string
+	}{
+		{expr: "extract('/users/42', '^/users/([0-9]+)$')", expected: "42"},
+		{expr: "extract('/users/42/posts', '^/users/([0-9]+)$')", expected: ""},
+		{expr: "extract('Bearer abc.def', 'Bearer (.+)')", expected: "abc.def"},
+		{expr: "extract('tenant-acme.example.com', '[a-z]+-[a-z]+')", expected: "tenant-acme"},
+		{expr: "extract('/users/42', '^/users/(?P<id>[0-9]+)$')", expected: "42"},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestParse_invalidPattern(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	for _, expr := range []string{
+		"matches(req_path, '^/users/[0-9+$')",
+		"req_path.matches('(unclosed')",
+		"extract(req_path, '*') == ''",
+		"req_method == 'GET' && [req_path].exists(p, p.matches('['))",
+	} {
+		if _, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: expr}}); err != ErrPattern {
+			t.Errorf("%s: unexpected error: %v", expr, err)
+		}
+	}
+}
+
+func TestExtract_dynamicPattern(t *testing.T) {
+	p := NewCheckExpressionParser(logging.NoOp)
+	prg, err := p.Parse(InterpretableDefinition{CheckExpression: "extract(req_path, req_method) == ''"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, _, err := prg.Eval(map[string]interface{}{"req_path": "/", "req_method": "("}); err == nil {
+		t.Error("expecting error")
+	}
+}
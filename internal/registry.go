@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
+	"github.com/google/cel-go/interpreter/functions"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// ContextKey is the hidden identifier carrying the context of the evaluation to the registered
+// functions. The calls to them get it as an extra first argument when they are compiled
+const ContextKey = "_cel_context"
+
+// contextFunctions are the custom functions getting the context as their first argument, like the
+// registered ones
+var contextFunctions = map[string]bool{"log": true}
+
+var (
+	ErrFunctionName = errors.New("cel: invalid or already declared function name")
+	ErrFunctionDecl = errors.New("cel: the function must declare its result and its implementation")
+)
+
+// Function is a custom function registered by the embedder. The types of the arguments and the
+// result are CEL types, like decls.String or decls.NewListType(decls.String)
+type Function struct {
+	Name   string
+	Args   []*exprpb.Type
+	Result *exprpb.Type
+	// Impl receives the context of the evaluation, cancelled when the request is cancelled or
+	// the timeout of the definition expires, and the arguments of the call
+	Impl func(ctx context.Context, args ...ref.Val) ref.Val
+}
+
+var registry = &functionRegistry{names: map[string]bool{}}
+
+type functionRegistry struct {
+	mu        sync.RWMutex
+	functions []function
+	names     map[string]bool
+}
+
+// RegisterFunction adds the function to the environment of all the expressions compiled after the
+// registration. The names of the custom and the standard functions can not be reused
+func RegisterFunction(f Function) error {
+	if f.Result == nil || f.Impl == nil {
+		return ErrFunctionDecl
+	}
+	if !varName.MatchString(f.Name) || reservedNames[f.Name] || f.Name == ContextKey || isDeclared(f.Name) {
+		return ErrFunctionName
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.names[f.Name] {
+		return ErrFunctionName
+	}
+	registry.names[f.Name] = true
+	registry.functions = append(registry.functions, registeredFunction(f))
+	return nil
+}
+
+// isDeclared returns true if the name is already used by a standard or a custom function
+func isDeclared(name string) bool {
+	for _, d := range checker.StandardDeclarations() {
+		if d.Name == name {
+			return true
+		}
+	}
+	for _, f := range customFunctions() {
+		if f.decl.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// registeredFunction declares the function with the context as its first argument and adapts the
+// implementation to every arity, since the interpreter dispatches the calls by their argument count
+func registeredFunction(f Function) function {
+	call := func(args ...ref.Val) ref.Val {
+		if len(args) == 0 {
+			return types.NewErr("%s: missing evaluation context", f.Name)
+		}
+		ctx, ok := args[0].(contextVal)
+		if !ok {
+			return types.NewErr("%s: missing evaluation context", f.Name)
+		}
+		return f.Impl(ctx.Context, args[1:]...)
+	}
+	return function{
+		decl: decls.NewFunction(f.Name,
+			decls.NewOverload(f.Name+"_registered", append([]*exprpb.Type{decls.Dyn}, f.Args...), f.Result),
+		),
+		overload: &functions.Overload{
+			Operator: f.Name,
+			Unary:    func(v ref.Val) ref.Val { return call(v) },
+			Binary:   func(lhs, rhs ref.Val) ref.Val { return call(lhs, rhs) },
+			Function: call,
+		},
+	}
+}
+
+func (r *functionRegistry) list() []function {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]function{}, r.functions...)
+}
+
+func (r *functionRegistry) has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.names[name]
+}
+
+// key identifies the set of registered functions, so the programs compiled before a registration
+// are not reused by the expressions compiled after it
+func (r *functionRegistry) key() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return strconv.Itoa(len(r.functions))
+}
+
+// injectContext adds the context identifier as the first argument of the calls to the registered
+// functions and to the custom ones needing it
+func injectContext(ast cel.Ast) (cel.Ast, error) {
+	parsed, err := cel.AstToParsedExpr(ast)
+	if err != nil {
+		return ast, err
+	}
+	id := maxExprID(parsed.Expr)
+	walkExpr(parsed.Expr, func(e *exprpb.Expr) {
+		call, ok := e.ExprKind.(*exprpb.Expr_CallExpr)
+		if !ok || call.CallExpr.Target != nil || !(registry.has(call.CallExpr.Function) || contextFunctions[call.CallExpr.Function]) {
+			return
+		}
+		id++
+		ctx := &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_IdentExpr{IdentExpr: &exprpb.Expr_Ident{Name: ContextKey}}}
+		call.CallExpr.Args = append([]*exprpb.Expr{ctx}, call.CallExpr.Args...)
+	})
+	return cel.ParsedExprToAst(parsed), nil
+}
+
+func maxExprID(e *exprpb.Expr) int64 {
+	var id int64
+	walkExpr(e, func(e *exprpb.Expr) {
+		if e.Id > id {
+			id = e.Id
+		}
+	})
+	return id
+}
+
+// walkExpr calls the func with the expression and all its subexpressions
+func walkExpr(e *exprpb.Expr, fn func(*exprpb.Expr)) {
+	if e == nil {
+		return
+	}
+	fn(e)
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_SelectExpr:
+		walkExpr(k.SelectExpr.Operand, fn)
+	case *exprpb.Expr_CallExpr:
+		walkExpr(k.CallExpr.Target, fn)
+		for _, arg := range k.CallExpr.Args {
+			walkExpr(arg, fn)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, elem := range k.ListExpr.Elements {
+			walkExpr(elem, fn)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range k.StructExpr.Entries {
+			walkExpr(entry.GetMapKey(), fn)
+			walkExpr(entry.Value, fn)
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		comp := k.ComprehensionExpr
+		for _, sub := range []*exprpb.Expr{comp.IterRange, comp.AccuInit, comp.LoopCondition, comp.LoopStep, comp.Result} {
+			walkExpr(sub, fn)
+		}
+	}
+}
+
+// WithContext returns the activation of the args exposing the context to the registered functions
+func WithContext(ctx context.Context, args interface{}) interface{} {
+	parent, err := interpreter.NewActivation(args)
+	if err != nil {
+		return args
+	}
+	child, err := interpreter.NewActivation(map[string]interface{}{ContextKey: contextVal{ctx}})
+	if err != nil {
+		return args
+	}
+	return interpreter.NewHierarchicalActivation(parent, child)
+}
+
+var contextType = types.NewTypeValue("cel.context")
+
+// contextVal wraps the context of the evaluation, so it can travel as an argument of the calls
+type contextVal struct {
+	context.Context
+}
+
+func (c contextVal) ConvertToNative(typeDesc reflect.Type) (interface{}, error) {
+	return nil, fmt.Errorf("cel: the evaluation context can not be converted to %v", typeDesc)
+}
+
+func (c contextVal) ConvertToType(typeValue ref.Type) ref.Val {
+	return types.NewErr("cel: the evaluation context can not be converted to %s", typeValue.TypeName())
+}
+
+func (c contextVal) Equal(other ref.Val) ref.Val {
+	return types.False
+}
+
+func (c contextVal) Type() ref.Type {
+	return contextType
+}
+
+func (c contextVal) Value() interface{} {
+	return c.Context
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+func TestRegisterFunction(t *testing.T) {
+	var received context.Context
+	if err := RegisterFunction(Function{
+		Name:   "testReputation",
+		Args:   []*exprpb.Type{decls.String, decls.Int},
+		Result: decls.Bool,
+		Impl: func(ctx context.Context, args ...ref.Val) ref.Val {
+			received = ctx
+			if len(args) != 2 {
+				return types.NewErr("unexpected args %v", args)
+			}
+			return types.Bool(args[0].Equal(types.String("10.0.0.1")) == types.True && args[1].Equal(types.Int(3)) == types.True)
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewCheckExpressionParser(logging.NoOp)
+	evals, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "req_client_ip != '' && [1].all(x, testReputation(req_client_ip, 3))"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !evals[0].References(ContextKey) {
+		t.Error("the context is not referenced")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, _, err := evals[0].Eval(WithContext(ctx, map[string]interface{}{PreKey + "_client_ip": "10.0.0.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != types.True {
+		t.Errorf("unexpected result: %v", res)
+	}
+	if _, ok := received.Deadline(); !ok {
+		t.Error("the function did not receive the context")
+	}
+
+	// type checked as any other function
+	if _, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: "testReputation(req_client_ip)"}}); err != ErrChecking {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRegisterFunction_errors(t *testing.T) {
+	impl := func(_ context.Context, _ ...ref.Val) ref.Val { return types.True }
+	for _, f := range []Function{
+		{Name: "testNoImpl", Result: decls.Bool},
+		{Name: "testNoResult", Impl: impl},
+		{Name: "1invalid", Result: decls.Bool, Impl: impl},
+		{Name: "size", Result: decls.Bool, Impl: impl},
+		{Name: "inCIDR", Result: decls.Bool, Impl: impl},
+		{Name: JwtKey, Result: decls.Bool, Impl: impl},
+		{Name: ContextKey, Result: decls.Bool, Impl: impl},
+	} {
+		if err := RegisterFunction(f); err == nil {
+			t.Errorf("%s: expecting error", f.Name)
+		}
+	}
+
+	if err := RegisterFunction(Function{Name: "testTwice", Result: decls.Bool, Impl: impl}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterFunction(Function{Name: "testTwice", Result: decls.Bool, Impl: impl}); err != ErrFunctionName {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,955 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+var (
+	ErrSchemaName = errors.New("cel: invalid schema name")
+	ErrSchema     = errors.New("cel: invalid JSON schema")
+	ErrNoSchema   = errors.New("cel: the expression references an undeclared schema")
+)
+
+// maxSchemaErrors limits the validation errors reported by schemaErrors, so a huge invalid body
+// does not build a huge message
+const maxSchemaErrors = 10
+
+// Schemas are the named JSON schemas declared in the config, so the expressions of the pipe can
+// validate a value with matchesSchema(value, name) and list the failures with schemaErrors
+type Schemas struct {
+	schemas map[string]*schema
+	key     string
+}
+
+// NewSchemas loads and compiles the schemas. Every schema is either the JSON schema itself or the
+// path of a file containing it. The compiled schemas are cached by content, so the pipes and the
+// reloads declaring the same schema share it
+func NewSchemas(schemas map[string]interface{}) (Schemas, error) {
+	res := Schemas{schemas: make(map[string]*schema, len(schemas))}
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		if name == "" {
+			return Schemas{}, ErrSchemaName
+		}
+		doc, err := loadSchema(schemas[name])
+		if err != nil {
+			return Schemas{}, err
+		}
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return Schemas{}, ErrSchema
+		}
+		s, err := compiledSchemas.get(string(b), doc)
+		if err != nil {
+			return Schemas{}, err
+		}
+		res.schemas[name] = s
+		fmt.Fprintf(h, "%q:%s\n", name, b)
+	}
+	if len(names) > 0 {
+		res.key = hex.EncodeToString(h.Sum(nil))
+	}
+	return res, nil
+}
+
+// loadSchema returns the document of the schema, reading it from its file when declared as a path
+func loadSchema(v interface{}) (interface{}, error) {
+	path, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, ErrSchema
+	}
+	return doc, nil
+}
+
+// overloads returns the implementations of matchesSchema and schemaErrors, bound to the schemas
+func (s Schemas) overloads() []*functions.Overload {
+	return []*functions.Overload{
+		{Operator: "matchesSchema", Binary: func(lhs, rhs ref.Val) ref.Val {
+			sch, err := s.lookup("matchesSchema", rhs)
+			if err != nil {
+				return err
+			}
+			return types.Bool(len(sch.validate(normalizeJSON(NativeValue(lhs)), "", 1)) == 0)
+		}},
+		{Operator: "schemaErrors", Binary: func(lhs, rhs ref.Val) ref.Val {
+			sch, err := s.lookup("schemaErrors", rhs)
+			if err != nil {
+				return err
+			}
+			return types.NewStringList(types.DefaultTypeAdapter, sch.validate(normalizeJSON(NativeValue(lhs)), "", maxSchemaErrors))
+		}},
+	}
+}
+
+func (s Schemas) lookup(function string, name ref.Val) (*schema, ref.Val) {
+	n, ok := name.(types.String)
+	if !ok {
+		return nil, types.NewErr("%s: unexpected name type %s", function, name.Type().TypeName())
+	}
+	sch, ok := s.schemas[string(n)]
+	if !ok {
+		return nil, types.NewErr("%s: undeclared schema '%s'", function, n)
+	}
+	return sch, nil
+}
+
+// validate checks the literal names of the schemas referenced by the expression, so the typos are
+// detected when parsing the definitions instead of failing every evaluation
+func (s Schemas) validate(e *exprpb.Expr) error {
+	var err error
+	walkExpr(e, func(e *exprpb.Expr) {
+		call, ok := e.ExprKind.(*exprpb.Expr_CallExpr)
+		if !ok || (call.CallExpr.Function != "matchesSchema" && call.CallExpr.Function != "schemaErrors") || len(call.CallExpr.Args) != 2 {
+			return
+		}
+		c, ok := call.CallExpr.Args[1].ExprKind.(*exprpb.Expr_ConstExpr)
+		if !ok {
+			return
+		}
+		if name, ok := c.ConstExpr.ConstantKind.(*exprpb.Constant_StringValue); ok {
+			if _, ok := s.schemas[name.StringValue]; !ok && err == nil {
+				err = ErrNoSchema
+			}
+		}
+	})
+	return err
+}
+
+// schemaCache stores the compiled schemas by their canonical JSON
+type schemaCache struct {
+	mu      sync.Mutex
+	schemas map[string]*schema
+}
+
+func (c *schemaCache) get(key string, doc interface{}) (*schema, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.schemas[key]; ok {
+		return s, nil
+	}
+	s, err := compileSchema(doc)
+	if err != nil {
+		return nil, err
+	}
+	c.schemas[key] = s
+	return s, nil
+}
+
+var compiledSchemas = &schemaCache{schemas: map[string]*schema{}}
+
+// schema is a compiled JSON schema (draft-07). The annotations are ignored, as well as the
+// formats without a validator here, as the draft allows
+type schema struct {
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constVal interface{}
+	hasConst bool
+
+	properties           map[string]*schema
+	patternProperties    []patternSchema
+	additionalProperties *schema
+	required             []string
+	propertyNames        *schema
+	dependencies         map[string]dependency
+	minProperties        *int
+	maxProperties        *int
+
+	items           *schema
+	itemsList       []*schema
+	additionalItems *schema
+	contains        *schema
+	minItems        *int
+	maxItems        *int
+	uniqueItems     bool
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+	format    string
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	allOf []*schema
+	anyOf []*schema
+	oneOf []*schema
+	not   *schema
+	ifS   *schema
+	thenS *schema
+	elseS *schema
+
+	ref *schema
+}
+
+type patternSchema struct {
+	re     *regexp.Regexp
+	schema *schema
+}
+
+// dependency is either the list of the properties required by a property or the schema applied
+// to the object when it has the property
+type dependency struct {
+	required []string
+	schema   *schema
+}
+
+// schemaCompiler resolves the local references of a document ("#" and "#/definitions/..."),
+// compiling each of their targets once, so the recursive schemas are supported
+type schemaCompiler struct {
+	root interface{}
+	refs map[string]*schema
+}
+
+func compileSchema(doc interface{}) (*schema, error) {
+	c := &schemaCompiler{root: doc, refs: map[string]*schema{}}
+	s, err := c.ref("#")
+	if err != nil {
+		return nil, err
+	}
+	visited := map[*schema]bool{}
+	for _, target := range c.refs {
+		if loops(target, map[*schema]bool{}, visited) {
+			return nil, ErrSchema
+		}
+	}
+	return s, nil
+}
+
+// loops returns true if the schema reaches itself again without moving to a child of the value,
+// like {"$ref": "#"} or {"allOf": [{"$ref": "#"}]}, since its validation would never end. The
+// recursive schemas descending into the properties or the items are fine
+func loops(s *schema, path, visited map[*schema]bool) bool {
+	if path[s] {
+		return true
+	}
+	if visited[s] {
+		return false
+	}
+	visited[s] = true
+	path[s] = true
+	defer delete(path, s)
+
+	applied := append(append(append([]*schema{s.ref, s.not, s.ifS, s.thenS, s.elseS}, s.allOf...), s.anyOf...), s.oneOf...)
+	for _, d := range s.dependencies {
+		applied = append(applied, d.schema)
+	}
+	for _, sub := range applied {
+		if sub != nil && loops(sub, path, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *schemaCompiler) ref(pointer string) (*schema, error) {
+	if s, ok := c.refs[pointer]; ok {
+		return s, nil
+	}
+	if !strings.HasPrefix(pointer, "#") {
+		return nil, ErrSchema
+	}
+	doc, ok := resolvePointer(c.root, strings.TrimPrefix(pointer, "#"))
+	if !ok {
+		return nil, ErrSchema
+	}
+	s := &schema{}
+	c.refs[pointer] = s
+	if err := c.compileInto(s, doc); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// resolvePointer returns the value at the JSON pointer of the document
+func resolvePointer(doc interface{}, pointer string) (interface{}, bool) {
+	if pointer == "" {
+		return doc, true
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, false
+	}
+	for _, token := range strings.Split(pointer[1:], "/") {
+		if unescaped, err := url.PathUnescape(token); err == nil {
+			token = unescaped
+		}
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(d) {
+				return nil, false
+			}
+			doc = d[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+func (c *schemaCompiler) compile(doc interface{}) (*schema, error) {
+	s := &schema{}
+	return s, c.compileInto(s, doc)
+}
+
+func (c *schemaCompiler) compileInto(s *schema, doc interface{}) error {
+	if b, ok := doc.(bool); ok {
+		s.always = &b
+		return nil
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return ErrSchema
+	}
+
+	// the siblings of a reference are ignored in draft-07
+	if v, ok := m["$ref"]; ok {
+		pointer, ok := v.(string)
+		if !ok {
+			return ErrSchema
+		}
+		target, err := c.ref(pointer)
+		if err != nil {
+			return err
+		}
+		s.ref = target
+		return nil
+	}
+
+	var err error
+	if s.types, err = schemaTypes(m["type"]); err != nil {
+		return err
+	}
+	if v, ok := m["enum"]; ok {
+		if s.enum, ok = v.([]interface{}); !ok {
+			return ErrSchema
+		}
+		s.enum = normalizeJSON(s.enum).([]interface{})
+	}
+	if v, ok := m["const"]; ok {
+		s.constVal, s.hasConst = normalizeJSON(v), true
+	}
+
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return ErrSchema
+		}
+		s.properties = make(map[string]*schema, len(props))
+		for name, p := range props {
+			if s.properties[name], err = c.compile(p); err != nil {
+				return err
+			}
+		}
+	}
+	if v, ok := m["patternProperties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return ErrSchema
+		}
+		patterns := make([]string, 0, len(props))
+		for pattern := range props {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return ErrSchema
+			}
+			p, err := c.compile(props[pattern])
+			if err != nil {
+				return err
+			}
+			s.patternProperties = append(s.patternProperties, patternSchema{re: re, schema: p})
+		}
+	}
+	if s.additionalProperties, err = c.optional(m, "additionalProperties"); err != nil {
+		return err
+	}
+	if s.required, err = stringList(m["required"]); err != nil {
+		return err
+	}
+	if s.propertyNames, err = c.optional(m, "propertyNames"); err != nil {
+		return err
+	}
+	if v, ok := m["dependencies"]; ok {
+		deps, ok := v.(map[string]interface{})
+		if !ok {
+			return ErrSchema
+		}
+		s.dependencies = make(map[string]dependency, len(deps))
+		for name, d := range deps {
+			if list, ok := d.([]interface{}); ok {
+				required, err := stringList(list)
+				if err != nil {
+					return err
+				}
+				s.dependencies[name] = dependency{required: required}
+				continue
+			}
+			ds, err := c.compile(d)
+			if err != nil {
+				return err
+			}
+			s.dependencies[name] = dependency{schema: ds}
+		}
+	}
+	if s.minProperties, err = schemaInt(m, "minProperties"); err != nil {
+		return err
+	}
+	if s.maxProperties, err = schemaInt(m, "maxProperties"); err != nil {
+		return err
+	}
+
+	if v, ok := m["items"]; ok {
+		if list, ok := v.([]interface{}); ok {
+			if s.itemsList, err = c.compileList(list); err != nil {
+				return err
+			}
+		} else if s.items, err = c.compile(v); err != nil {
+			return err
+		}
+	}
+	if s.additionalItems, err = c.optional(m, "additionalItems"); err != nil {
+		return err
+	}
+	if s.contains, err = c.optional(m, "contains"); err != nil {
+		return err
+	}
+	if s.minItems, err = schemaInt(m, "minItems"); err != nil {
+		return err
+	}
+	if s.maxItems, err = schemaInt(m, "maxItems"); err != nil {
+		return err
+	}
+	if v, ok := m["uniqueItems"]; ok {
+		if s.uniqueItems, ok = v.(bool); !ok {
+			return ErrSchema
+		}
+	}
+
+	if s.minLength, err = schemaInt(m, "minLength"); err != nil {
+		return err
+	}
+	if s.maxLength, err = schemaInt(m, "maxLength"); err != nil {
+		return err
+	}
+	if v, ok := m["pattern"]; ok {
+		pattern, ok := v.(string)
+		if !ok {
+			return ErrSchema
+		}
+		if s.pattern, err = regexp.Compile(pattern); err != nil {
+			return ErrSchema
+		}
+	}
+	if v, ok := m["format"]; ok {
+		if s.format, ok = v.(string); !ok {
+			return ErrSchema
+		}
+	}
+
+	for key, dst := range map[string]**float64{
+		"minimum":          &s.minimum,
+		"maximum":          &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMinimum,
+		"exclusiveMaximum": &s.exclusiveMaximum,
+		"multipleOf":       &s.multipleOf,
+	} {
+		if *dst, err = schemaNumber(m, key); err != nil {
+			return err
+		}
+	}
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return ErrSchema
+	}
+
+	for key, dst := range map[string]*[]*schema{"allOf": &s.allOf, "anyOf": &s.anyOf, "oneOf": &s.oneOf} {
+		v, ok := m[key]
+		if !ok {
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return ErrSchema
+		}
+		if *dst, err = c.compileList(list); err != nil {
+			return err
+		}
+	}
+	for key, dst := range map[string]**schema{"not": &s.not, "if": &s.ifS, "then": &s.thenS, "else": &s.elseS} {
+		if *dst, err = c.optional(m, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *schemaCompiler) optional(m map[string]interface{}, key string) (*schema, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	return c.compile(v)
+}
+
+func (c *schemaCompiler) compileList(list []interface{}) ([]*schema, error) {
+	res := make([]*schema, len(list))
+	for i, v := range list {
+		s, err := c.compile(v)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = s
+	}
+	return res, nil
+}
+
+var schemaTypeNames = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true, "number": true, "string": true, "integer": true,
+}
+
+func schemaTypes(v interface{}) ([]string, error) {
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if !schemaTypeNames[t] {
+			return nil, ErrSchema
+		}
+		return []string{t}, nil
+	case []interface{}:
+		res, err := stringList(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range res {
+			if !schemaTypeNames[name] {
+				return nil, ErrSchema
+			}
+		}
+		return res, nil
+	default:
+		return nil, ErrSchema
+	}
+}
+
+func stringList(v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, ErrSchema
+	}
+	res := make([]string, len(list))
+	for i, elem := range list {
+		s, ok := elem.(string)
+		if !ok {
+			return nil, ErrSchema
+		}
+		res[i] = s
+	}
+	return res, nil
+}
+
+func schemaNumber(m map[string]interface{}, key string) (*float64, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := normalizeJSON(v).(float64)
+	if !ok {
+		return nil, ErrSchema
+	}
+	return &f, nil
+}
+
+func schemaInt(m map[string]interface{}, key string) (*int, error) {
+	f, err := schemaNumber(m, key)
+	if err != nil || f == nil {
+		return nil, err
+	}
+	if *f < 0 || *f != math.Trunc(*f) {
+		return nil, ErrSchema
+	}
+	i := int(*f)
+	return &i, nil
+}
+
+// normalizeJSON turns the numbers into float64, so the values decoded from any body format are
+// compared like the JSON ones
+func normalizeJSON(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, elem := range val {
+			res[k] = normalizeJSON(elem)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, elem := range val {
+			res[i] = normalizeJSON(elem)
+		}
+		return res
+	case int:
+		return float64(val)
+	case int64:
+		return float64(val)
+	case uint64:
+		return float64(val)
+	case float32:
+		return float64(val)
+	case json.Number:
+		f, _ := val.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// validate returns the failures of the value, up to limit, prefixed with the JSON pointer of the
+// failing value
+func (s *schema) validate(v interface{}, path string, limit int) []string {
+	var errs []string
+	s.check(v, path, limit, &errs)
+	return errs
+}
+
+func (s *schema) check(v interface{}, path string, limit int, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		if len(*errs) < limit {
+			p := path
+			if p == "" {
+				p = "/"
+			}
+			*errs = append(*errs, p+": "+fmt.Sprintf(format, args...))
+		}
+	}
+	if len(*errs) >= limit {
+		return
+	}
+	if s.ref != nil {
+		s.ref.check(v, path, limit, errs)
+		return
+	}
+	if s.always != nil {
+		if !*s.always {
+			fail("not allowed")
+		}
+		return
+	}
+
+	t := jsonType(v)
+	if len(s.types) > 0 {
+		matched := false
+		for _, expected := range s.types {
+			if expected == t || (expected == "number" && t == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("expected %s, got %s", strings.Join(s.types, " or "), t)
+			return
+		}
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value not in enum")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constVal, v) {
+		fail("value does not match const")
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		s.checkObject(val, path, limit, errs, fail)
+	case []interface{}:
+		s.checkArray(val, path, limit, errs, fail)
+	case string:
+		s.checkString(val, fail)
+	case float64:
+		s.checkNumber(val, fail)
+	}
+
+	for _, sub := range s.allOf {
+		sub.check(v, path, limit, errs)
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if len(sub.validate(v, path, 1)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("no schema of anyOf matched")
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if len(sub.validate(v, path, 1)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("%d schemas of oneOf matched, expected 1", matched)
+		}
+	}
+	if s.not != nil && len(s.not.validate(v, path, 1)) == 0 {
+		fail("value matches the not schema")
+	}
+	if s.ifS != nil {
+		if len(s.ifS.validate(v, path, 1)) == 0 {
+			if s.thenS != nil {
+				s.thenS.check(v, path, limit, errs)
+			}
+		} else if s.elseS != nil {
+			s.elseS.check(v, path, limit, errs)
+		}
+	}
+}
+
+func (s *schema) checkObject(m map[string]interface{}, path string, limit int, errs *[]string, fail func(string, ...interface{})) {
+	if s.minProperties != nil && len(m) < *s.minProperties {
+		fail("expected at least %d properties", *s.minProperties)
+	}
+	if s.maxProperties != nil && len(m) > *s.maxProperties {
+		fail("expected at most %d properties", *s.maxProperties)
+	}
+	for _, name := range s.required {
+		if _, ok := m[name]; !ok {
+			fail("missing property %s", name)
+		}
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := path + "/" + strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+		if s.propertyNames != nil && len(s.propertyNames.validate(name, child, 1)) > 0 {
+			fail("invalid property name %s", name)
+		}
+		matched := false
+		if p, ok := s.properties[name]; ok {
+			matched = true
+			p.check(m[name], child, limit, errs)
+		}
+		for _, pp := range s.patternProperties {
+			if pp.re.MatchString(name) {
+				matched = true
+				pp.schema.check(m[name], child, limit, errs)
+			}
+		}
+		if !matched && s.additionalProperties != nil {
+			if s.additionalProperties.always != nil && !*s.additionalProperties.always {
+				fail("unexpected property %s", name)
+				continue
+			}
+			s.additionalProperties.check(m[name], child, limit, errs)
+		}
+		if d, ok := s.dependencies[name]; ok {
+			for _, required := range d.required {
+				if _, ok := m[required]; !ok {
+					fail("property %s requires %s", name, required)
+				}
+			}
+			if d.schema != nil {
+				d.schema.check(m, path, limit, errs)
+			}
+		}
+	}
+}
+
+func (s *schema) checkArray(list []interface{}, path string, limit int, errs *[]string, fail func(string, ...interface{})) {
+	if s.minItems != nil && len(list) < *s.minItems {
+		fail("expected at least %d items", *s.minItems)
+	}
+	if s.maxItems != nil && len(list) > *s.maxItems {
+		fail("expected at most %d items", *s.maxItems)
+	}
+	if s.uniqueItems {
+	unique:
+		for i := range list {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(list[i], list[j]) {
+					fail("duplicated items")
+					break unique
+				}
+			}
+		}
+	}
+	for i, elem := range list {
+		child := path + "/" + strconv.Itoa(i)
+		switch {
+		case s.items != nil:
+			s.items.check(elem, child, limit, errs)
+		case s.itemsList != nil && i < len(s.itemsList):
+			s.itemsList[i].check(elem, child, limit, errs)
+		case s.itemsList != nil && s.additionalItems != nil:
+			s.additionalItems.check(elem, child, limit, errs)
+		}
+	}
+	if s.contains != nil {
+		found := false
+		for _, elem := range list {
+			if len(s.contains.validate(elem, path, 1)) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("no item matches the contains schema")
+		}
+	}
+}
+
+func (s *schema) checkString(str string, fail func(string, ...interface{})) {
+	length := utf8.RuneCountInString(str)
+	if s.minLength != nil && length < *s.minLength {
+		fail("expected at least %d characters", *s.minLength)
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		fail("expected at most %d characters", *s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		fail("does not match the pattern %s", s.pattern.String())
+	}
+	if s.format != "" && !validFormat(s.format, str) {
+		fail("invalid %s", s.format)
+	}
+}
+
+func (s *schema) checkNumber(f float64, fail func(string, ...interface{})) {
+	if s.minimum != nil && f < *s.minimum {
+		fail("expected a minimum of %v", *s.minimum)
+	}
+	if s.maximum != nil && f > *s.maximum {
+		fail("expected a maximum of %v", *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+		fail("expected more than %v", *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+		fail("expected less than %v", *s.exclusiveMaximum)
+	}
+	if s.multipleOf != nil {
+		q := f / *s.multipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("expected a multiple of %v", *s.multipleOf)
+		}
+	}
+}
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+$`)
+
+// validFormat checks the formats of draft-07 with a validator here. The rest are accepted
+func validFormat(format, s string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "email":
+		return emailPattern.MatchString(s)
+	case "ipv4":
+		ip := net.ParseIP(s)
+		return ip != nil && ip.To4() != nil && !strings.Contains(s, ":")
+	case "ipv6":
+		return net.ParseIP(s) != nil && strings.Contains(s, ":")
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && u.IsAbs()
+	case "regex":
+		_, err := regexp.Compile(s)
+		return err == nil
+	default:
+		return true
+	}
+}
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestNewSchemas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	valid := filepath.Join(dir, "valid.json")
+	if err := ioutil.WriteFile(valid, []byte(`{"type": "object"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte(`{"type": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		schemas map[string]interface{}
+		err     error
+	}{
+		{name: "none"},
+		{name: "inline", schemas: map[string]interface{}{"order": map[string]interface{}{"type": "object"}, "any": true}},
+		{name: "file", schemas: map[string]interface{}{"order": valid}},
+		{name: "empty name", schemas: map[string]interface{}{"": true}, err: ErrSchemaName},
+		{name: "invalid file", schemas: map[string]interface{}{"order": invalid}, err: ErrSchema},
+		{name: "invalid type", schemas: map[string]interface{}{"order": map[string]interface{}{"type": "date"}}, err: ErrSchema},
+		{name: "invalid pattern", schemas: map[string]interface{}{"order": map[string]interface{}{"pattern": "("}}, err: ErrSchema},
+		{name: "remote ref", schemas: map[string]interface{}{"order": map[string]interface{}{"$ref": "http://example.com/order.json"}}, err: ErrSchema},
+		{name: "missing ref", schemas: map[string]interface{}{"order": map[string]interface{}{"$ref": "#/definitions/item"}}, err: ErrSchema},
+		{name: "invalid number", schemas: map[string]interface{}{"order": map[string]interface{}{"minLength": -1.0}}, err: ErrSchema},
+		{name: "self ref", schemas: map[string]interface{}{"order": map[string]interface{}{"$ref": "#"}}, err: ErrSchema},
+		{name: "mutual refs", schemas: map[string]interface{}{"order": map[string]interface{}{
+			"$ref": "#/definitions/a",
+			"definitions": map[string]interface{}{
+				"a": map[string]interface{}{"$ref": "#/definitions/b"},
+				"b": map[string]interface{}{"$ref": "#/definitions/a"},
+			},
+		}}, err: ErrSchema},
+		{name: "self allOf", schemas: map[string]interface{}{"order": map[string]interface{}{"type": "object", "allOf": []interface{}{map[string]interface{}{"$ref": "#"}}}}, err: ErrSchema},
+		{name: "recursive properties", schemas: map[string]interface{}{"order": map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"parent": map[string]interface{}{"$ref": "#"}},
+		}}},
+	} {
+		if _, err := NewSchemas(tc.schemas); err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+	if _, err := NewSchemas(map[string]interface{}{"order": filepath.Join(dir, "unknown.json")}); err == nil {
+		t.Error("expecting error for a missing file")
+	}
+}
+
+func TestSchema_validate(t *testing.T) {
+	order := `{
+		"definitions": {
+			"item": {
+				"type": "object",
+				"required": ["sku", "quantity"],
+				"properties": {
+					"sku": {"type": "string", "pattern": "^[A-Z]{3}-[0-9]+$"},
+					"quantity": {"type": "integer", "minimum": 1, "maximum": 100}
+				},
+				"additionalProperties": false
+			}
+		},
+		"type": "object",
+		"required": ["id", "items"],
+		"properties": {
+			"id": {"type": "string", "format": "uuid", "minLength": 3},
+			"email": {"type": "string", "format": "email"},
+			"created": {"type": "string", "format": "date-time"},
+			"status": {"enum": ["draft", "placed"]},
+			"version": {"const": 2},
+			"total": {"type": "number", "exclusiveMinimum": 0, "multipleOf": 0.01},
+			"items": {"type": "array", "minItems": 1, "items": {"$ref": "#/definitions/item"}, "uniqueItems": true},
+			"tags": {"type": "array", "items": [{"type": "string"}], "additionalItems": false},
+			"coupon": {"anyOf": [{"type": "null"}, {"type": "string", "maxLength": 8}]},
+			"payment": {
+				"type": "object",
+				"oneOf": [{"required": ["card"]}, {"required": ["iban"]}],
+				"if": {"required": ["card"]},
+				"then": {"properties": {"card": {"type": "string", "minLength": 16}}}
+			},
+			"children": {"type": "array", "items": {"$ref": "#"}}
+		},
+		"patternProperties": {"^x-": {"type": "string"}},
+		"dependencies": {"coupon": ["total"]},
+		"propertyNames": {"not": {"const": "forbidden"}}
+	}`
+	var doc interface{}
+	if err := json.Unmarshal([]byte(order), &doc); err != nil {
+		t.Fatal(err)
+	}
+	s, err := compileSchema(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{name: "valid", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 2}], "total": 10.5, "coupon": null, "x-source": "web"}`},
+		{name: "not an object", value: `[]`, expected: []string{"/: expected object, got array"}},
+		{name: "missing property", value: `{"id": "abc"}`, expected: []string{"/: missing property items"}},
+		{
+			name:  "invalid items",
+			value: `{"id": "abc", "items": [{"sku": "abc", "quantity": 1.5, "price": 1}]}`,
+			expected: []string{
+				"/items/0: unexpected property price",
+				"/items/0/quantity: expected integer, got number",
+				"/items/0/sku: does not match the pattern ^[A-Z]{3}-[0-9]+$",
+			},
+		},
+		{name: "min items", value: `{"id": "abc", "items": []}`, expected: []string{"/items: expected at least 1 items"}},
+		{
+			name:     "unique items",
+			value:    `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 2}, {"sku": "ABC-1", "quantity": 2.0}]}`,
+			expected: []string{"/items: duplicated items"},
+		},
+		{name: "enum and const", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "status": "sent", "version": 2.0}`, expected: []string{"/status: value not in enum"}},
+		{name: "numbers", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 101}], "total": 1.005}`, expected: []string{"/items/0/quantity: expected a maximum of 100", "/total: expected a multiple of 0.01"}},
+		{name: "formats", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "email": "nobody", "created": "yesterday"}`, expected: []string{"/created: invalid date-time", "/email: invalid email"}},
+		{name: "additional items", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "tags": ["a", "b"]}`, expected: []string{"/tags/1: not allowed"}},
+		{name: "any of", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "coupon": "TOO-LONG-CODE", "total": 1}`, expected: []string{"/coupon: no schema of anyOf matched"}},
+		{name: "dependencies", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "coupon": "SALE"}`, expected: []string{"/: property coupon requires total"}},
+		{name: "one of", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "payment": {"card": "4111111111111111", "iban": "ES00"}}`, expected: []string{"/payment: 2 schemas of oneOf matched, expected 1"}},
+		{name: "if then", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "payment": {"card": "4111"}}`, expected: []string{"/payment/card: expected at least 16 characters"}},
+		{name: "pattern properties", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "x-source": 1}`, expected: []string{"/x-source: expected string, got integer"}},
+		{name: "property names", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "forbidden": 1}`, expected: []string{"/: invalid property name forbidden"}},
+		{name: "recursive", value: `{"id": "abc", "items": [{"sku": "ABC-1", "quantity": 1}], "children": [{"id": "a"}]}`, expected: []string{"/children/0/id: expected at least 3 characters", "/children/0: missing property items"}},
+	} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tc.value), &v); err != nil {
+			t.Fatal(err)
+		}
+		errs := s.validate(normalizeJSON(v), "", maxSchemaErrors)
+		if !sameStrings(errs, tc.expected) {
+			t.Errorf("%s: unexpected errors: %q", tc.name, errs)
+		}
+	}
+
+	items := make([]interface{}, 20)
+	for i := range items {
+		items[i] = map[string]interface{}{}
+	}
+	if errs := s.validate(map[string]interface{}{"id": "abc", "items": items}, "", maxSchemaErrors); len(errs) != maxSchemaErrors {
+		t.Errorf("unexpected number of errors: %d", len(errs))
+	}
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	count := map[string]int{}
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		count[s]--
+	}
+	for _, c := range count {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParser_matchesSchema(t *testing.T) {
+	schemas, err := NewSchemas(map[string]interface{}{
+		"user": map[string]interface{}{
+			"type":       "object",
+			"required":   []interface{}{"name"},
+			"properties": map[string]interface{}{"name": map[string]interface{}{"type": "string"}, "age": map[string]interface{}{"type": "integer"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewCheckExpressionParser(logging.NoOp).WithSchemas(schemas)
+
+	for _, tc := range []struct {
+		expr     string
+		body     map[string]interface{}
+		expected interface{}
+	}{
+		{expr: "matchesSchema(req_body, 'user')", body: map[string]interface{}{"name": "alice", "age": 30.0}, expected: true},
+		{expr: "matchesSchema(req_body, 'user')", body: map[string]interface{}{"age": 30.5}, expected: false},
+		{expr: "matchesSchema(req_body.name, 'user')", body: map[string]interface{}{"name": "alice"}, expected: false},
+		{expr: "schemaErrors(req_body, 'user') == []", body: map[string]interface{}{"name": "alice"}, expected: true},
+		{expr: "schemaErrors(req_body, 'user')", body: map[string]interface{}{"name": 1.0}, expected: []string{"/name: expected string, got integer"}},
+	} {
+		prg, err := p.Parse(InterpretableDefinition{CheckExpression: tc.expr})
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err.Error())
+			continue
+		}
+		res, _, err := prg.Eval(map[string]interface{}{"req_body": tc.body})
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err.Error())
+			continue
+		}
+		v := res.Value()
+		if list, ok := NativeValue(res).([]interface{}); ok {
+			strs := make([]string, len(list))
+			for i, s := range list {
+				strs[i], _ = s.(string)
+			}
+			v = strs
+		}
+		if !reflect.DeepEqual(v, tc.expected) {
+			t.Errorf("%s: unexpected result %v", tc.expr, v)
+		}
+	}
+
+	if _, err := p.Parse(InterpretableDefinition{CheckExpression: "matchesSchema(req_body, 'users')"}); err != ErrNoSchema {
+		t.Errorf("unexpected error for an undeclared schema: %v", err)
+	}
+	prg, err := p.Parse(InterpretableDefinition{CheckExpression: "matchesSchema(req_body, 'us' + 'ers')"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := prg.Eval(map[string]interface{}{"req_body": map[string]interface{}{}}); err == nil {
+		t.Error("expecting error for an undeclared schema")
+	}
+}
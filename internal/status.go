@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// statusClass returns the function checking if the status code belongs to the range [min, max]
+func statusClass(function string, min, max types.Int) func(ref.Val) ref.Val {
+	return func(val ref.Val) ref.Val {
+		code, ok := val.(types.Int)
+		if !ok {
+			return types.NewErr("%s: unexpected status type %s", function, val.Type().TypeName())
+		}
+		return types.Bool(code >= min && code <= max)
+	}
+}
+
+var (
+	// isSuccess checks for the 2xx status codes
+	isSuccess = statusClass("isSuccess", 200, 299)
+	// isClientError checks for the 4xx status codes
+	isClientError = statusClass("isClientError", 400, 499)
+	// isServerError checks for the 5xx status codes
+	isServerError = statusClass("isServerError", 500, 599)
+)
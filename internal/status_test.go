@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStatusClasses(t *testing.T) {
+	for _, tc := range []struct {
+		code                              int
+		success, clientError, serverError bool
+	}{
+		{code: 0},
+		{code: 199},
+		{code: 200, success: true},
+		{code: 204, success: true},
+		{code: 299, success: true},
+		{code: 300},
+		{code: 399},
+		{code: 400, clientError: true},
+		{code: 499, clientError: true},
+		{code: 500, serverError: true},
+		{code: 599, serverError: true},
+		{code: 600},
+	} {
+		for expr, expected := range map[string]bool{
+			fmt.Sprintf("isSuccess(%d)", tc.code):     tc.success,
+			fmt.Sprintf("isClientError(%d)", tc.code): tc.clientError,
+			fmt.Sprintf("isServerError(%d)", tc.code): tc.serverError,
+		} {
+			res, err := evalExpr(expr)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", expr, err.Error())
+				continue
+			}
+			if res != expected {
+				t.Errorf("%s: unexpected result %v", expr, res)
+			}
+		}
+	}
+}
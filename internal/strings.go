@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// lowerASCII converts the ASCII upper case letters of the string, leaving the rest untouched
+func lowerASCII(val ref.Val) ref.Val {
+	s, ok := val.(types.String)
+	if !ok {
+		return types.NewErr("lowerAscii: unexpected string type %s", val.Type().TypeName())
+	}
+	return types.String(mapASCII(string(s), 'A', 'Z', 'a'-'A'))
+}
+
+// upperASCII converts the ASCII lower case letters of the string, leaving the rest untouched
+func upperASCII(val ref.Val) ref.Val {
+	s, ok := val.(types.String)
+	if !ok {
+		return types.NewErr("upperAscii: unexpected string type %s", val.Type().TypeName())
+	}
+	return types.String(mapASCII(string(s), 'a', 'z', 'A'-'a'))
+}
+
+func mapASCII(s string, from, to, delta rune) string {
+	return strings.Map(func(r rune) rune {
+		if r >= from && r <= to {
+			return r + delta
+		}
+		return r
+	}, s)
+}
+
+// trim removes the leading and trailing white space of the string, as defined by Unicode
+func trim(val ref.Val) ref.Val {
+	s, ok := val.(types.String)
+	if !ok {
+		return types.NewErr("trim: unexpected string type %s", val.Type().TypeName())
+	}
+	return types.String(strings.TrimSpace(string(s)))
+}
@@ -0,0 +1,30 @@
+package internal
+
+import "testing"
+
+func TestStringFunctions(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "lowerAscii('Hello World')", expected: "hello world"},
+		{expr: "'Hello World'.lowerAscii()", expected: "hello world"},
+		{expr: "lowerAscii('ÀÉÎ ABC')", expected: "ÀÉÎ abc"},
+		{expr: "upperAscii('Hello World')", expected: "HELLO WORLD"},
+		{expr: "'hello world'.upperAscii()", expected: "HELLO WORLD"},
+		{expr: "upperAscii('àéî abc')", expected: "àéî ABC"},
+		{expr: "trim('  hello \\t\\n')", expected: "hello"},
+		{expr: "' hello '.trim()", expected: "hello"},
+		{expr: "trim('')", expected: ""},
+		{expr: "'Admin '.trim().lowerAscii() == 'admin'", expected: true},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// parseTime returns the timestamp represented by the string. Without a layout, the string must be
+// either a RFC 3339 date or any of the formats accepted by HTTP/1.1, like the one of the Date
+// header. The optional layout follows the format of the Go time package
+func parseTime(vals ...ref.Val) ref.Val {
+	if len(vals) == 0 || len(vals) > 2 {
+		return types.NewErr("parseTime: unexpected number of arguments %d", len(vals))
+	}
+	s, ok := vals[0].(types.String)
+	if !ok {
+		return types.NewErr("parseTime: unexpected string type %s", vals[0].Type().TypeName())
+	}
+
+	var t time.Time
+	var err error
+	if len(vals) == 2 {
+		layout, ok := vals[1].(types.String)
+		if !ok {
+			return types.NewErr("parseTime: unexpected layout type %s", vals[1].Type().TypeName())
+		}
+		t, err = time.Parse(string(layout), string(s))
+	} else if t, err = time.Parse(time.RFC3339, string(s)); err != nil {
+		t, err = http.ParseTime(string(s))
+	}
+	if err != nil {
+		return types.NewErr("parseTime: invalid time '%s'", s)
+	}
+
+	ts, err := ptypes.TimestampProto(t.UTC())
+	if err != nil {
+		return types.NewErr("parseTime: %s", err.Error())
+	}
+	return types.Timestamp{Timestamp: ts}
+}
+
+// durationSeconds returns the whole seconds elapsed from the start (lhs) to the end (rhs), negative
+// when the end is before the start
+func durationSeconds(lhs, rhs ref.Val) ref.Val {
+	start, ok := lhs.(types.Timestamp)
+	if !ok {
+		return types.NewErr("durationSeconds: unexpected start type %s", lhs.Type().TypeName())
+	}
+	end, ok := rhs.(types.Timestamp)
+	if !ok {
+		return types.NewErr("durationSeconds: unexpected end type %s", rhs.Type().TypeName())
+	}
+	s, err := ptypes.Timestamp(start.Timestamp)
+	if err != nil {
+		return types.NewErr("durationSeconds: %s", err.Error())
+	}
+	e, err := ptypes.Timestamp(end.Timestamp)
+	if err != nil {
+		return types.NewErr("durationSeconds: %s", err.Error())
+	}
+	return types.Int(e.Sub(s) / time.Second)
+}
@@ -0,0 +1,42 @@
+package internal
+
+import "testing"
+
+func TestParseTime(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "parseTime('2019-01-02T03:04:05Z') == timestamp('2019-01-02T03:04:05Z')", expected: true},
+		{expr: "parseTime('2019-01-02T05:04:05.5+02:00') == timestamp('2019-01-02T03:04:05.5Z')", expected: true},
+		{expr: "parseTime('Wed, 02 Jan 2019 03:04:05 GMT') == timestamp('2019-01-02T03:04:05Z')", expected: true},
+		{expr: "parseTime('Wednesday, 02-Jan-19 03:04:05 GMT') == timestamp('2019-01-02T03:04:05Z')", expected: true},
+		{expr: "parseTime('2019-01-02', '2006-01-02') == timestamp('2019-01-02T00:00:00Z')", expected: true},
+		{expr: "parseTime('02/01/2019 03:04', '02/01/2006 15:04').getHours()", expected: int64(3)},
+		{expr: "durationSeconds(timestamp('2019-01-02T03:04:05Z'), timestamp('2019-01-02T03:09:05.9Z'))", expected: int64(300)},
+		{expr: "durationSeconds(timestamp('2019-01-02T03:09:05Z'), timestamp('2019-01-02T03:04:05Z'))", expected: int64(-300)},
+		{expr: "timestamp('2019-01-02T03:09:05Z') - parseTime('Wed, 02 Jan 2019 03:04:05 GMT') < duration('10m')", expected: true},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestParseTime_errors(t *testing.T) {
+	for _, expr := range []string{
+		"parseTime('yesterday')",
+		"parseTime('')",
+		"parseTime('2019-01-02', '2006/01/02')",
+		"parseTime('2019-13-02T03:04:05Z')",
+	} {
+		if _, err := evalExpr(expr); err == nil {
+			t.Errorf("%s: expecting error", expr)
+		}
+	}
+}
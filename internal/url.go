@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"net/url"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// urlParse decomposes the URL into a map with its scheme, host (without port), port, path and
+// query, where every query parameter keeps the list of all its values
+func urlParse(val ref.Val) ref.Val {
+	s, ok := val.(types.String)
+	if !ok {
+		return types.NewErr("urlParse: unexpected string type %s", val.Type().TypeName())
+	}
+	u, err := url.Parse(string(s))
+	if err != nil {
+		return types.NewErr("urlParse: %s", err.Error())
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return types.NewErr("urlParse: %s", err.Error())
+	}
+
+	// the maps and lists must be generic, since the CEL adapters of the typed ones do not support
+	// the 'in' operator
+	q := make(map[string]interface{}, len(query))
+	for k, vs := range query {
+		values := make([]interface{}, len(vs))
+		for i, v := range vs {
+			values[i] = v
+		}
+		q[k] = values
+	}
+	return types.DefaultTypeAdapter.NativeToValue(map[string]interface{}{
+		"scheme": u.Scheme,
+		"host":   u.Hostname(),
+		"port":   u.Port(),
+		"path":   u.Path,
+		"query":  q,
+	})
+}
@@ -0,0 +1,45 @@
+package internal
+
+import "testing"
+
+func TestURLParse(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "urlParse('https://example.com/callback?code=1').scheme", expected: "https"},
+		{expr: "urlParse('https://example.com/callback?code=1').host", expected: "example.com"},
+		{expr: "urlParse('https://Example.com:8443/callback').host", expected: "Example.com"},
+		{expr: "urlParse('https://example.com:8443/callback').port", expected: "8443"},
+		{expr: "urlParse('https://example.com/callback').port", expected: ""},
+		{expr: "urlParse('https://example.com/a%20b/c').path", expected: "/a b/c"},
+		{expr: "urlParse('/relative/path').host", expected: ""},
+		{expr: "urlParse('//evil.com/path').host in ['example.com']", expected: false},
+		{expr: "urlParse('https://example.com/?role=a&role=b').query.role == ['a', 'b']", expected: true},
+		{expr: "'code' in urlParse('https://example.com/?code=1').query", expected: true},
+		{expr: "'state' in urlParse('https://example.com/?code=1').query", expected: false},
+		{expr: "'b' in urlParse('https://example.com/?role=a&role=b').query.role", expected: true},
+	} {
+		res, err := evalExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.expr, err.Error())
+			continue
+		}
+		if res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.expr, res)
+		}
+	}
+}
+
+func TestURLParse_errors(t *testing.T) {
+	for _, expr := range []string{
+		"urlParse('http://[::1').host == ''",
+		"urlParse(':no-scheme').host == ''",
+		"urlParse('https://example.com/?a=%zz').host == ''",
+		"urlParse('http://exa mple.com').host == ''",
+	} {
+		if _, err := evalExpr(expr); err == nil {
+			t.Errorf("%s: expecting error", expr)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/cel-go/checker/decls"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+var (
+	ErrVarName = errors.New("cel: invalid var name")
+	ErrVarType = errors.New("cel: invalid var type, only strings, numbers, bools and lists of them are supported")
+)
+
+var varName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedNames can not be used as var names, since they are either CEL keywords or identifiers
+// already declared by the module
+var reservedNames = map[string]bool{
+	"true": true, "false": true, "null": true, "in": true, "as": true, "break": true,
+	"const": true, "continue": true, "else": true, "for": true, "function": true, "if": true,
+	"import": true, "let": true, "loop": true, "package": true, "namespace": true,
+	"return": true, "var": true, "void": true, "while": true,
+	JwtKey: true, NowKey: true, NowUnixKey: true, EndpointKey: true, StoreKey: true,
+}
+
+// Vars are the constants declared in the config, available to all the expressions of the pipe
+// as plain identifiers
+type Vars struct {
+	decls  []*exprpb.Decl
+	values map[string]interface{}
+	key    string
+}
+
+// NewVars validates the vars and returns their declarations and values. The JSON numbers without
+// decimals are exposed as ints and the rest as doubles
+func NewVars(vars map[string]interface{}) (Vars, error) {
+	res := Vars{values: make(map[string]interface{}, len(vars))}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		if !varName.MatchString(name) || reservedNames[name] ||
+			strings.HasPrefix(name, PreKey+"_") || strings.HasPrefix(name, PostKey+"_") {
+			return Vars{}, ErrVarName
+		}
+		v, t, ok := varValue(vars[name])
+		if !ok {
+			return Vars{}, ErrVarType
+		}
+		res.decls = append(res.decls, decls.NewIdent(name, t, nil))
+		res.values[name] = v
+		keys = append(keys, name+":"+t.String())
+	}
+	res.key = strings.Join(keys, ",")
+	return res, nil
+}
+
+// Values returns the values of the vars, to be added to the activations
+func (v Vars) Values() map[string]interface{} {
+	return v.values
+}
+
+func varValue(v interface{}) (interface{}, *exprpb.Type, bool) {
+	switch val := v.(type) {
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		var elemType *exprpb.Type
+		for i, elem := range val {
+			e, t, ok := scalarValue(elem)
+			if !ok {
+				return nil, nil, false
+			}
+			if elemType == nil {
+				elemType = t
+			} else if !proto.Equal(elemType, t) {
+				elemType = decls.Dyn
+			}
+			res[i] = e
+		}
+		if elemType == nil {
+			elemType = decls.Dyn
+		}
+		return res, decls.NewListType(elemType), true
+	default:
+		return scalarValue(v)
+	}
+}
+
+func scalarValue(v interface{}) (interface{}, *exprpb.Type, bool) {
+	switch val := v.(type) {
+	case string:
+		return val, decls.String, true
+	case bool:
+		return val, decls.Bool, true
+	case int:
+		return int64(val), decls.Int, true
+	case int64:
+		return val, decls.Int, true
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) < 1<<53 {
+			return int64(val), decls.Int, true
+		}
+		return val, decls.Double, true
+	default:
+		return nil, nil, false
+	}
+}
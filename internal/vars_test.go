@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestNewVars(t *testing.T) {
+	vars, err := NewVars(map[string]interface{}{
+		"tenant":          "acme",
+		"allowed_tenants": []interface{}{"acme", "globex"},
+		"max_size":        float64(1024),
+		"ratio":           0.5,
+		"enabled":         true,
+		"mixed":           []interface{}{"a", float64(1)},
+		"empty":           []interface{}{},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	p := NewCheckExpressionParser(logging.NoOp).WithVars(vars)
+	for _, expr := range []string{
+		"req_params.Tenant == tenant",
+		"req_params.Tenant in allowed_tenants",
+		"size(req_params.Tenant) < max_size",
+		"ratio < 1.0",
+		"enabled && size(empty) == 0",
+		"'a' in mixed && 1 in mixed",
+	} {
+		pre, err := p.ParsePre([]InterpretableDefinition{{CheckExpression: expr, Type: PhasePre}})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", expr, err.Error())
+			continue
+		}
+		activation := map[string]interface{}{"req_params": map[string]string{"Tenant": "acme"}}
+		for k, v := range vars.Values() {
+			activation[k] = v
+		}
+		res, _, err := pre[0].Eval(activation)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", expr, err.Error())
+			continue
+		}
+		if res.Value() != true {
+			t.Errorf("%s: unexpected result %v", expr, res)
+		}
+	}
+
+	// the same expression checked without the vars is an error
+	if _, err := NewCheckExpressionParser(logging.NoOp).ParsePre([]InterpretableDefinition{{CheckExpression: "req_params.Tenant == tenant"}}); err != ErrChecking {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewVars_errors(t *testing.T) {
+	for _, tc := range []struct {
+		vars map[string]interface{}
+		err  error
+	}{
+		{vars: map[string]interface{}{"req_tenant": "acme"}, err: ErrVarName},
+		{vars: map[string]interface{}{"resp_limit": float64(1)}, err: ErrVarName},
+		{vars: map[string]interface{}{"now": "acme"}, err: ErrVarName},
+		{vars: map[string]interface{}{"in": "acme"}, err: ErrVarName},
+		{vars: map[string]interface{}{"1tenant": "acme"}, err: ErrVarName},
+		{vars: map[string]interface{}{"the-tenant": "acme"}, err: ErrVarName},
+		{vars: map[string]interface{}{"tenant": nil}, err: ErrVarType},
+		{vars: map[string]interface{}{"tenant": map[string]interface{}{"a": "b"}}, err: ErrVarType},
+		{vars: map[string]interface{}{"tenants": []interface{}{[]interface{}{"a"}}}, err: ErrVarType},
+	} {
+		if _, err := NewVars(tc.vars); err != tc.err {
+			t.Errorf("%v: unexpected error: %v", tc.vars, err)
+		}
+	}
+}
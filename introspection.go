@@ -0,0 +1,45 @@
+package cel
+
+import (
+	"sort"
+	"sync"
+)
+
+// PipeSummary counts the evaluators compiled from the definitions of a pipe, so the operators can
+// confirm how many rules are active for each endpoint and backend
+type PipeSummary struct {
+	// Name is the name of the pipe, as reported to the metrics (i.e. "proxy /foo" or "backend /bar")
+	Name                string `json:"name"`
+	PreEvaluators       int    `json:"pre_evaluators"`
+	PostEvaluators      int    `json:"post_evaluators"`
+	HeaderMutations     int    `json:"header_mutations"`
+	DataMutations       int    `json:"data_mutations"`
+	RespHeaderMutations int    `json:"resp_header_mutations"`
+	RespStatusMutations int    `json:"resp_status_mutations"`
+	StoreMutations      int    `json:"store_mutations"`
+}
+
+// Summaries returns the summaries of the pipes with CEL definitions loaded, sorted by name. The
+// reloadable proxies report their current definitions. The pipes sharing a name, like the backends
+// with the same url pattern in several endpoints, report the last one loaded
+func Summaries() []PipeSummary {
+	summariesMu.RLock()
+	res := make([]PipeSummary, 0, len(summaries))
+	for _, s := range summaries {
+		res = append(res, s)
+	}
+	summariesMu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func registerSummary(s PipeSummary) {
+	summariesMu.Lock()
+	summaries[s.Name] = s
+	summariesMu.Unlock()
+}
+
+var (
+	summariesMu sync.RWMutex
+	summaries   = map[string]PipeSummary{}
+)
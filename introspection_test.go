@@ -0,0 +1,82 @@
+package cel
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestSummaries(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("INFO", buff, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProxyFactory(logger, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(&config.EndpointConfig{
+		Endpoint: "/summaries",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+			{CheckExpression: "req_method == 'GET'"},
+			{CheckExpression: "'X-Tenant' in req_headers"},
+			{CheckExpression: "resp_completed"},
+			{ModExpression: "req_method", Header: "X-Method"},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := PipeSummary{Name: "proxy /summaries", PreEvaluators: 2, PostEvaluators: 1, HeaderMutations: 1}
+	if s, ok := findSummary(expected.Name); !ok || s != expected {
+		t.Errorf("unexpected summary: %+v", s)
+	}
+	if logs := buff.String(); !strings.Contains(logs, `INFO: CEL: definitions loaded endpoint="proxy /summaries" pre_evaluators=2 post_evaluators=1 header_mutations=1`) {
+		t.Errorf("summary not logged: %s", logs)
+	}
+
+	next := func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{IsComplete: true}, nil
+	}
+	p, err := NewReloadableProxy(logging.NoOp, &config.EndpointConfig{
+		Endpoint: "/summaries/reloadable",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+			{CheckExpression: "req_method == 'GET'"},
+		}},
+	}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Summary(); s.PreEvaluators != 1 || s.PostEvaluators != 0 {
+		t.Errorf("unexpected summary: %+v", s)
+	}
+	if err := p.Reload([]InterpretableDefinition{{CheckExpression: "resp_completed"}, {CheckExpression: "resp_data.ok"}}); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Summary(); s.PreEvaluators != 0 || s.PostEvaluators != 2 {
+		t.Errorf("unexpected summary after the reload: %+v", s)
+	}
+	if s, ok := findSummary("proxy /summaries/reloadable"); !ok || s != p.Summary() {
+		t.Errorf("unexpected registered summary after the reload: %+v", s)
+	}
+
+	summaries := Summaries()
+	for i := 1; i < len(summaries); i++ {
+		if summaries[i-1].Name > summaries[i].Name {
+			t.Errorf("unsorted summaries: %+v", summaries)
+			break
+		}
+	}
+}
+
+func findSummary(name string) (PipeSummary, bool) {
+	for _, s := range Summaries() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return PipeSummary{}, false
+}
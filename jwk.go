@@ -0,0 +1,262 @@
+package cel
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKCacheTTL = 15 * time.Minute
+	jwkFetchTimeout    = 5 * time.Second
+	// minimum time between two fetches triggered by an unknown kid, so forged tokens can not be
+	// used to hammer the identity provider
+	jwkMinRefresh = 10 * time.Second
+)
+
+var (
+	errUnknownKey       = errors.New("unknown key")
+	errUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+type signingAlg struct {
+	hash crypto.Hash
+	kty  string
+}
+
+var signingAlgs = map[string]signingAlg{
+	"RS256": {hash: crypto.SHA256, kty: "RSA"},
+	"RS384": {hash: crypto.SHA384, kty: "RSA"},
+	"RS512": {hash: crypto.SHA512, kty: "RSA"},
+	"ES256": {hash: crypto.SHA256, kty: "EC"},
+	"ES384": {hash: crypto.SHA384, kty: "EC"},
+	"ES512": {hash: crypto.SHA512, kty: "EC"},
+}
+
+func newJWKVerifier(url, ttl string) (*jwkVerifier, error) {
+	cacheTTL := defaultJWKCacheTTL
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("parsing the jwk cache ttl: %s", err.Error())
+		}
+		cacheTTL = d
+	}
+	return &jwkVerifier{
+		url:        url,
+		ttl:        cacheTTL,
+		minRefresh: jwkMinRefresh,
+		client:     &http.Client{Timeout: jwkFetchTimeout},
+		keys:       map[string]crypto.PublicKey{},
+	}, nil
+}
+
+// jwkVerifier checks the signature of the JWTs with the keys published at a JWKS endpoint.
+// The keys are cached for the configured ttl and the set is fetched again as soon as a token
+// signed with an unknown kid is received, so key rotations are picked up without waiting for
+// the cache to expire. When the set can not be fetched, the cached keys are used until the
+// next fetch succeeds.
+type jwkVerifier struct {
+	url        string
+	ttl        time.Duration
+	minRefresh time.Duration
+	client     *http.Client
+
+	mu         sync.RWMutex
+	keys       map[string]crypto.PublicKey
+	expiration time.Time
+	lastFetch  time.Time
+}
+
+func (v *jwkVerifier) verify(header map[string]interface{}, parts []string) error {
+	alg, _ := header["alg"].(string)
+	sa, ok := signingAlgs[alg]
+	if !ok {
+		return errUnsupportedAlg
+	}
+	kid, _ := header["kid"].(string)
+
+	key, err := v.key(kid)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+
+	h := sa.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if sa.kty != "RSA" {
+			return errUnsupportedAlg
+		}
+		if err := rsa.VerifyPKCS1v15(k, sa.hash, digest, signature); err != nil {
+			return errInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		if sa.kty != "EC" {
+			return errUnsupportedAlg
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errInvalidSignature
+		}
+	default:
+		return errUnsupportedAlg
+	}
+	return nil
+}
+
+func (v *jwkVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.RLock()
+	k, ok := v.keys[kid]
+	expired := timeNow().After(v.expiration)
+	v.mu.RUnlock()
+
+	if ok && !expired {
+		return k, nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if k, ok = v.keys[kid]; ok && timeNow().Before(v.expiration) {
+		return k, nil
+	}
+	// the fetches are throttled after the expiration too, so an outage of the identity provider
+	// does not trigger a fetch per request. Meanwhile, the expired keys are still used
+	if timeNow().Sub(v.lastFetch) < v.minRefresh {
+		if ok {
+			return k, nil
+		}
+		return nil, errUnknownKey
+	}
+	if err := v.fetch(); err != nil {
+		if ok {
+			return k, nil
+		}
+		return nil, err
+	}
+	if k, ok = v.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, errUnknownKey
+}
+
+// fetch must be called with the write lock held
+func (v *jwkVerifier) fetch() error {
+	v.lastFetch = timeNow()
+
+	resp, err := v.client.Get(v.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code fetching the jwk set: %d", resp.StatusCode)
+	}
+
+	set := jwkSet{}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pk
+	}
+
+	v.keys = keys
+	v.expiration = v.lastFetch.Add(v.ttl)
+	return nil
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pk := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pk.X, pk.Y) {
+			return nil, errors.New("invalid ec key")
+		}
+		return pk, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
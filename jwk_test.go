@@ -0,0 +1,368 @@
+package cel
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestProxyFactory_jwkVerification(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	forgedKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	keys := &jwkServer{keys: []jwk{rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)}}
+	ts := httptest.NewServer(keys)
+	defer ts.Close()
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"jwk_url": ts.URL,
+				"definitions": []internal.InterpretableDefinition{
+					{CheckExpression: "req_jwt.sub == 'alice'"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	claims := map[string]interface{}{"sub": "alice"}
+
+	for _, tc := range []struct {
+		name    string
+		token   string
+		success bool
+	}{
+		{name: "rs256", token: signRS256(t, "rsa", rsaKey, claims), success: true},
+		{name: "es256", token: signES256(t, "ec", ecKey, claims), success: true},
+		{name: "forged", token: signRS256(t, "rsa", forgedKey, claims), success: false},
+		{name: "unknown kid", token: signRS256(t, "unknown", rsaKey, claims), success: false},
+		{name: "alg none", token: unsignedToken(map[string]interface{}{"alg": "none", "kid": "rsa"}, claims), success: false},
+		{name: "alg mismatch", token: signES256(t, "rsa", ecKey, claims), success: false},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "GET",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Authorization": {"Bearer " + tc.token}},
+		})
+		if tc.success {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+				continue
+			}
+			if resp != expectedResponse {
+				t.Errorf("%s: unexpected response %+v", tc.name, resp)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expecting error", tc.name)
+		}
+		if resp != nil {
+			t.Errorf("%s: unexpected response %+v", tc.name, resp)
+		}
+	}
+}
+
+func TestProxyFactory_jwtIssuers(t *testing.T) {
+	acmeKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	globexKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	legacyKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	acme := httptest.NewServer(&jwkServer{keys: []jwk{rsaJWK("acme", &acmeKey.PublicKey)}})
+	defer acme.Close()
+	globex := httptest.NewServer(&jwkServer{keys: []jwk{ecJWK("globex", &globexKey.PublicKey)}})
+	defer globex.Close()
+	legacy := httptest.NewServer(&jwkServer{keys: []jwk{rsaJWK("legacy", &legacyKey.PublicKey)}})
+	defer legacy.Close()
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"issuers": map[string]interface{}{
+					"https://acme.example.com/":   map[string]interface{}{"jwk_url": acme.URL, "audience": []string{"api"}},
+					"https://globex.example.com/": map[string]interface{}{"jwk_url": globex.URL},
+					"":                            map[string]interface{}{"jwk_url": legacy.URL},
+				},
+				"definitions": []internal.InterpretableDefinition{
+					{CheckExpression: "req_jwt.sub == 'alice'"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		name    string
+		token   string
+		success bool
+	}{
+		{name: "acme", token: signRS256(t, "acme", acmeKey, map[string]interface{}{"sub": "alice", "iss": "https://acme.example.com/", "aud": []string{"web", "api"}}), success: true},
+		{name: "acme audience", token: signRS256(t, "acme", acmeKey, map[string]interface{}{"sub": "alice", "iss": "https://acme.example.com/", "aud": "web"})},
+		{name: "acme without audience", token: signRS256(t, "acme", acmeKey, map[string]interface{}{"sub": "alice", "iss": "https://acme.example.com/"})},
+		{name: "globex", token: signES256(t, "globex", globexKey, map[string]interface{}{"sub": "alice", "iss": "https://globex.example.com/"}), success: true},
+		{name: "keys of another issuer", token: signRS256(t, "acme", acmeKey, map[string]interface{}{"sub": "alice", "iss": "https://globex.example.com/"})},
+		{name: "unknown issuer", token: signRS256(t, "acme", acmeKey, map[string]interface{}{"sub": "alice", "iss": "https://initech.example.com/", "aud": "api"})},
+		{name: "without issuer", token: signRS256(t, "legacy", legacyKey, map[string]interface{}{"sub": "alice"}), success: true},
+		{name: "without issuer, other keys", token: signRS256(t, "acme", acmeKey, map[string]interface{}{"sub": "alice"})},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "GET",
+			Path:    "/some-path",
+			Headers: map[string][]string{"Authorization": {"Bearer " + tc.token}},
+		})
+		if tc.success {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+				continue
+			}
+			if resp != expectedResponse {
+				t.Errorf("%s: unexpected response %+v", tc.name, resp)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expecting error", tc.name)
+		}
+	}
+
+	if _, err := newJWTParser(internal.Config{JWKURL: acme.URL, Issuers: map[string]internal.Issuer{"https://acme.example.com/": {}}}); err != errJWKAndIssuers {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := newJWTParser(internal.Config{Issuers: map[string]internal.Issuer{
+		"https://acme.example.com/":   {JWKURL: acme.URL},
+		"https://globex.example.com/": {Audience: []string{"api"}},
+	}}); err != errIssuerWithoutJWK {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestJWKVerifier_rotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	keys := &jwkServer{keys: []jwk{rsaJWK("old", &oldKey.PublicKey)}}
+	ts := httptest.NewServer(keys)
+	defer ts.Close()
+
+	v, err := newJWKVerifier(ts.URL, "1h")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	v.minRefresh = 0
+
+	claims := map[string]interface{}{"sub": "alice"}
+
+	if err := verifyToken(v, signRS256(t, "old", oldKey, claims)); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	keys.set([]jwk{rsaJWK("new", &newKey.PublicKey)})
+
+	if err := verifyToken(v, signRS256(t, "new", newKey, claims)); err != nil {
+		t.Errorf("unexpected error after the rotation: %s", err.Error())
+	}
+	if err := verifyToken(v, signRS256(t, "old", oldKey, claims)); err != errUnknownKey {
+		t.Errorf("unexpected error with the rotated key: %v", err)
+	}
+	if hits := keys.count(); hits != 3 {
+		t.Errorf("unexpected number of fetches: %d", hits)
+	}
+}
+
+func TestJWKVerifier_outage(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys := &jwkServer{keys: []jwk{rsaJWK("key", &key.PublicKey)}}
+	ts := httptest.NewServer(keys)
+	defer ts.Close()
+
+	v, err := newJWKVerifier(ts.URL, "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signRS256(t, "key", key, map[string]interface{}{"sub": "alice"})
+	if err := verifyToken(v, token); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	keys.fail(true)
+	now = now.Add(2 * time.Hour)
+	for i, tc := range []struct {
+		elapsed time.Duration
+		token   string
+		err     error
+		hits    int
+	}{
+		// the expired keys are used while the fetches fail
+		{token: token, hits: 2},
+		// and the fetches are throttled
+		{token: token, hits: 2},
+		{token: signRS256(t, "other", key, map[string]interface{}{"sub": "alice"}), err: errUnknownKey, hits: 2},
+		{elapsed: jwkMinRefresh, token: token, hits: 3},
+	} {
+		now = now.Add(tc.elapsed)
+		if err := verifyToken(v, tc.token); err != tc.err {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if hits := keys.count(); hits != tc.hits {
+			t.Errorf("#%d: unexpected number of fetches: %d", i, hits)
+		}
+	}
+
+	keys.fail(false)
+	now = now.Add(jwkMinRefresh)
+	if err := verifyToken(v, token); err != nil {
+		t.Errorf("unexpected error after the outage: %s", err.Error())
+	}
+	if err := verifyToken(v, token); err != nil || keys.count() != 4 {
+		t.Errorf("the keys fetched after the outage are not cached: %v %d", err, keys.count())
+	}
+
+	// without cached keys, the failures are returned
+	keys.fail(true)
+	v, err = newJWKVerifier(ts.URL, "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyToken(v, token); err == nil || err == errUnknownKey {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := verifyToken(v, token); err != errUnknownKey || keys.count() != 5 {
+		t.Errorf("the fetch is not throttled: %v %d", err, keys.count())
+	}
+}
+
+func verifyToken(v *jwkVerifier, token string) error {
+	parts := strings.Split(token, ".")
+	header, err := internal.DecodeJWTSegment(parts[0])
+	if err != nil {
+		return err
+	}
+	return v.verify(header, parts)
+}
+
+type jwkServer struct {
+	mu      sync.Mutex
+	keys    []jwk
+	hits    int
+	failing bool
+}
+
+func (s *jwkServer) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits++
+	if s.failing {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	json.NewEncoder(rw).Encode(jwkSet{Keys: s.keys})
+}
+
+func (s *jwkServer) fail(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+
+func (s *jwkServer) set(keys []jwk) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+func (s *jwkServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits
+}
+
+func rsaJWK(kid string, k *rsa.PublicKey) jwk {
+	return jwk{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, k *ecdsa.PublicKey) jwk {
+	return jwk{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(k.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(k.Y.Bytes()),
+	}
+}
+
+func signRS256(t *testing.T, kid string, k *rsa.PrivateKey, claims map[string]interface{}) string {
+	payload := unsignedPayload(map[string]interface{}{"alg": "RS256", "kid": kid}, claims)
+	digest := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func signES256(t *testing.T, kid string, k *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	payload := unsignedPayload(map[string]interface{}{"alg": "ES256", "kid": kid}, claims)
+	digest := sha256.Sum256([]byte(payload))
+	r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func unsignedToken(header, claims map[string]interface{}) string {
+	return unsignedPayload(header, claims) + "."
+}
+
+func unsignedPayload(header, claims map[string]interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
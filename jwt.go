@@ -0,0 +1,225 @@
+package cel
+
+import (
+	"errors"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+const (
+	authHeader  = "Authorization"
+	tokenPrefix = "Bearer "
+
+	// number of segments of the signed (JWS) and the encrypted (JWE) tokens, in compact form
+	jwsParts = 3
+	jweParts = 5
+)
+
+func newJWTParser(cfg internal.Config) (jwtParser, error) {
+	p := jwtParser{
+		header: authHeader,
+		prefix: tokenPrefix,
+	}
+	if cfg.JWTHeader != "" {
+		p.header = cfg.JWTHeader
+	}
+	if cfg.JWTPrefix != nil {
+		p.prefix = *cfg.JWTPrefix
+	}
+	p.cookie = cfg.JWTCookie
+	if len(cfg.Issuers) > 0 && cfg.JWKURL != "" {
+		return p, errJWKAndIssuers
+	}
+	if len(cfg.Issuers) > 0 {
+		p.issuers = make(map[string]jwtIssuer, len(cfg.Issuers))
+	}
+	for iss, issuer := range cfg.Issuers {
+		// the iss claim can be set by anyone, so it only selects the keys verifying the token
+		if issuer.JWKURL == "" {
+			return p, errIssuerWithoutJWK
+		}
+		v, err := newJWKVerifier(issuer.JWKURL, issuer.JWKCacheTTL)
+		if err != nil {
+			return p, err
+		}
+		p.issuers[iss] = jwtIssuer{verifier: v, audience: issuer.Audience}
+	}
+	if cfg.JWKURL != "" {
+		v, err := newJWKVerifier(cfg.JWKURL, cfg.JWKCacheTTL)
+		if err != nil {
+			return p, err
+		}
+		p.verifier = v
+	}
+	return p, nil
+}
+
+var (
+	errJWKAndIssuers    = errors.New("jwk_url and issuers can not be declared together")
+	errIssuerWithoutJWK = errors.New("the issuers must declare their jwk_url")
+)
+
+// jwtParser extracts the token from the request and decodes it
+type jwtParser struct {
+	header   string
+	prefix   string
+	cookie   string
+	verifier *jwkVerifier
+	issuers  map[string]jwtIssuer
+}
+
+// jwtIssuer is the verification of the tokens of an issuer
+type jwtIssuer struct {
+	verifier *jwkVerifier
+	audience []string
+}
+
+// accepts checks if the aud claim, a string or a list of them, contains any of the audiences of
+// the issuer. Any audience is accepted when the issuer declares none
+func (i jwtIssuer) accepts(aud interface{}) bool {
+	if len(i.audience) == 0 {
+		return true
+	}
+	var values []interface{}
+	switch v := aud.(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+	for _, v := range values {
+		for _, expected := range i.audience {
+			if v == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parse decodes the header and the claims of the token. When a verifier is set, they are only
+// returned if the signature of the token is valid. When the issuers are declared, the token is
+// only returned if its signature is valid for the keys of its issuer and the audiences of the
+// issuer accept it, so the tokens without a declared issuer are not returned
+func (p jwtParser) parse(l logging.Logger, r *proxy.Request) (map[string]interface{}, map[string]interface{}) {
+	jwt, ok := p.token(l, r)
+	if !ok {
+		return nil, nil
+	}
+	jwtParts := strings.Split(jwt, ".")
+	if len(jwtParts) == jweParts {
+		return p.parseJWE(l, jwtParts), nil
+	}
+	if len(jwtParts) != jwsParts {
+		l.Error("CEL: token found, but with", len(jwtParts), "parts")
+		return nil, nil
+	}
+	jwtHeader, err := internal.DecodeJWTSegment(jwtParts[0])
+	if err != nil {
+		l.Error("CEL: decoding the jwt header:", err.Error())
+		return nil, nil
+	}
+	jwtData, err := internal.DecodeJWTSegment(jwtParts[1])
+	if err != nil {
+		l.Error("CEL: decoding the jwt payload:", err.Error())
+		return nil, nil
+	}
+	verifier := p.verifier
+	if p.issuers != nil {
+		// the claims are not trusted until the signature is verified with the keys of the issuer
+		iss, _ := jwtData["iss"].(string)
+		issuer, ok := p.issuers[iss]
+		if !ok {
+			l.Warning("CEL: token found, but its issuer", "'"+iss+"'", "is not declared")
+			return nil, nil
+		}
+		if !issuer.accepts(jwtData["aud"]) {
+			l.Error("CEL: the jwt audience is not accepted by its issuer", iss)
+			return nil, nil
+		}
+		verifier = issuer.verifier
+		if verifier == nil {
+			l.Error("CEL: the issuer", iss, "has no keys to verify the jwt signature")
+			return nil, nil
+		}
+	}
+	if verifier != nil {
+		if err := verifier.verify(jwtHeader, jwtParts); err != nil {
+			l.Error("CEL: verifying the jwt signature:", err.Error())
+			return nil, nil
+		}
+	}
+	return jwtHeader, jwtData
+}
+
+// parseJWE decodes the header of an encrypted token, so the rules can at least check its alg and
+// enc. The claims can not be decrypted, so they are never returned. The header of a JWE is not
+// signed, so it is not exposed when the signatures must be verified, nor when the issuers are
+// declared, since its issuer can not be read
+func (p jwtParser) parseJWE(l logging.Logger, jwtParts []string) map[string]interface{} {
+	if p.verifier != nil {
+		l.Error("CEL: encrypted token (JWE) found, but only signed tokens can be verified")
+		return nil
+	}
+	if p.issuers != nil {
+		l.Error("CEL: encrypted token (JWE) found, but its issuer can not be read")
+		return nil
+	}
+	l.Warning("CEL: encrypted token (JWE) found, only its header is exposed since the claims can not be decrypted")
+	jwtHeader, err := internal.DecodeJWTSegment(jwtParts[0])
+	if err != nil {
+		l.Error("CEL: decoding the jwe header:", err.Error())
+		return nil
+	}
+	return jwtHeader
+}
+
+// token returns the raw token, looking for it in the configured cookie first and in the
+// configured header after that
+func (p jwtParser) token(l logging.Logger, r *proxy.Request) (string, bool) {
+	if p.cookie != "" {
+		if jwt, ok := cookieValue(r.Headers, p.cookie); ok {
+			return jwt, true
+		}
+	}
+
+	values := headerValues(r.Headers, p.header)
+	if len(values) == 0 {
+		return "", false
+	}
+	if !strings.HasPrefix(values[0], p.prefix) {
+		l.Debug("CEL: auth header found but without the token prefix", p.prefix)
+		return "", false
+	}
+	return values[0][len(p.prefix):], true
+}
+
+// headerValues looks for the header with the name as declared and, if missing, with its
+// canonical form
+func headerValues(headers map[string][]string, name string) []string {
+	if vs, ok := headers[name]; ok {
+		return vs
+	}
+	return headers[textproto.CanonicalMIMEHeaderKey(name)]
+}
+
+// cookieValue returns the unescaped value of the named cookie. All the Cookie headers and all the
+// cookies declared in each one of them are considered.
+func cookieValue(headers map[string][]string, name string) (string, bool) {
+	req := http.Request{Header: http.Header{"Cookie": headerValues(headers, "Cookie")}}
+	c, err := req.Cookie(name)
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+	v, err := url.PathUnescape(c.Value)
+	if err != nil {
+		return c.Value, true
+	}
+	return v, true
+}
@@ -0,0 +1,313 @@
+package cel
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestProxyFactory_jwtHeaderAndPrefix(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	token := unsignedToken(map[string]interface{}{"alg": "RS256"}, map[string]interface{}{"sub": "alice"}) + "sig"
+
+	for _, tc := range []struct {
+		name    string
+		cfg     map[string]interface{}
+		headers map[string][]string
+		success bool
+	}{
+		{
+			name:    "defaults",
+			cfg:     map[string]interface{}{},
+			headers: map[string][]string{"Authorization": {"Bearer " + token}},
+			success: true,
+		},
+		{
+			name:    "custom header",
+			cfg:     map[string]interface{}{"jwt_header": "X-Access-Token"},
+			headers: map[string][]string{"X-Access-Token": {"Bearer " + token}},
+			success: true,
+		},
+		{
+			name:    "custom header not canonical",
+			cfg:     map[string]interface{}{"jwt_header": "x-access-token"},
+			headers: map[string][]string{"X-Access-Token": {"Bearer " + token}},
+			success: true,
+		},
+		{
+			name:    "custom header and prefix",
+			cfg:     map[string]interface{}{"jwt_header": "X-Access-Token", "jwt_prefix": "Token "},
+			headers: map[string][]string{"X-Access-Token": {"Token " + token}},
+			success: true,
+		},
+		{
+			name:    "custom header without prefix",
+			cfg:     map[string]interface{}{"jwt_header": "X-Access-Token", "jwt_prefix": ""},
+			headers: map[string][]string{"X-Access-Token": {token}},
+			success: true,
+		},
+		{
+			name:    "prefix required by default",
+			cfg:     map[string]interface{}{"jwt_header": "X-Access-Token"},
+			headers: map[string][]string{"X-Access-Token": {token}},
+		},
+		{
+			name:    "custom header ignores the default one",
+			cfg:     map[string]interface{}{"jwt_header": "X-Access-Token"},
+			headers: map[string][]string{"Authorization": {"Bearer " + token}},
+		},
+		{
+			name:    "wrong prefix",
+			cfg:     map[string]interface{}{"jwt_prefix": "Token "},
+			headers: map[string][]string{"Authorization": {"Bearer " + token}},
+		},
+	} {
+		tc.cfg["definitions"] = []internal.InterpretableDefinition{{CheckExpression: "req_jwt.sub == 'alice'"}}
+		prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: tc.cfg},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "GET",
+			Path:    "/some-path",
+			Headers: tc.headers,
+		})
+		if tc.success {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+				continue
+			}
+			if resp != expectedResponse {
+				t.Errorf("%s: unexpected response %+v", tc.name, resp)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expecting error", tc.name)
+		}
+	}
+}
+
+func TestProxyFactory_jwtCookie(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	alice := unsignedToken(map[string]interface{}{"alg": "RS256"}, map[string]interface{}{"sub": "alice"}) + "sig"
+	bob := unsignedToken(map[string]interface{}{"alg": "RS256"}, map[string]interface{}{"sub": "bob"}) + "sig"
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"jwt_cookie":  "access_token",
+				"definitions": []internal.InterpretableDefinition{{CheckExpression: "req_jwt.sub == 'alice'"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string][]string
+		success bool
+	}{
+		{
+			name:    "single cookie",
+			headers: map[string][]string{"Cookie": {"access_token=" + alice}},
+			success: true,
+		},
+		{
+			name:    "several cookies",
+			headers: map[string][]string{"Cookie": {"session=abc; access_token=" + alice + "; theme=dark"}},
+			success: true,
+		},
+		{
+			name:    "several cookie headers",
+			headers: map[string][]string{"Cookie": {"session=abc", "access_token=" + alice}},
+			success: true,
+		},
+		{
+			name:    "escaped cookie",
+			headers: map[string][]string{"Cookie": {"access_token=" + strings.Replace(alice, ".", "%2E", -1)}},
+			success: true,
+		},
+		{
+			name:    "cookie wins over the header",
+			headers: map[string][]string{"Cookie": {"access_token=" + alice}, "Authorization": {"Bearer " + bob}},
+			success: true,
+		},
+		{
+			name:    "fallback to the header",
+			headers: map[string][]string{"Cookie": {"session=abc"}, "Authorization": {"Bearer " + alice}},
+			success: true,
+		},
+		{
+			name:    "wrong token",
+			headers: map[string][]string{"Cookie": {"access_token=" + bob}},
+		},
+		{
+			name:    "no token",
+			headers: map[string][]string{"Cookie": {"session=abc"}},
+		},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "GET",
+			Path:    "/some-path",
+			Headers: tc.headers,
+		})
+		if tc.success {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+				continue
+			}
+			if resp != expectedResponse {
+				t.Errorf("%s: unexpected response %+v", tc.name, resp)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expecting error", tc.name)
+		}
+	}
+}
+
+func TestJWTParser_jwe(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RSA-OAEP","enc":"A256GCM"}`))
+	jwe := header + ".key.iv.ciphertext.tag"
+
+	for _, tc := range []struct {
+		name     string
+		token    string
+		verifier *jwkVerifier
+		issuers  map[string]jwtIssuer
+		enc      interface{}
+		log      string
+	}{
+		{name: "jwe", token: jwe, enc: "A256GCM", log: "encrypted token (JWE) found"},
+		{name: "jwe verified", token: jwe, verifier: &jwkVerifier{}, log: "only signed tokens can be verified"},
+		{name: "jwe with issuers", token: jwe, issuers: map[string]jwtIssuer{"https://idp.example.com/": {}}, log: "its issuer can not be read"},
+		{name: "four parts", token: header + ".a.b.c", log: "with 4 parts"},
+	} {
+		buff := new(bytes.Buffer)
+		logger, err := logging.NewLogger("DEBUG", buff, "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		p := jwtParser{header: authHeader, prefix: tokenPrefix, verifier: tc.verifier, issuers: tc.issuers}
+		jwtHeader, claims := p.parse(logger, &proxy.Request{
+			Headers: map[string][]string{"Authorization": {"Bearer " + tc.token}},
+		})
+		if claims != nil {
+			t.Errorf("%s: unexpected claims %v", tc.name, claims)
+		}
+		if tc.enc == nil && jwtHeader != nil {
+			t.Errorf("%s: unexpected header %v", tc.name, jwtHeader)
+		}
+		if tc.enc != nil && jwtHeader["enc"] != tc.enc {
+			t.Errorf("%s: unexpected header %v", tc.name, jwtHeader)
+		}
+		if !strings.Contains(buff.String(), tc.log) {
+			t.Errorf("%s: unexpected log %q", tc.name, buff.String())
+		}
+	}
+}
+
+func TestProxyFactory_jwtClaimHelpers(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "jwtAudienceContains(req_jwt, 'my-api') && jwtIssuer(req_jwt) == 'https://idp'"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		name    string
+		claims  map[string]interface{}
+		success bool
+	}{
+		{name: "string aud", claims: map[string]interface{}{"aud": "my-api", "iss": "https://idp"}, success: true},
+		{name: "list aud", claims: map[string]interface{}{"aud": []string{"other", "my-api"}, "iss": "https://idp"}, success: true},
+		{name: "wrong iss", claims: map[string]interface{}{"aud": "my-api", "iss": "https://evil"}},
+		{name: "no aud", claims: map[string]interface{}{"iss": "https://idp"}},
+		{name: "no token"},
+	} {
+		headers := map[string][]string{}
+		if tc.claims != nil {
+			headers["Authorization"] = []string{"Bearer " + unsignedToken(map[string]interface{}{"alg": "RS256"}, tc.claims) + "sig"}
+		}
+		resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/some-path", Headers: headers})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.name)
+			}
+			continue
+		}
+		if err != nil || resp != expectedResponse {
+			t.Errorf("%s: unexpected result: %v %+v", tc.name, err, resp)
+		}
+	}
+}
+
+func TestProxyFactory_hasScope(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "hasScope(req_jwt, 'read:orders')"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		name    string
+		claims  map[string]interface{}
+		success bool
+	}{
+		{name: "string scope", claims: map[string]interface{}{"scope": "openid read:orders"}, success: true},
+		{name: "list scp", claims: map[string]interface{}{"scp": []string{"openid", "read:orders"}}, success: true},
+		{name: "other scope", claims: map[string]interface{}{"scope": "write:orders"}},
+		{name: "no scope", claims: map[string]interface{}{"sub": "alice"}},
+		{name: "no token"},
+	} {
+		headers := map[string][]string{}
+		if tc.claims != nil {
+			headers["Authorization"] = []string{"Bearer " + unsignedToken(map[string]interface{}{"alg": "RS256"}, tc.claims) + "sig"}
+		}
+		resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/some-path", Headers: headers})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.name)
+			}
+			continue
+		}
+		if err != nil || resp != expectedResponse {
+			t.Errorf("%s: unexpected result: %v %+v", tc.name, err, resp)
+		}
+	}
+}
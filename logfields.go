@@ -0,0 +1,101 @@
+package cel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/logging"
+)
+
+// Keys of the fields of the evaluation logs
+const (
+	LogFieldEndpoint        = "endpoint"
+	LogFieldPhase           = "phase"
+	LogFieldDefinitionIndex = "definition_index"
+	LogFieldExpression      = "expression"
+	LogFieldOutcome         = "outcome"
+)
+
+// FieldLogger is implemented by the loggers supporting structured fields. When the logger passed
+// to the factories implements it, the evaluation logs carry their values as fields instead of
+// formatting them into the message
+type FieldLogger interface {
+	logging.Logger
+	WithFields(fields map[string]interface{}) logging.Logger
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+// rejectLevel returns the level of the rejections of the definition, Info when it does not set one
+func rejectLevel(def internal.InterpretableDefinition) logLevel {
+	switch strings.ToUpper(def.LogLevel) {
+	case internal.LogLevelDebug:
+		return levelDebug
+	case internal.LogLevelWarning:
+		return levelWarning
+	case internal.LogLevelError:
+		return levelError
+	default:
+		return levelInfo
+	}
+}
+
+// logValue returns the value (a result or an error) of the evaluator for the logs, masked when
+// its expression, or the one of its guard, references a redacted identifier or key
+func logValue(eval internal.Evaluator, v interface{}) interface{} {
+	if v == nil {
+		return v
+	}
+	if eval.Redacted || (eval.Guard != nil && eval.Guard.Redacted) {
+		return redactedValue
+	}
+	return v
+}
+
+// logEvent logs the message with the key/value pairs. The plain loggers get them appended to the
+// message in the key=value format, quoting the values with spaces (but the JSON objects, like
+// the dumped activations), so the logs are still readable and they can be parsed by the aggregators
+func logEvent(l logging.Logger, level logLevel, msg string, kv ...interface{}) {
+	msg = "CEL: " + msg
+	if fl, ok := l.(FieldLogger); ok {
+		fields := make(map[string]interface{}, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			fields[fmt.Sprint(kv[i])] = kv[i+1]
+		}
+		l = fl.WithFields(fields)
+	} else if len(kv) > 0 {
+		msg += " " + formatFields(kv...)
+	}
+
+	switch level {
+	case levelDebug:
+		l.Debug(msg)
+	case levelInfo:
+		l.Info(msg)
+	case levelWarning:
+		l.Warning(msg)
+	default:
+		l.Error(msg)
+	}
+}
+
+func formatFields(kv ...interface{}) string {
+	parts := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || (!strings.HasPrefix(v, "{") && strings.ContainsAny(v, " \t\n\"=")) {
+			v = strconv.Quote(v)
+		}
+		parts = append(parts, fmt.Sprintf("%v=%s", kv[i], v))
+	}
+	return strings.Join(parts, " ")
+}
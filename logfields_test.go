@@ -0,0 +1,203 @@
+package cel
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestLogEvent_plain(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("DEBUG", buff, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logEvent(logger, levelWarning, "check failed", LogFieldEndpoint, "proxy /foo", LogFieldPhase, "pre", LogFieldDefinitionIndex, 2, "error", "", "activation", `{"req_method":"GET POST"}`)
+
+	expected := `WARNING: CEL: check failed endpoint="proxy /foo" phase=pre definition_index=2 error="" activation={"req_method":"GET POST"}`
+	if logs := buff.String(); !strings.Contains(logs, expected) {
+		t.Errorf("unexpected log: %s", logs)
+	}
+}
+
+func TestProxyFactory_fieldLogger(t *testing.T) {
+	l := &fieldLogger{}
+	prxy, err := ProxyFactory(l, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(&config.EndpointConfig{
+		Endpoint: "/foo",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+			{CheckExpression: "req_method == 'GET'"},
+			{CheckExpression: "req_path == '/bar'"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/foo"}); err == nil {
+		t.Fatal("expecting error")
+	}
+
+	var passed, rejected map[string]interface{}
+	for _, e := range l.entries {
+		switch e.msg {
+		case "CEL: check passed":
+			passed = e.fields
+		case "CEL: check rejected":
+			rejected = e.fields
+		}
+	}
+	for name, tc := range map[string]struct {
+		fields  map[string]interface{}
+		index   int
+		outcome string
+	}{
+		"passed":   {fields: passed, index: 0, outcome: OutcomePass},
+		"rejected": {fields: rejected, index: 1, outcome: OutcomeReject},
+	} {
+		if tc.fields == nil {
+			t.Errorf("%s: not logged: %+v", name, l.entries)
+			continue
+		}
+		if tc.fields[LogFieldEndpoint] != "proxy /foo" || tc.fields[LogFieldPhase] != internal.PhasePre ||
+			tc.fields[LogFieldDefinitionIndex] != tc.index || tc.fields[LogFieldOutcome] != tc.outcome {
+			t.Errorf("%s: unexpected fields: %+v", name, tc.fields)
+		}
+	}
+}
+
+func TestProxyFactory_logLevel(t *testing.T) {
+	for _, tc := range []struct {
+		level    string
+		expected string
+	}{
+		{level: "", expected: "INFO: CEL: check rejected"},
+		{level: internal.LogLevelDebug, expected: "DEBUG: CEL: check rejected"},
+		{level: "warning", expected: "WARNING: CEL: check rejected"},
+		{level: internal.LogLevelError, expected: "ERROR: CEL: check rejected"},
+	} {
+		buff := new(bytes.Buffer)
+		logger, err := logging.NewLogger("DEBUG", buff, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		prxy, err := ProxyFactory(logger, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(&config.EndpointConfig{
+			Endpoint: "/foo",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_method == 'GET'", LogLevel: tc.level},
+				{CheckExpression: "req_path == '/bar'", LogLevel: tc.level},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/foo"}); err == nil {
+			t.Errorf("'%s': expecting error", tc.level)
+			continue
+		}
+
+		logs := buff.String()
+		if !strings.Contains(logs, tc.expected) {
+			t.Errorf("'%s': rejection not logged: %s", tc.level, logs)
+		}
+		if !strings.Contains(logs, "DEBUG: CEL: check passed") {
+			t.Errorf("'%s': pass not logged: %s", tc.level, logs)
+		}
+	}
+}
+
+type logEntry struct {
+	msg    string
+	fields map[string]interface{}
+}
+
+// fieldLogger records the messages logged with fields
+type fieldLogger struct {
+	logging.Logger
+	fields  map[string]interface{}
+	entries []logEntry
+	parent  *fieldLogger
+}
+
+func (f *fieldLogger) WithFields(fields map[string]interface{}) logging.Logger {
+	return &fieldLogger{fields: fields, parent: f}
+}
+
+func (f *fieldLogger) record(v ...interface{}) {
+	root := f
+	if f.parent != nil {
+		root = f.parent
+	}
+	if len(v) == 1 {
+		root.entries = append(root.entries, logEntry{msg: v[0].(string), fields: f.fields})
+	}
+}
+
+func (f *fieldLogger) Debug(v ...interface{})    { f.record(v...) }
+func (f *fieldLogger) Info(v ...interface{})     { f.record(v...) }
+func (f *fieldLogger) Warning(v ...interface{})  { f.record(v...) }
+func (f *fieldLogger) Error(v ...interface{})    { f.record(v...) }
+func (f *fieldLogger) Critical(v ...interface{}) { f.record(v...) }
+func (f *fieldLogger) Fatal(v ...interface{})    { f.record(v...) }
+
+func TestProxyFactory_logRedact(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		redact    []string
+		logged    []string
+		notLogged []string
+	}{
+		{
+			name:      "default",
+			logged:    []string{"result=[REDACTED]", "alice@example.com"},
+			notLogged: []string{"result=false"},
+		},
+		{
+			name:      "configured",
+			redact:    []string{"email"},
+			logged:    []string{"result=false", "result=[REDACTED]"},
+			notLogged: []string{"alice@example.com"},
+		},
+	} {
+		buff := bytes.NewBuffer(make([]byte, 1024))
+		logger, err := logging.NewLogger("DEBUG", buff, "pref")
+		if err != nil {
+			t.Error("building the logger:", err.Error())
+			return
+		}
+
+		prxy, err := ProxyFactory(logger, dummyProxyFactory(&proxy.Response{Data: map[string]interface{}{"mail": "alice@example.com"}, IsComplete: true})).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{
+				"log_redact": tc.redact,
+				"definitions": []internal.InterpretableDefinition{
+					{CheckExpression: "req_authorization.startsWith('Bearer ')", FailPolicy: internal.FailPolicyOpen, Audit: true},
+					{ModExpression: "{'email': resp_data.mail}"},
+				},
+			}},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/", Headers: map[string][]string{"Authorization": {"Basic c2VjcmV0"}}}); err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+			continue
+		}
+		for _, line := range tc.logged {
+			if !strings.Contains(buff.String(), line) {
+				t.Errorf("%s: %s not logged", tc.name, line)
+			}
+		}
+		for _, line := range tc.notLogged {
+			if strings.Contains(buff.String(), line) {
+				t.Errorf("%s: %s logged", tc.name, line)
+			}
+		}
+	}
+}
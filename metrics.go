@@ -0,0 +1,50 @@
+package cel
+
+import "sync"
+
+// Outcomes of the evaluations reported to the MetricsCollector
+const (
+	OutcomePass   = "pass"
+	OutcomeReject = "reject"
+	OutcomeError  = "error"
+	// OutcomeRedirect is the outcome of the failed checks redirecting the request
+	OutcomeRedirect = "redirect"
+	// OutcomeSkip is the outcome of the checks whose when guard does not apply
+	OutcomeSkip = "skip"
+	// OutcomeAudit is the outcome of the failed checks in audit mode, letting the request proceed
+	OutcomeAudit = "audit"
+)
+
+// MetricsCollector receives the outcome of every evaluation, labeled by the name of the pipe
+// (i.e. "proxy /foo-pre") and the index of the definition, so it can be exposed as a counter in
+// the metrics registry of the gateway. Implementations must be safe for concurrent use
+type MetricsCollector interface {
+	Count(name string, index int, outcome string)
+}
+
+// SetMetricsCollector wires the collector of the outcomes of the evaluations. Until a collector
+// is set, the outcomes are not counted
+func SetMetricsCollector(c MetricsCollector) {
+	collectorMu.Lock()
+	if c == nil {
+		c = noopCollector{}
+	}
+	collector = c
+	collectorMu.Unlock()
+}
+
+func countOutcome(name string, index int, outcome string) {
+	collectorMu.RLock()
+	c := collector
+	collectorMu.RUnlock()
+	c.Count(name, index, outcome)
+}
+
+var (
+	collectorMu sync.RWMutex
+	collector   MetricsCollector = noopCollector{}
+)
+
+type noopCollector struct{}
+
+func (noopCollector) Count(_ string, _ int, _ string) {}
@@ -0,0 +1,87 @@
+package cel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestProxyFactory_metrics(t *testing.T) {
+	c := &memoryCollector{counters: map[string]int{}}
+	SetMetricsCollector(c)
+	defer SetMetricsCollector(nil)
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_method == 'GET' || req_method == 'POST'"},
+				{CheckExpression: "req_params.Id == '42'", FailPolicy: internal.FailPolicyOpen},
+				{CheckExpression: "resp_completed"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, r := range []*proxy.Request{
+		{Method: "GET", Params: map[string]string{"Id": "42"}},
+		{Method: "POST"},
+		{Method: "DELETE"},
+	} {
+		r.Path = "/some-path"
+		r.Headers = map[string][]string{}
+		prxy(context.Background(), r)
+	}
+
+	expected := map[string]int{
+		"proxy /-pre #0 pass":   2,
+		"proxy /-pre #0 reject": 1,
+		"proxy /-pre #1 pass":   1,
+		"proxy /-pre #1 error":  1,
+		"proxy /-post #0 pass":  2,
+	}
+	if len(c.counters) != len(expected) {
+		t.Errorf("unexpected counters: %v", c.counters)
+	}
+	for k, v := range expected {
+		if c.counters[k] != v {
+			t.Errorf("unexpected value for %s: %d", k, c.counters[k])
+		}
+	}
+}
+
+func TestProxyFactory_metricsNotWired(t *testing.T) {
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{{CheckExpression: "req_method == 'GET'"}},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/", Headers: map[string][]string{}}); err != nil {
+		t.Error(err)
+	}
+}
+
+type memoryCollector struct {
+	mu       sync.Mutex
+	counters map[string]int
+}
+
+func (c *memoryCollector) Count(name string, index int, outcome string) {
+	c.mu.Lock()
+	c.counters[fmt.Sprintf("%s #%d %s", name, index, outcome)]++
+	c.mu.Unlock()
+}
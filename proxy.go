@@ -1,217 +1,1531 @@
 package cel
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/devopsfaith/krakend-cel/internal"
 	"github.com/devopsfaith/krakend/config"
 	"github.com/devopsfaith/krakend/logging"
 	"github.com/devopsfaith/krakend/proxy"
-	"github.com/google/cel-go/cel"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
 )
 
 const (
-	authHeader        = "Authorization"
-	contentTypeHeader = "Content-Type"
-	contentTypeJson   = "application/json"
-	contentTypeForm   = "multipart/form-data"
-	tokenPrefix       = "Bearer "
+	forwardedForHeader   = "X-Forwarded-For"
+	realIPHeader         = "X-Real-Ip"
+	forwardedHostHeader  = "X-Forwarded-Host"
+	forwardedProtoHeader = "X-Forwarded-Proto"
+	hostHeader           = "Host"
+
+	forwardedTLSVersionHeader = "X-Forwarded-Tls-Version"
+	sslProtocolHeader         = "X-Ssl-Protocol"
+	forwardedSSLHeader        = "X-Forwarded-Ssl"
 )
 
+// tlsVersionHeaders are the headers declaring the version of TLS negotiated with the client, by
+// order of precedence
+var tlsVersionHeaders = []string{forwardedTLSVersionHeader, sslProtocolHeader}
+
 func ProxyFactory(l logging.Logger, pf proxy.Factory) proxy.Factory {
+	return ProxyFactoryWithDefaults(l, pf, nil)
+}
+
+// ProxyFactoryWithDefaults is like ProxyFactory, but the definitions declared under the namespace
+// of the service extra config are prepended to the ones of every endpoint, so a baseline rule is
+// enforced everywhere. The endpoints declaring skip_defaults only evaluate their own definitions.
+// The groups of the service config are registered, so the endpoints and the backends can include
+// them, and its error_body applies to the endpoints not declaring their own one
+func ProxyFactoryWithDefaults(l logging.Logger, pf proxy.Factory, e config.ExtraConfig) proxy.Factory {
+	defaults, _ := internal.ConfigGetter(e)
+	for name, definitions := range defaults.Groups {
+		if registerGroup(name, definitions) {
+			l.Warning("CEL: the definition group", name, "of the service config replaces the registered one")
+		}
+	}
 	return proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
 		next, err := pf.New(cfg)
 		if err != nil {
 			return next, err
 		}
+		if isSequential(cfg) {
+			next = withSequence(next)
+		}
 
 		def, ok := internal.ConfigGetter(cfg.ExtraConfig)
-		if !ok {
+		if !ok && len(defaults.Definitions) == 0 {
 			l.Debug("CEL: no extra config detected for pipe", cfg.Endpoint)
 			return next, nil
 		}
 		l.Debug("CEL: loading the extra config detected for pipe", cfg.Endpoint)
+		def, err = withGroups(def)
+		def = def.WithDefaults(defaults.Definitions)
+		if def.ErrorBody == nil {
+			def.ErrorBody = defaults.ErrorBody
+		}
 
-		p, err := newProxy(l, "proxy "+cfg.Endpoint, def, next)
+		p := next
+		if err == nil {
+			p, err = newProxy(l, "proxy "+cfg.Endpoint, cfg.Endpoint, len(cfg.Backend), def, next, nil)
+		}
+		if err != nil && def.Strict {
+			l.Error("CEL: error parsing the definitions for pipe", cfg.Endpoint, ":", err.Error())
+			return nil, err
+		}
+		if err != nil && internal.AnyCritical(def.Definitions) {
+			l.Error("CEL: error parsing the critical definitions for pipe", cfg.Endpoint, ":", err.Error())
+			l.Error("CEL: rejecting all the requests of the pipe")
+			return rejectAll(err), nil
+		}
 		if err != nil {
 			l.Warning("CEL: error parsing the definitions for pipe", cfg.Endpoint, ":", err.Error())
 			l.Warning("CEL: falling back to the next pipe proxy")
 			return next, nil
 		}
+		if def.ErrorBody != nil {
+			if !errorStatusRegistered() {
+				l.Error("CEL: error building the pipe", cfg.Endpoint, ":", errErrorStatus.Error())
+				return nil, errErrorStatus
+			}
+			p = errorBodyProxy(*def.ErrorBody, p)
+		}
 		return p, err
 	})
 }
 
+// BackendFactory wraps the backends with the definitions of their extra config. All the backends
+// report their completion to the endpoint, so its rules can check resp_backends_completed, and
+// the backends of the sequential endpoints record their responses for the next ones
 func BackendFactory(l logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
 	return func(cfg *config.Backend) proxy.Proxy {
-		next := bf(cfg)
+		return trackBackend(sequenceBackend(newBackendProxy(l, bf, cfg)))
+	}
+}
 
-		def, ok := internal.ConfigGetter(cfg.ExtraConfig)
-		if !ok {
-			l.Debug("CEL: no extra config detected for backend", cfg.URLPattern)
-			return next
-		}
-		l.Debug("CEL: loading the extra config detected for backend", cfg.URLPattern)
+func newBackendProxy(l logging.Logger, bf proxy.BackendFactory, cfg *config.Backend) proxy.Proxy {
+	next := bf(cfg)
 
-		p, err := newProxy(l, "backend "+cfg.URLPattern, def, next)
-		if err != nil {
-			l.Warning("CEL: error parsing the definitions for backend", cfg.URLPattern, ":", err.Error())
-			l.Warning("CEL: falling back to the next backend proxy")
-			return next
-		}
-		return p
+	def, ok := internal.ConfigGetter(cfg.ExtraConfig)
+	if !ok {
+		l.Debug("CEL: no extra config detected for backend", cfg.URLPattern)
+		return next
+	}
+	l.Debug("CEL: loading the extra config detected for backend", cfg.URLPattern)
+
+	def, err := withGroups(def)
+	p := next
+	if err == nil {
+		p, err = newProxy(l, "backend "+cfg.URLPattern, cfg.URLPattern, 0, def, next, backendRejection(cfg.URLPattern))
+	}
+	if err != nil && (def.Strict || internal.AnyCritical(def.Definitions)) {
+		l.Error("CEL: error parsing the definitions for backend", cfg.URLPattern, ":", err.Error())
+		return rejectAll(err)
+	}
+	if err != nil {
+		l.Warning("CEL: error parsing the definitions for backend", cfg.URLPattern, ":", err.Error())
+		l.Warning("CEL: falling back to the next backend proxy")
+		return next
+	}
+	return p
+}
+
+// rejectAll returns a proxy failing every request with the error. The backend factories can not
+// return errors, so this is how the strict mode keeps the backends with invalid definitions closed.
+// It also keeps closed the endpoints with invalid critical definitions
+func rejectAll(err error) proxy.Proxy {
+	return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, err
 	}
 }
 
-func newProxy(l logging.Logger, name string, defs []internal.InterpretableDefinition, next proxy.Proxy) (proxy.Proxy, error) {
-	p := internal.NewCheckExpressionParser(l)
-	preEvaluators, err := p.ParsePre(defs)
+// newProxy returns the proxy evaluating the definitions around the next one. The endpoint is the
+// one exposed to the expressions and backends is the number of backends of the endpoint, 0 for
+// the pipes of the backends. When present, the rejection func wraps the errors of the post-checks
+func newProxy(l logging.Logger, name, endpoint string, backends int, cfg internal.Config, next proxy.Proxy, rejection func(error) error) (proxy.Proxy, error) {
+	rs, err := newRuleSet(l, name, endpoint, backends, cfg)
 	if err != nil {
 		return proxy.NoopProxy, err
 	}
-	postEvaluators, err := p.ParsePost(defs)
+	return rulesProxy(l, name, backends, func() *ruleSet { return rs }, next, rejection), nil
+}
+
+// ruleSet contains the evaluators of the definitions of a pipe, along with the options derived
+// from them
+type ruleSet struct {
+	skip                []internal.Evaluator
+	preEvaluators       []internal.Evaluator
+	postEvaluators      []internal.Evaluator
+	headerMutations     []internal.Evaluator
+	dataMutations       []internal.Evaluator
+	respHeaderMutations []internal.Evaluator
+	respStatusMutations []internal.Evaluator
+	storeMutations      []internal.Evaluator
+	opts                reqOptions
+	dumper              *activationDumper
+	trackBackends       bool
+	reportAll           bool
+	rejectIncomplete    bool
+	// auditPost is true when the post phase has audited checks, which keep running in the
+	// background after timing out
+	auditPost bool
+	summary   PipeSummary
+	// logSink receives the messages of the log function, when any expression can call it
+	logSink internal.LogSink
+}
+
+// newRuleSet compiles the definitions of the config
+func newRuleSet(l logging.Logger, name, endpoint string, backends int, cfg internal.Config) (*ruleSet, error) {
+	if cfg.Audit {
+		cfg.Definitions = auditDefinitions(cfg.Definitions)
+	}
+	vars, err := internal.NewVars(cfg.Vars)
 	if err != nil {
-		return proxy.NoopProxy, err
+		return nil, err
+	}
+	lists, err := internal.NewLists(cfg.Lists)
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := internal.NewSchemas(cfg.Schemas)
+	if err != nil {
+		return nil, err
+	}
+	redacted := cfg.LogRedactKeys()
+	f := currentFeatures()
+	p := internal.NewCheckExpressionParser(l).WithVars(vars).WithLists(lists).WithSchemas(schemas).WithRedacted(redacted).WithFeatures(f)
+	preEvaluators, err := p.ParsePre(cfg.Definitions)
+	if err != nil {
+		return nil, err
+	}
+	postEvaluators, err := p.ParsePost(cfg.Definitions)
+	if err != nil {
+		return nil, err
+	}
+	m := internal.NewModExpressionParser(l).WithVars(vars).WithLists(lists).WithSchemas(schemas).WithRedacted(redacted).WithFeatures(f)
+	headerMutations, err := m.ParseHeaderMutations(cfg.Definitions)
+	if err != nil {
+		return nil, err
 	}
+	dataMutations, err := m.ParseDataMutations(cfg.Definitions)
+	if err != nil {
+		return nil, err
+	}
+	respHeaderMutations, err := m.ParseRespHeaderMutations(cfg.Definitions)
+	if err != nil {
+		return nil, err
+	}
+	respStatusMutations, err := m.ParseRespStatusMutations(cfg.Definitions)
+	if err != nil {
+		return nil, err
+	}
+	storeMutations, err := m.ParseStoreMutations(cfg.Definitions)
+	if err != nil {
+		return nil, err
+	}
+	skip, err := p.ParseSkip(cfg.Skip)
+	if err != nil {
+		return nil, err
+	}
+	// the guards and the redirects are evaluated against the same activation, so the references
+	// of the phase include theirs
+	reqEvaluators := withNested(skip, preEvaluators, headerMutations, storeMutations)
+	respEvaluators := withNested(postEvaluators, dataMutations, respHeaderMutations, respStatusMutations)
+	if !cfg.RespBodyRaw && internal.AnyReferences(respEvaluators, internal.PostKey+"_body_raw") {
+		return nil, errRespBodyRawDisabled
+	}
+	if !cfg.ReqBodyB64 && internal.AnyReferences(reqEvaluators, internal.PreKey+"_body_b64") {
+		return nil, errReqBodyB64Disabled
+	}
+
+	jwt, err := newJWTParser(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts := reqOptions{
+		jwt:            jwt,
+		body:           newBodyParser(cfg),
+		trustedProxies: cfg.TrustedProxies,
+		constants:      pipeConstants(vars, endpoint),
+		// decoding the token and the body is expensive, so it is skipped if no rule needs them
+		parseJWT:       internal.AnyReferences(reqEvaluators, internal.PreKey+"_jwt", internal.PreKey+"_jwt_header"),
+		parseBody:      internal.AnyReferences(reqEvaluators, internal.PreKey+"_body"),
+		parseBodyFiles: internal.AnyReferences(reqEvaluators, internal.PreKey+"_body_files"),
+		readBodyBytes:  internal.AnyReferences(reqEvaluators, internal.PreKey+"_body_raw", internal.PreKey+"_body_size", internal.PreKey+"_body_b64"),
+	}
+
+	dumper := newActivationDumper(cfg)
+	var logSink internal.LogSink
+	if internal.AnyReferences(append(append([]internal.Evaluator{}, reqEvaluators...), respEvaluators...), internal.ContextKey) {
+		logSink = func(msg string, dropped int) {
+			kv := []interface{}{LogFieldEndpoint, name, "message", msg}
+			if dropped > 0 {
+				kv = append(kv, "dropped", dropped)
+			}
+			logEvent(l, levelInfo, "expression log", kv...)
+		}
+	}
+	// counting the completed backends requires them to report to the tracker of the request
+	trackBackends := backends > 0 && internal.AnyReferences(respEvaluators, internal.PostKey+"_backends_completed")
+
+	summary := PipeSummary{
+		Name:                name,
+		PreEvaluators:       len(preEvaluators),
+		PostEvaluators:      len(postEvaluators),
+		HeaderMutations:     len(headerMutations),
+		DataMutations:       len(dataMutations),
+		RespHeaderMutations: len(respHeaderMutations),
+		RespStatusMutations: len(respStatusMutations),
+		StoreMutations:      len(storeMutations),
+	}
+	registerSummary(summary)
+	logEvent(l, levelInfo, "definitions loaded", LogFieldEndpoint, name,
+		"pre_evaluators", summary.PreEvaluators,
+		"post_evaluators", summary.PostEvaluators,
+		"header_mutations", summary.HeaderMutations,
+		"data_mutations", summary.DataMutations,
+		"resp_header_mutations", summary.RespHeaderMutations,
+		"resp_status_mutations", summary.RespStatusMutations,
+		"store_mutations", summary.StoreMutations)
+
+	return &ruleSet{
+		skip:                skip,
+		preEvaluators:       preEvaluators,
+		postEvaluators:      postEvaluators,
+		headerMutations:     headerMutations,
+		dataMutations:       dataMutations,
+		respHeaderMutations: respHeaderMutations,
+		respStatusMutations: respStatusMutations,
+		storeMutations:      storeMutations,
+		opts:                opts,
+		dumper:              dumper,
+		trackBackends:       trackBackends,
+		reportAll:           cfg.ReportAll,
+		rejectIncomplete:    cfg.RejectIncomplete,
+		auditPost:           anyAudited(postEvaluators),
+		summary:             summary,
+		logSink:             logSink,
+	}, nil
+}
 
-	l.Debug("CEL:", name, "preEvaluators", preEvaluators)
-	l.Debug("CEL:", name, "postEvaluators", postEvaluators)
+// withNested returns the evaluators along with their guards and redirects
+func withNested(evaluators ...[]internal.Evaluator) []internal.Evaluator {
+	res := []internal.Evaluator{}
+	for _, evals := range evaluators {
+		for _, e := range evals {
+			res = append(res, e)
+			if e.Guard != nil {
+				res = append(res, *e.Guard)
+			}
+			if e.Redirect != nil {
+				res = append(res, *e.Redirect)
+			}
+		}
+	}
+	return res
+}
 
+// rulesProxy returns the proxy evaluating the rule set returned by the rules func around the next
+// one. The rule set is taken once per request, so all the phases use the same one
+func rulesProxy(l logging.Logger, name string, backends int, rules func() *ruleSet, next proxy.Proxy, rejection func(error) error) proxy.Proxy {
 	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
-		now := timeNow().Format(time.RFC3339)
+		rs := rules()
+		now := timeNow()
+		if rs.logSink != nil {
+			ctx = internal.WithLogSink(ctx, rs.logSink)
+		}
 
-		if err := evalChecks(l, name+"-pre", newReqActivation(l, r, now), preEvaluators); err != nil {
+		reqActivation := newReqActivation(l, r, now, rs.opts)
+		reqActivation.prev = sequenceFrom(ctx)
+		if shouldSkip(ctx, l, name, reqActivation, rs.skip) {
+			reqActivation.close()
+			logEvent(l, levelDebug, "skipping the evaluation of the definitions", LogFieldEndpoint, name)
+			return next(ctx, r)
+		}
+		var store map[string]interface{}
+		err := tracePhase(ctx, SpanPre, name, len(rs.preEvaluators)+len(rs.headerMutations)+len(rs.storeMutations), func(ctx context.Context) error {
+			if err := evalChecks(ctx, l, name, internal.PhasePre, reqActivation, rs.preEvaluators, rs.reportAll, rs.dumper); err != nil {
+				return err
+			}
+			if err := applyHeaderMutations(ctx, l, name, reqActivation, rs.headerMutations); err != nil {
+				return err
+			}
+			var err error
+			store, err = applyStoreMutations(ctx, l, name, reqActivation, rs.storeMutations)
+			return err
+		})
+		// the evaluations timed out keep running in the background, so they must not touch the
+		// request once the next stages have it
+		reqActivation.close()
+		if err != nil {
 			return nil, err
 		}
 
-		resp, err := next(ctx, r)
-		if err != nil {
-			l.Debug(fmt.Sprintf("CEL: %s delegated execution failed: %s", name, err.Error()))
-			return resp, err
+		nextCtx := ctx
+		var tracker *backendTracker
+		if rs.trackBackends {
+			nextCtx, tracker = withBackendTracker(ctx)
+		}
+
+		start := time.Now()
+		resp, nextErr := next(nextCtx, r)
+		elapsed := time.Since(start)
+		if nextErr != nil {
+			logEvent(l, levelDebug, "delegated execution failed", LogFieldEndpoint, name, "elapsed", elapsed, "error", nextErr.Error())
+			// the partial aggregations are returned along with the merge error, so the rules
+			// checking the completed backends get the chance to reject them
+			if (tracker == nil && !rs.rejectIncomplete) || resp == nil {
+				return resp, nextErr
+			}
 		}
 
-		if err := evalChecks(l, name+"-post", newRespActivation(resp, now), postEvaluators); err != nil {
+		respOpts := respOptions{
+			now:       now,
+			elapsed:   elapsed,
+			constants: rs.opts.constants,
+			backends:  backends,
+			store:     store,
+		}
+		switch {
+		case tracker != nil:
+			respOpts.backendsCompleted = tracker.count()
+		case backends == 0:
+			// the pipe of a backend wraps a single one
+			respOpts.backends = 1
+			if resp != nil && resp.IsComplete {
+				respOpts.backendsCompleted = 1
+			}
+		}
+
+		err = tracePhase(ctx, SpanPost, name, len(rs.postEvaluators)+len(rs.dataMutations)+len(rs.respHeaderMutations)+len(rs.respStatusMutations), func(ctx context.Context) error {
+			if rs.rejectIncomplete {
+				if err := checkComplete(l, name, resp, nextErr); err != nil {
+					if rejection != nil {
+						return rejection(err)
+					}
+					return err
+				}
+			}
+			// the audited checks timing out keep running in the background, so they evaluate a
+			// snapshot of the response and they must not resolve it once it is returned
+			respActivation := newRespActivation(resp, respOpts)
+			respActivation.snapshot = rs.auditPost
+			err := evalChecks(ctx, l, name, internal.PhasePost, respActivation, rs.postEvaluators, rs.reportAll, rs.dumper)
+			respActivation.close()
+			if err != nil {
+				if rejection != nil {
+					return rejection(err)
+				}
+				return err
+			}
+			resp, err = applyDataMutations(ctx, l, name, resp, respOpts, rs.dataMutations)
+			if err != nil {
+				return err
+			}
+			resp, err = applyRespHeaderMutations(ctx, l, name, resp, respOpts, rs.respHeaderMutations)
+			if err != nil {
+				return err
+			}
+			resp, err = applyRespStatusMutations(ctx, l, name, resp, respOpts, rs.respStatusMutations)
+			return err
+		})
+		if err != nil {
 			return nil, err
 		}
+		return resp, nextErr
+	}
+}
+
+// checkComplete rejects the incomplete responses, logging why they are incomplete. The index of
+// the error is -1, since the check does not belong to any definition
+func checkComplete(l logging.Logger, pipe string, resp *proxy.Response, nextErr error) error {
+	if resp.IsComplete && nextErr == nil {
+		return nil
+	}
+	reason := "the response is not complete"
+	if nextErr != nil {
+		reason = "the response is partial: " + nextErr.Error()
+	}
+	logEvent(l, levelInfo, "incomplete response rejected", LogFieldEndpoint, pipe, LogFieldPhase, internal.PhasePost,
+		LogFieldOutcome, OutcomeReject, "reason", reason)
+	return CheckError{
+		Pipe:    pipe,
+		Phase:   internal.PhasePost,
+		Index:   -1,
+		Message: fmt.Sprintf("CEL: incomplete response rejected by %s", pipe),
+	}
+}
+
+// shouldSkip returns true if the skip condition accepts the request. The definitions are evaluated
+// when the condition fails, so a broken condition does not disable them. A condition timing out
+// keeps resolving the activation in the background, so the activation must be closed before the
+// request is passed to the next stages
+func shouldSkip(ctx context.Context, l logging.Logger, name string, args interface{}, ps []internal.Evaluator) bool {
+	for _, eval := range ps {
+		res, err := evaluate(ctx, eval, args)
+		if err != nil {
+			logEvent(l, levelWarning, "skip condition failed", LogFieldEndpoint, name, LogFieldPhase, internal.PhasePre, "error", logValue(eval, err))
+			return false
+		}
+		if v, ok := res.Value().(bool); ok && v {
+			return true
+		}
+	}
+	return false
+}
+
+// evalChecks evaluates the checks of the phase. When present, the dumper logs the activation of
+// the rejected requests
+func evalChecks(ctx context.Context, l logging.Logger, pipe, phase string, args interface{}, ps []internal.Evaluator, reportAll bool, dumper *activationDumper) error {
+	name := pipe + "-" + phase
+	var rejections []CheckError
+	for i, eval := range ps {
+		fields := []interface{}{LogFieldEndpoint, pipe, LogFieldPhase, phase, LogFieldDefinitionIndex, i, LogFieldExpression, eval.Source()}
+		if eval.Definition.Negate {
+			fields = append(fields, "negate", true)
+		}
+		res, applies, err := evalGuard(ctx, eval, args)
+		if !applies {
+			countOutcome(name, i, OutcomeSkip)
+			logEvent(l, levelDebug, "check skipped by its guard", append(fields, LogFieldOutcome, OutcomeSkip)...)
+			continue
+		}
+		if err == nil {
+			res, err = evaluate(ctx, eval, args)
+		}
+		// a check returning anything but a bool is a mistake of the rule, not a rejection
+		if err == nil && res.Type() != types.BoolType {
+			logEvent(l, levelError, "the check returned a "+res.Type().TypeName()+" instead of a bool", append(fields, "result", logValue(eval, res))...)
+			err = fmt.Errorf("unexpected result type %s", res.Type().TypeName())
+		}
+
+		// the audited checks timing out do not abort the request, unlike the cancelled requests
+		if isAborted(err) && !(eval.Definition.Audit && ctx.Err() == nil) {
+			countOutcome(name, i, OutcomeError)
+			logEvent(l, levelWarning, "check aborted", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			return CheckError{
+				Pipe:       pipe,
+				Phase:      phase,
+				Index:      i,
+				Expression: eval.Source(),
+				Message:    fmt.Sprintf("CEL: %s evaluator #%d aborted: %s", name, i, err.Error()),
+				Aborted:    true,
+			}
+		}
+
+		if err != nil && eval.Definition.FailOpen() {
+			countOutcome(name, i, OutcomeError)
+			logEvent(l, levelWarning, "check failed, skipping it", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			continue
+		}
+
+		// the negated checks reject the requests they match
+		if v, ok := boolResult(res); !ok || v == eval.Definition.Negate {
+			outcome := OutcomeReject
+			if err != nil {
+				outcome = OutcomeError
+			}
+			if eval.Definition.Audit {
+				countOutcome(name, i, OutcomeAudit)
+				logEvent(l, rejectLevel(eval.Definition), "check rejected in audit mode", append(fields, LogFieldOutcome, OutcomeAudit, "result", logValue(eval, res), "error", logValue(eval, err))...)
+				if dumper != nil {
+					logEvent(l, levelDebug, "activation of the rejected check", append(fields, "activation", dumper.dump(args))...)
+				}
+				continue
+			}
+			if eval.Redirect != nil {
+				if location, ok := redirectLocation(ctx, l, eval, args, fields); ok {
+					countOutcome(name, i, OutcomeRedirect)
+					logEvent(l, rejectLevel(eval.Definition), "check redirected", append(fields, LogFieldOutcome, OutcomeRedirect, "location", logValue(*eval.Redirect, location), "result", logValue(eval, res), "error", logValue(eval, err))...)
+					return RedirectError{CheckError: rejection(pipe, phase, i, eval), Location: location}
+				}
+			}
+			countOutcome(name, i, outcome)
+			logEvent(l, rejectLevel(eval.Definition), "check rejected", append(fields, LogFieldOutcome, outcome, "result", logValue(eval, res), "error", logValue(eval, err))...)
+			if dumper != nil {
+				logEvent(l, levelDebug, "activation of the rejected check", append(fields, "activation", dumper.dump(args))...)
+			}
+			r := rejection(pipe, phase, i, eval)
+			if !reportAll {
+				return r.withCode()
+			}
+			rejections = append(rejections, r)
+			continue
+		}
+		countOutcome(name, i, OutcomePass)
+		logEvent(l, levelDebug, "check passed", append(fields, LogFieldOutcome, OutcomePass)...)
+	}
+	return aggregateRejections(rejections)
+}
+
+// boolResult returns the value of the result of a check, if it is a bool. The aborted evaluations
+// have no result
+func boolResult(res ref.Val) (bool, bool) {
+	if res == nil {
+		return false, false
+	}
+	v, ok := res.Value().(bool)
+	return v, ok
+}
+
+// anyAudited returns true if any of the checks is in audit mode
+func anyAudited(evaluators []internal.Evaluator) bool {
+	for _, e := range evaluators {
+		if e.Definition.Audit {
+			return true
+		}
+	}
+	return false
+}
+
+// auditDefinitions returns a copy of the definitions with the audit mode set
+func auditDefinitions(definitions []internal.InterpretableDefinition) []internal.InterpretableDefinition {
+	res := make([]internal.InterpretableDefinition, len(definitions))
+	for i, def := range definitions {
+		def.Audit = true
+		res[i] = def
+	}
+	return res
+}
+
+// evalGuard evaluates the when expression of the check, if any, with the activation of the check.
+// The check only applies when the guard returns true, while the errors of the guard are handled
+// like the ones of the check
+func evalGuard(ctx context.Context, eval internal.Evaluator, args interface{}) (ref.Val, bool, error) {
+	if eval.Guard == nil {
+		return nil, true, nil
+	}
+	res, err := evaluate(ctx, *eval.Guard, args)
+	if isAborted(err) {
+		return res, true, err
+	}
+	if err != nil {
+		return res, true, fmt.Errorf("evaluating the guard: %s", err.Error())
+	}
+	v, ok := res.Value().(bool)
+	if !ok {
+		return res, true, fmt.Errorf("unexpected guard result type %s", res.Type().TypeName())
+	}
+	return res, v, nil
+}
+
+// redirectLocation evaluates the redirect expression of the failed check. When the evaluation
+// fails or it returns an empty location, the check rejects the request as the rest of them
+func redirectLocation(ctx context.Context, l logging.Logger, eval internal.Evaluator, args interface{}, fields []interface{}) (string, bool) {
+	res, err := evaluate(ctx, *eval.Redirect, args)
+	if err != nil {
+		logEvent(l, levelError, "redirect failed, rejecting the request", append(fields, "error", logValue(*eval.Redirect, err))...)
+		return "", false
+	}
+	location, ok := res.Value().(string)
+	if !ok || location == "" {
+		logEvent(l, levelError, "redirect without location, rejecting the request", append(fields, "result", logValue(*eval.Redirect, res))...)
+		return "", false
+	}
+	return location, true
+}
+
+// rejection returns the error for a check rejecting the request
+func rejection(pipe, phase string, index int, eval internal.Evaluator) CheckError {
+	msg := fmt.Sprintf("CEL: request aborted by the %s evaluator #%d of %s: %s", phase, index, pipe, eval.Source())
+	if eval.Definition.RejectMessage != "" {
+		msg = eval.Definition.RejectMessage
+	}
+	return CheckError{
+		Pipe:       pipe,
+		Phase:      phase,
+		Index:      index,
+		Expression: eval.Source(),
+		Message:    msg,
+		Code:       eval.Definition.StatusCode,
+	}
+}
+
+// aggregateRejections returns a single error listing the messages of all the rejections. The
+// index and the status code are the ones of the first rejection (declaring a status code)
+func aggregateRejections(rejections []CheckError) error {
+	switch len(rejections) {
+	case 0:
+		return nil
+	case 1:
+		return rejections[0].withCode()
+	}
+
+	res := rejections[0]
+	res.Rejections = rejections
+	msgs := make([]string, len(rejections))
+	for i, r := range rejections {
+		msgs[i] = r.Message
+		if res.Code == 0 {
+			res.Code = r.Code
+		}
+	}
+	res.Message = strings.Join(msgs, "; ")
+	return res.withCode()
+}
+
+var errEvalTimeout = errors.New("evaluation timeout")
+
+// evaluate runs the evaluator until it finishes, the timeout of its definition expires or the
+// context is done. In the last two cases, the evaluation keeps running in the background but its
+// result is discarded
+func evaluate(ctx context.Context, eval internal.Evaluator, args interface{}) (ref.Val, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if eval.References(internal.ContextKey) {
+		// the registered functions stop their work when the evaluation is aborted
+		fctx, cancel := context.WithTimeout(ctx, eval.Definition.EvalTimeout())
+		defer cancel()
+		if eval.Redacted {
+			// the messages of the log function can carry the redacted values
+			fctx = internal.WithRedactedLogs(fctx)
+		}
+		args = internal.WithContext(fctx, args)
+	}
+
+	type result struct {
+		val ref.Val
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		val, _, err := eval.Eval(args)
+		done <- result{val: val, err: err}
+	}()
+
+	timer := time.NewTimer(eval.Definition.EvalTimeout())
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.val, res.err
+	case <-timer.C:
+		return nil, errEvalTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// isAborted returns true if the evaluation did not finish, so the fail policy does not apply
+func isAborted(err error) bool {
+	return err == errEvalTimeout || err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// applyHeaderMutations sets the request headers with the results of the mod expressions. The
+// headers are copied before the first change, since the map can be shared with other requests.
+// The activation forgets the values derived from the headers after each change, so the next
+// mutations see the headers set by the previous ones
+func applyHeaderMutations(ctx context.Context, l logging.Logger, pipe string, a *reqActivation, ps []internal.Evaluator) error {
+	name := pipe + "-mod"
+	for i, eval := range ps {
+		res, err := evaluate(ctx, eval, a)
+		fields := []interface{}{LogFieldEndpoint, pipe, LogFieldPhase, internal.PhasePre, LogFieldDefinitionIndex, i, "mutation", "request_header"}
+		if isAborted(err) {
+			logEvent(l, levelWarning, "mutation aborted", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			return fmt.Errorf("CEL: %s mutation #%d aborted: %s", name, i, err.Error())
+		}
+
+		if err != nil && eval.Definition.FailOpen() {
+			logEvent(l, levelWarning, "mutation failed, skipping it", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			continue
+		}
+
+		v, ok := res.Value().(string)
+		if err != nil || !ok {
+			logEvent(l, levelInfo, "mutation rejected", append(fields, LogFieldOutcome, OutcomeReject, "result", logValue(eval, res), "error", logValue(eval, err))...)
+			return fmt.Errorf("CEL: request aborted by the %s mutation #%d: %s", name, i, eval.Source())
+		}
+		logEvent(l, levelDebug, "mutation applied", append(fields, LogFieldOutcome, OutcomePass, "result", logValue(eval, res))...)
+
+		a.setHeader(eval.Definition.Header, v)
+	}
+	return nil
+}
+
+// applyStoreMutations evaluates the store mutations against the request and returns the values
+// for the post phase, keyed by their name. The value of a mutation skipped by the open fail policy
+// is not stored
+func applyStoreMutations(ctx context.Context, l logging.Logger, pipe string, args interface{}, ps []internal.Evaluator) (map[string]interface{}, error) {
+	if len(ps) == 0 {
+		return nil, nil
+	}
+	store := make(map[string]interface{}, len(ps))
+	name := pipe + "-store"
+	for i, eval := range ps {
+		res, err := evaluate(ctx, eval, args)
+		fields := []interface{}{LogFieldEndpoint, pipe, LogFieldPhase, internal.PhasePre, LogFieldDefinitionIndex, i, "mutation", "store", "store", eval.Definition.Store}
+		if isAborted(err) {
+			logEvent(l, levelWarning, "mutation aborted", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			return nil, fmt.Errorf("CEL: %s mutation #%d aborted: %s", name, i, err.Error())
+		}
+
+		if err != nil && eval.Definition.FailOpen() {
+			logEvent(l, levelWarning, "mutation failed, skipping it", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			continue
+		}
+		if err != nil {
+			logEvent(l, levelInfo, "mutation rejected", append(fields, LogFieldOutcome, OutcomeReject, "result", logValue(eval, res), "error", logValue(eval, err))...)
+			return nil, fmt.Errorf("CEL: request aborted by the %s mutation #%d: %s", name, i, eval.Source())
+		}
+		logEvent(l, levelDebug, "mutation applied", append(fields, LogFieldOutcome, OutcomePass, "result", logValue(eval, res))...)
+		store[eval.Definition.Store] = internal.NativeValue(res)
+	}
+	return store, nil
+}
 
+// applyDataMutations replaces the data of the response with the results of the mod expressions.
+// Every mutation receives the data returned by the previous one. The response is copied, since
+// it can be shared with other requests
+func applyDataMutations(ctx context.Context, l logging.Logger, pipe string, resp *proxy.Response, opts respOptions, ps []internal.Evaluator) (*proxy.Response, error) {
+	if len(ps) == 0 {
 		return resp, nil
-	}, nil
+	}
+	mutated := *resp
+	name := pipe + "-mod"
+	for i, eval := range ps {
+		res, err := evaluate(ctx, eval, newRespActivation(&mutated, opts))
+		fields := []interface{}{LogFieldEndpoint, pipe, LogFieldPhase, internal.PhasePost, LogFieldDefinitionIndex, i, "mutation", "data"}
+		if isAborted(err) {
+			logEvent(l, levelWarning, "mutation aborted", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			return nil, fmt.Errorf("CEL: %s mutation #%d aborted: %s", name, i, err.Error())
+		}
+
+		if err != nil && eval.Definition.FailOpen() {
+			logEvent(l, levelWarning, "mutation failed, skipping it", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			continue
+		}
+
+		var data map[string]interface{}
+		if err == nil {
+			data, _ = internal.NativeValue(res).(map[string]interface{})
+		}
+		if data == nil {
+			logEvent(l, levelInfo, "mutation rejected", append(fields, LogFieldOutcome, OutcomeReject, "result", logValue(eval, res), "error", logValue(eval, err))...)
+			return nil, fmt.Errorf("CEL: response aborted by the %s mutation #%d: %s", name, i, eval.Source())
+		}
+		logEvent(l, levelDebug, "mutation applied", append(fields, LogFieldOutcome, OutcomePass, "result", logValue(eval, res))...)
+		mutated.Data = data
+	}
+	return &mutated, nil
+}
+
+// applyRespHeaderMutations sets and removes the response headers with the results of the mod
+// expressions. The headers are copied, since the map can be shared with other responses
+func applyRespHeaderMutations(ctx context.Context, l logging.Logger, pipe string, resp *proxy.Response, opts respOptions, ps []internal.Evaluator) (*proxy.Response, error) {
+	if len(ps) == 0 {
+		return resp, nil
+	}
+	mutated := *resp
+	mutated.Metadata.Headers = make(map[string][]string, len(resp.Metadata.Headers)+len(ps))
+	for k, vs := range resp.Metadata.Headers {
+		mutated.Metadata.Headers[k] = vs
+	}
+	name := pipe + "-mod"
+	for i, eval := range ps {
+		res, err := evaluate(ctx, eval, newRespActivation(&mutated, opts))
+		fields := []interface{}{LogFieldEndpoint, pipe, LogFieldPhase, internal.PhasePost, LogFieldDefinitionIndex, i, "mutation", "response_header"}
+		if isAborted(err) {
+			logEvent(l, levelWarning, "mutation aborted", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			return nil, fmt.Errorf("CEL: %s response header mutation #%d aborted: %s", name, i, err.Error())
+		}
+
+		if err != nil && eval.Definition.FailOpen() {
+			logEvent(l, levelWarning, "mutation failed, skipping it", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			continue
+		}
+
+		var changes map[string][]string
+		ok := false
+		if err == nil {
+			changes, ok = headerChanges(internal.NativeValue(res))
+		}
+		if !ok {
+			logEvent(l, levelInfo, "mutation rejected", append(fields, LogFieldOutcome, OutcomeReject, "result", logValue(eval, res), "error", logValue(eval, err))...)
+			return nil, fmt.Errorf("CEL: response aborted by the %s mutation #%d: %s", name, i, eval.Source())
+		}
+		logEvent(l, levelDebug, "mutation applied", append(fields, LogFieldOutcome, OutcomePass, "result", logValue(eval, res))...)
+
+		for k, vs := range changes {
+			for existing := range mutated.Metadata.Headers {
+				if strings.EqualFold(existing, k) {
+					delete(mutated.Metadata.Headers, existing)
+				}
+			}
+			if len(vs) > 0 {
+				mutated.Metadata.Headers[http.CanonicalHeaderKey(k)] = vs
+			}
+		}
+	}
+	return &mutated, nil
 }
 
-func evalChecks(l logging.Logger, name string, args map[string]interface{}, ps []cel.Program) error {
+// applyRespStatusMutations replaces the status code of the response with the results of the mod
+// expressions. The results out of the range of the HTTP status codes reject the response
+func applyRespStatusMutations(ctx context.Context, l logging.Logger, pipe string, resp *proxy.Response, opts respOptions, ps []internal.Evaluator) (*proxy.Response, error) {
+	if len(ps) == 0 {
+		return resp, nil
+	}
+	mutated := *resp
+	name := pipe + "-mod"
 	for i, eval := range ps {
-		res, _, err := eval.Eval(args)
-		resultMsg := fmt.Sprintf("CEL: %s evaluator #%d result: %v - err: %v", name, i, res, err)
+		res, err := evaluate(ctx, eval, newRespActivation(&mutated, opts))
+		fields := []interface{}{LogFieldEndpoint, pipe, LogFieldPhase, internal.PhasePost, LogFieldDefinitionIndex, i, "mutation", "response_status"}
+		if isAborted(err) {
+			logEvent(l, levelWarning, "mutation aborted", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			return nil, fmt.Errorf("CEL: %s response status mutation #%d aborted: %s", name, i, err.Error())
+		}
+
+		if err != nil && eval.Definition.FailOpen() {
+			logEvent(l, levelWarning, "mutation failed, skipping it", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			continue
+		}
+
+		var code types.Int
+		ok := false
+		if err == nil {
+			code, ok = res.(types.Int)
+		}
+		if !ok || !validStatusCode(code) {
+			logEvent(l, levelInfo, "mutation rejected", append(fields, LogFieldOutcome, OutcomeReject, "result", logValue(eval, res), "error", logValue(eval, err))...)
+			return nil, fmt.Errorf("CEL: response aborted by the %s mutation #%d: %s", name, i, eval.Source())
+		}
+		logEvent(l, levelDebug, "mutation applied", append(fields, LogFieldOutcome, OutcomePass, "result", logValue(eval, res))...)
+		mutated.Metadata.StatusCode = int(code)
+	}
+	return &mutated, nil
+}
+
+// validStatusCode returns true if the code is in the range of the HTTP status codes
+func validStatusCode(code types.Int) bool {
+	return code >= 100 && code <= 599
+}
 
-		if v, ok := res.Value().(bool); !ok || !v {
-			l.Info(resultMsg)
-			return fmt.Errorf("CEL: request aborted by %+v", eval)
+// headerChanges converts the result of a response header mutation into the values of each header.
+// Strings and lists of strings set the header, while null and empty lists remove it
+func headerChanges(v interface{}) (map[string][]string, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	res := make(map[string][]string, len(m))
+	for k, value := range m {
+		switch val := value.(type) {
+		case nil:
+			res[k] = nil
+		case string:
+			res[k] = []string{val}
+		case []interface{}:
+			vs := make([]string, len(val))
+			for i, e := range val {
+				s, ok := e.(string)
+				if !ok {
+					return nil, false
+				}
+				vs[i] = s
+			}
+			res[k] = vs
+		default:
+			return nil, false
 		}
-		l.Debug(resultMsg)
 	}
+	return res, true
+}
+
+// reqOptions contains the settings used for building the request activation
+type reqOptions struct {
+	jwt            jwtParser
+	body           bodyParser
+	trustedProxies int
+	constants      map[string]interface{}
+	parseJWT       bool
+	parseBody      bool
+	parseBodyFiles bool
+	readBodyBytes  bool
+}
+
+func newReqActivation(l logging.Logger, r *proxy.Request, now time.Time, opts reqOptions) *reqActivation {
+	return &reqActivation{
+		l:      l,
+		r:      r,
+		now:    now,
+		opts:   opts,
+		values: map[string]ref.Val{},
+	}
+}
+
+// reqActivation resolves the request identifiers on first access and keeps the resolved values,
+// so the token and the body are parsed at most once per request, no matter how many
+// pre-evaluators reference them. The evaluations timed out keep resolving names in the background,
+// so the access to the request and to the resolved values is serialized
+type reqActivation struct {
+	l      logging.Logger
+	r      *proxy.Request
+	now    time.Time
+	opts   reqOptions
+	mu     sync.Mutex
+	values map[string]ref.Val
+	// closed is set once the request is passed to the next stages, so the names not resolved
+	// before are not resolved anymore
+	closed bool
+	// headersCopied is set once the headers of the request are replaced by a copy
+	headersCopied bool
+	// prev is the sequence of the responses of the previous backends, if any
+	prev *sequence
+
+	jwtParsed bool
+	jwtHeader map[string]interface{}
+	jwtData   map[string]interface{}
+
+	bodyRead bool
+	body     []byte
+	bodySize int64
+	bodyOK   bool
+}
+
+// ResolveName implements the interpreter.Activation interface
+func (a *reqActivation) ResolveName(name string) (ref.Val, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if v, ok := a.values[name]; ok {
+		return v, true
+	}
+	if a.closed {
+		return nil, false
+	}
+	v, ok := a.resolve(name)
+	if !ok {
+		return nil, false
+	}
+	val := types.DefaultTypeAdapter.NativeToValue(v)
+	a.values[name] = val
+	return val, true
+}
+
+// Parent implements the interpreter.Activation interface
+func (a *reqActivation) Parent() interpreter.Activation {
 	return nil
 }
 
-func newReqActivation(l logging.Logger, r *proxy.Request, now string) map[string]interface{} {
-	jwtData := parseJWT(l, r)
-	bodyData := parseBody(l, r)
+// headerIdents are the request identifiers resolved from the headers
+var headerIdents = []string{
+	internal.PreKey + "_headers",
+	internal.PreKey + "_client_ip",
+	internal.PreKey + "_host",
+	internal.PreKey + "_scheme",
+	internal.PreKey + "_tls",
+	internal.PreKey + "_tls_version",
+	internal.PreKey + "_content_type",
+	internal.PreKey + "_cookies",
+	internal.PreKey + "_authorization",
+	internal.PreKey + "_grpc_metadata",
+}
+
+// close stops resolving the names not resolved yet. It waits for the names being resolved, so the
+// request is not read any more once it returns
+func (a *reqActivation) close() {
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+}
 
-	return map[string]interface{}{
-		internal.PreKey + "_method":      r.Method,
-		internal.PreKey + "_path":        r.Path,
-		internal.PreKey + "_params":      r.Params,
-		internal.PreKey + "_headers":     r.Headers,
-		internal.PreKey + "_querystring": r.Query,
-		internal.NowKey:                  now,
-		internal.PreKey + "_jwt":         /*nil*/ jwtData,
-		internal.PreKey + "_body":        /*nil*/ bodyData,
+// setHeader sets the header of the request, copying the headers before the first change since the
+// map can be shared with other requests. The resolved values depending on the headers are
+// dropped, so they are resolved again with the mutated ones. The token is not parsed again
+func (a *reqActivation) setHeader(name, value string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.headersCopied {
+		headers := make(map[string][]string, len(a.r.Headers)+1)
+		for k, vs := range a.r.Headers {
+			headers[k] = vs
+		}
+		a.r.Headers = headers
+		a.headersCopied = true
+	}
+	a.r.Headers[http.CanonicalHeaderKey(name)] = []string{value}
+	for _, ident := range headerIdents {
+		delete(a.values, ident)
 	}
 }
 
-func newRespActivation(r *proxy.Response, now string) map[string]interface{} {
-	return map[string]interface{}{
-		internal.PostKey + "_completed":        r.IsComplete,
-		internal.PostKey + "_metadata_status":  r.Metadata.StatusCode,
-		internal.PostKey + "_metadata_headers": r.Metadata.Headers,
-		internal.PostKey + "_data":             r.Data,
-		internal.NowKey:                        now,
+func (a *reqActivation) resolve(name string) (interface{}, bool) {
+	switch name {
+	case internal.PreKey + "_method":
+		// the methods are conventionally uppercase, but some clients send them lowercased
+		return strings.ToUpper(a.r.Method), true
+	case internal.PreKey + "_path":
+		return a.r.Path, true
+	case internal.PreKey + "_path_segments":
+		return pathSegments(a.r.Path), true
+	case internal.PreKey + "_params":
+		return a.r.Params, true
+	case internal.PreKey + "_headers":
+		return a.r.Headers, true
+	case internal.PreKey + "_querystring":
+		return a.r.Query, true
+	case internal.PreKey + "_client_ip":
+		return clientIP(a.r.Headers, a.opts.trustedProxies), true
+	case internal.PreKey + "_host":
+		return requestHost(a.r.Headers), true
+	case internal.PreKey + "_scheme":
+		return requestScheme(a.r.Headers), true
+	case internal.PreKey + "_tls":
+		return requestTLS(a.r.Headers), true
+	case internal.PreKey + "_tls_version":
+		return requestTLSVersion(a.r.Headers), true
+	case internal.PreKey + "_content_type":
+		return mediaType(a.r.Headers), true
+	case internal.PreKey + "_cookies":
+		return cookies(a.r.Headers), true
+	case internal.PreKey + "_authorization":
+		return authorization(a.r.Headers), true
+	case internal.PreKey + "_grpc_metadata":
+		return grpcMetadata(a.r.Headers), true
+	case internal.PreKey + "_prev_resp":
+		return a.prev.data(), true
+	case internal.NowKey:
+		return nowTimestamp(a.now), true
+	case internal.NowUnixKey:
+		return a.now.Unix(), true
+	case internal.PreKey + "_jwt":
+		a.parseJWT()
+		return a.jwtData, true
+	case internal.PreKey + "_jwt_header":
+		a.parseJWT()
+		return a.jwtHeader, true
+	case internal.PreKey + "_body":
+		var bodyData map[string]interface{}
+		if a.opts.parseBody && len(a.r.Headers[contentTypeHeader]) > 0 {
+			if b, ok := a.readBody(); ok {
+				bodyData = a.opts.body.decode(a.l, a.r, b)
+			}
+		}
+		return bodyData, true
+	case internal.PreKey + "_body_files":
+		var files map[string]interface{}
+		if a.opts.parseBodyFiles && len(a.r.Headers[contentTypeHeader]) > 0 {
+			if b, ok := a.readBody(); ok {
+				files = a.opts.body.decodeFiles(a.l, a.r, b)
+			}
+		}
+		return files, true
+	case internal.PreKey + "_body_raw":
+		var raw string
+		if a.opts.readBodyBytes {
+			if b, ok := a.readBody(); ok {
+				raw = string(b)
+			}
+		}
+		return raw, true
+	case internal.PreKey + "_body_size":
+		var size int64
+		if a.opts.readBodyBytes {
+			a.readBody()
+			size = a.bodySize
+		}
+		return size, true
+	case internal.PreKey + "_body_b64":
+		var encoded string
+		if a.opts.readBodyBytes {
+			if b, ok := a.readBody(); ok {
+				encoded = a.opts.body.encodeB64(b)
+			}
+		}
+		return encoded, true
 	}
+	v, ok := a.opts.constants[name]
+	return v, ok
 }
 
-var timeNow = time.Now
+// readBody reads the body once, since req_body, req_body_raw and the rest of body values are built
+// from its bytes
+func (a *reqActivation) readBody() ([]byte, bool) {
+	if !a.bodyRead {
+		a.bodyRead = true
+		a.body, a.bodySize, a.bodyOK = a.opts.body.read(a.l, a.r)
+	}
+	return a.body, a.bodyOK
+}
 
-func parseJWT(l logging.Logger, r *proxy.Request) map[string]interface{} {
-	var jwtData map[string]interface{}
-	if len(r.Headers[authHeader]) == 0 {
-		return nil
+// parseJWT decodes the token once, since both the header and the claims are extracted from it
+func (a *reqActivation) parseJWT() {
+	if a.jwtParsed {
+		return
 	}
-	jwt := r.Headers[authHeader][0]
-	if strings.HasPrefix(jwt, tokenPrefix) {
-		jwt = jwt[len(tokenPrefix):]
-	} else {
-		l.Debug("Auth header found but without token prefix \"%v\"", tokenPrefix)
-		return nil
+	a.jwtParsed = true
+	if a.opts.parseJWT {
+		a.jwtHeader, a.jwtData = a.opts.jwt.parse(a.l, a.r)
 	}
-	jwtParts := strings.Split(jwt, ".")
-	if len(jwtParts) < 3 {
-		l.Error("%v token found, but with %d parts", tokenPrefix, len(jwtParts))
-		return nil
+}
+
+// pipeConstants returns the values shared by all the requests of the pipe: the vars and the endpoint
+func pipeConstants(vars internal.Vars, endpoint string) map[string]interface{} {
+	res := map[string]interface{}{internal.EndpointKey: endpoint}
+	for k, v := range vars.Values() {
+		res[k] = v
 	}
-	data, err := base64.RawURLEncoding.DecodeString(jwtParts[1])
-	if err != nil {
-		l.Error("Decode jwt: %v", err.Error())
-		return nil
-	} else {
-		if err := json.Unmarshal([]byte(data), &jwtData); err != nil {
-			l.Error("Unmarshal jwt: %v", err.Error())
-			return nil
+	return res
+}
+
+var (
+	errRespBodyRawDisabled = errors.New("resp_body_raw is referenced but not enabled")
+	errReqBodyB64Disabled  = errors.New("req_body_b64 is referenced but not enabled")
+)
+
+// respOptions contains the values, besides the response, used for building the response activation
+type respOptions struct {
+	now time.Time
+	// elapsed is the duration of the execution of the next proxy
+	elapsed           time.Duration
+	constants         map[string]interface{}
+	backends          int
+	backendsCompleted int
+	// store are the values set by the store mutations of the pre phase
+	store map[string]interface{}
+}
+
+// newRespActivation returns the values available to the post-evaluators, including the constants
+// of the pipe
+func newRespActivation(r *proxy.Response, opts respOptions) *respActivation {
+	return &respActivation{
+		r:      r,
+		opts:   opts,
+		values: map[string]ref.Val{},
+	}
+}
+
+// respActivation resolves the response identifiers on first access and keeps the resolved values,
+// like the reqActivation. Serializing the data is expensive, so it is only done when the values
+// depending on it are referenced, and at most once
+type respActivation struct {
+	r      *proxy.Response
+	opts   respOptions
+	mu     sync.Mutex
+	values map[string]ref.Val
+	closed bool
+	// snapshot resolves copies of the data and the headers, so the evaluations abandoned after
+	// the response is returned do not read the maps written by the next stages
+	snapshot bool
+
+	serialized bool
+	raw        []byte
+	rawErr     error
+}
+
+// ResolveName implements the interpreter.Activation interface
+func (a *respActivation) ResolveName(name string) (ref.Val, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if v, ok := a.values[name]; ok {
+		return v, true
+	}
+	if a.closed {
+		return nil, false
+	}
+	v, ok := a.resolve(name)
+	if !ok {
+		return nil, false
+	}
+	val, ok := v.(ref.Val)
+	if !ok {
+		val = types.DefaultTypeAdapter.NativeToValue(v)
+	}
+	a.values[name] = val
+	return val, true
+}
+
+// Parent implements the interpreter.Activation interface
+func (a *respActivation) Parent() interpreter.Activation {
+	return nil
+}
+
+// close stops resolving the identifiers, like the reqActivation one. It waits for the resolution
+// in progress, so the response is not read once it returns
+func (a *respActivation) close() {
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+}
+
+func (a *respActivation) resolve(name string) (interface{}, bool) {
+	switch name {
+	case internal.PostKey + "_completed":
+		return a.r.IsComplete, true
+	case internal.PostKey + "_metadata_status":
+		return a.r.Metadata.StatusCode, true
+	case internal.PostKey + "_metadata_headers":
+		if a.snapshot {
+			return copyHeaders(a.r.Metadata.Headers), true
+		}
+		return a.r.Metadata.Headers, true
+	case internal.PostKey + "_content_type":
+		return mediaType(a.r.Metadata.Headers), true
+	case internal.PostKey + "_data":
+		if a.snapshot {
+			return copyData(a.r.Data), true
+		}
+		return a.r.Data, true
+	case internal.PostKey + "_duration_ms":
+		return int64(a.opts.elapsed / time.Millisecond), true
+	case internal.PostKey + "_backends":
+		return a.opts.backends, true
+	case internal.PostKey + "_backends_completed":
+		return a.opts.backendsCompleted, true
+	case internal.PostKey + "_data_size":
+		b, err := a.serialize()
+		if err != nil {
+			return types.NewErr("serializing the response data: %s", err.Error()), true
+		}
+		return types.Int(len(b)), true
+	case internal.PostKey + "_body_raw":
+		b, err := a.serialize()
+		if err != nil {
+			return types.NewErr("serializing the response data: %s", err.Error()), true
+		}
+		return types.String(b), true
+	case internal.NowKey:
+		return nowTimestamp(a.opts.now), true
+	case internal.NowUnixKey:
+		return a.opts.now.Unix(), true
+	case internal.StoreKey:
+		if a.opts.store == nil {
+			return map[string]interface{}{}, true
 		}
+		return a.opts.store, true
 	}
-	return jwtData
+	v, ok := a.opts.constants[name]
+	return v, ok
 }
 
-func parseBody(l logging.Logger, r *proxy.Request) map[string]interface{} {
-	bodyData := make(map[string]interface{})
-	if len(r.Headers[contentTypeHeader]) == 0 {
-		return nil
+func (a *respActivation) serialize() ([]byte, error) {
+	if !a.serialized {
+		a.serialized = true
+		a.raw, a.rawErr = json.Marshal(a.r.Data)
 	}
-	if r.Body == nil {
-		return nil
+	return a.raw, a.rawErr
+}
+
+// copyData returns a deep copy of the maps and the lists of the data, leaving the rest of values
+// untouched
+func copyData(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			res[k] = copyData(e)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = copyData(e)
+		}
+		return res
 	}
-	bodyBytes, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		l.Error("Read body: %v", err.Error())
-		return nil
+	return v
+}
+
+// copyHeaders returns a copy of the headers and their values
+func copyHeaders(headers map[string][]string) map[string][]string {
+	res := make(map[string][]string, len(headers))
+	for k, vs := range headers {
+		res[k] = append([]string(nil), vs...)
 	}
-	r.Body.Close()
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
-	//fmt.Printf("BODY BYTES: %v\n", string(bodyBytes))
-	if strings.Contains(r.Headers[contentTypeHeader][0], contentTypeJson) {
-		if err := json.Unmarshal(bodyBytes, &bodyData); err != nil {
-			l.Error("Unmarshal body: %v", err.Error())
-			return nil
+	return res
+}
+
+var timeNow = time.Now
+
+// nowTimestamp converts the time into the protobuf timestamp, so the expressions can operate it
+// as a CEL timestamp
+func nowTimestamp(now time.Time) *timestamp.Timestamp {
+	ts, _ := ptypes.TimestampProto(now.UTC())
+	return ts
+}
+
+// clientIP returns the address of the client. The X-Forwarded-For header has precedence over the
+// X-Real-Ip one. When the gateway is behind trustedProxies proxies, the entries added by them are
+// discarded and the one added by the first trusted proxy is returned, so the entries forged by the
+// client are ignored. Without trusted proxies, the first hop of the X-Forwarded-For is returned.
+func clientIP(headers map[string][]string, trustedProxies int) string {
+	hops := []string{}
+	for _, v := range headerValues(headers, forwardedForHeader) {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
 		}
-	} else if strings.Contains(r.Headers[contentTypeHeader][0], contentTypeForm) {
-		newBodyReader := ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
-		req := http.Request{Method: r.Method, Header: r.Headers, Body: newBodyReader}
-		if err = req.ParseMultipartForm(32*1024*1024); err != nil {
-			l.Error("ParseForm: %v", err.Error())
-			return nil
+	}
+
+	var ip string
+	switch {
+	case len(hops) == 0:
+		vs := headerValues(headers, realIPHeader)
+		if len(vs) == 0 {
+			return ""
 		}
-		newBodyReader.Close()
-		for key, values := range req.MultipartForm.Value {
-			if len(values) > 0 {
-				bodyData[key] = values[0]
+		ip = strings.TrimSpace(vs[0])
+	case trustedProxies <= 0 || trustedProxies > len(hops):
+		ip = hops[0]
+	default:
+		ip = hops[len(hops)-trustedProxies]
+	}
+
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
+
+// requestHost returns the lowercased host requested by the client, without port. The
+// X-Forwarded-Host header wins over the Host one when both are present, since the Host received
+// by the gateway is the one of the last proxy
+func requestHost(headers map[string][]string) string {
+	host := firstHeaderEntry(headers, forwardedHostHeader)
+	if host == "" {
+		host = firstHeaderEntry(headers, hostHeader)
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// requestScheme returns the scheme declared by the X-Forwarded-Proto header, defaulting to http
+// when the header is missing or it does not contain a valid scheme
+func requestScheme(headers map[string][]string) string {
+	switch scheme := strings.ToLower(firstHeaderEntry(headers, forwardedProtoHeader)); scheme {
+	case "http", "https":
+		return scheme
+	}
+	return "http"
+}
+
+// requestTLS returns true if the proxies in front of the gateway declare the request arrived over
+// TLS: with a TLS version, with the https scheme in the X-Forwarded-Proto header or with the
+// X-Forwarded-Ssl header set to on
+func requestTLS(headers map[string][]string) bool {
+	return requestTLSVersion(headers) != "" || requestScheme(headers) == "https" ||
+		strings.EqualFold(firstHeaderEntry(headers, forwardedSSLHeader), "on")
+}
+
+var tlsVersionPattern = regexp.MustCompile(`^(?i)(tls|ssl)\s*v?\s*([0-9](\.[0-9])?)$`)
+
+// requestTLSVersion returns the version of TLS declared by the first of the tlsVersionHeaders
+// present, or an empty string. The usual spellings (TLSv1.2, TLS 1.2, tls1.2) are normalized to
+// the OpenSSL one, TLSv1.2, and the rest of values are returned as sent
+func requestTLSVersion(headers map[string][]string) string {
+	for _, name := range tlsVersionHeaders {
+		v := firstHeaderEntry(headers, name)
+		if v == "" {
+			continue
+		}
+		if m := tlsVersionPattern.FindStringSubmatch(v); m != nil {
+			return strings.ToUpper(m[1]) + "v" + m[2]
+		}
+		return v
+	}
+	return ""
+}
+
+// mediaType returns the lowercased media type of the Content-Type header, without its parameters,
+// or an empty string when the header is missing or malformed. The name of the header is looked up
+// ignoring its case
+func mediaType(headers map[string][]string) string {
+	vs := headerValues(headers, contentTypeHeader)
+	if len(vs) == 0 {
+		for k, v := range headers {
+			if strings.EqualFold(k, contentTypeHeader) {
+				vs = v
+				break
 			}
 		}
 	}
-	return bodyData
-}
\ No newline at end of file
+	if len(vs) == 0 {
+		return ""
+	}
+	mt, _, _ := mime.ParseMediaType(vs[0])
+	return mt
+}
+
+// firstHeaderEntry returns the first entry of the comma separated values of the header
+func firstHeaderEntry(headers map[string][]string, name string) string {
+	vs := headerValues(headers, name)
+	if len(vs) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(vs[0], ",", 2)[0])
+}
+
+// authorization returns the first value of the Authorization header, untouched, since the
+// parameters of some schemes, like Digest, are separated by commas
+func authorization(headers map[string][]string) string {
+	vs := headerValues(headers, authHeader)
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[0]
+}
+
+// cookies returns the values of the cookies declared in all the Cookie headers. When a cookie is
+// declared several times, the last value is returned. The values are strings, but the map is not
+// a map[string]string because the CEL adapter of those maps panics with the 'in' operator
+func cookies(headers map[string][]string) map[string]interface{} {
+	req := http.Request{Header: http.Header{"Cookie": headerValues(headers, "Cookie")}}
+	res := map[string]interface{}{}
+	for _, c := range req.Cookies() {
+		res[c.Name] = c.Value
+	}
+	return res
+}
+
+// grpcMetadataPrefix is the prefix of the headers forwarded as gRPC metadata by the HTTP to gRPC
+// transcoders, following the convention of grpc-gateway
+const grpcMetadataPrefix = "grpc-metadata-"
+
+// grpcMetadata returns the values of the headers carrying gRPC metadata, keyed by the lowercase
+// name of the metadata (the name of the header without the prefix), as gRPC does
+func grpcMetadata(headers map[string][]string) map[string][]string {
+	res := map[string][]string{}
+	for k, vs := range headers {
+		name := strings.ToLower(k)
+		if !strings.HasPrefix(name, grpcMetadataPrefix) || len(name) == len(grpcMetadataPrefix) {
+			continue
+		}
+		name = name[len(grpcMetadataPrefix):]
+		res[name] = append(res[name], vs...)
+	}
+	return res
+}
+
+// pathSegments splits the path into its non-empty segments, so the root path has no segments and
+// the repeated or trailing slashes are ignored. The segments are percent-decoded after splitting
+// the path, so an encoded slash does not start a new segment. Segments with invalid escapes are
+// returned as they are
+func pathSegments(path string) []string {
+	res := []string{}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		if v, err := url.PathUnescape(segment); err == nil {
+			segment = v
+		}
+		res = append(res, segment)
+	}
+	return res
+}
@@ -3,6 +3,7 @@ package cel
 import (
 	"bytes"
 	"context"
+	"io/ioutil"
 	"strconv"
 	"testing"
 
@@ -46,3 +47,84 @@ func BenchmarkProxyFactory_reqParams_int(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkProxyFactory_reqBody(b *testing.B) {
+	body := []byte(`{"user":"alice","roles":["admin","editor"],"profile":{"name":"Alice","age":42}}`)
+	token := unsignedToken(map[string]interface{}{"alg": "RS256"}, map[string]interface{}{"sub": "alice"}) + "sig"
+
+	for _, tc := range []struct {
+		name string
+		expr string
+	}{
+		{name: "unreferenced", expr: "req_method == 'POST'"},
+		{name: "body", expr: "req_body.user == 'alice'"},
+		{name: "jwt", expr: "req_jwt.sub == 'alice'"},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(&config.EndpointConfig{
+				Endpoint: "/",
+				ExtraConfig: config.ExtraConfig{
+					internal.Namespace: []internal.InterpretableDefinition{{CheckExpression: tc.expr}},
+				},
+			})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				prxy(context.Background(), &proxy.Request{
+					Method: "POST",
+					Path:   "/some-path",
+					Headers: map[string][]string{
+						"Content-Type":  {"application/json"},
+						"Authorization": {"Bearer " + token},
+					},
+					Body: ioutil.NopCloser(bytes.NewReader(body)),
+				})
+			}
+		})
+	}
+}
+
+func BenchmarkProxyFactory_resp(b *testing.B) {
+	resp := &proxy.Response{
+		Data:       map[string]interface{}{"status": "ok", "items": []interface{}{"a", "b", "c"}},
+		IsComplete: true,
+		Metadata:   proxy.Metadata{StatusCode: 200, Headers: map[string][]string{"Content-Type": {"application/json"}}},
+	}
+
+	for _, tc := range []struct {
+		name string
+		expr string
+	}{
+		{name: "completed", expr: "resp_completed"},
+		{name: "data", expr: "resp_data.status == 'ok'"},
+		{name: "size", expr: "resp_data_size < 1024"},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(resp)).New(&config.EndpointConfig{
+				Endpoint: "/",
+				ExtraConfig: config.ExtraConfig{
+					internal.Namespace: []internal.InterpretableDefinition{{CheckExpression: tc.expr}},
+				},
+			})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				prxy(context.Background(), &proxy.Request{
+					Method:  "GET",
+					Path:    "/some-path",
+					Headers: map[string][]string{},
+				})
+			}
+		})
+	}
+}
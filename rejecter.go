@@ -1,13 +1,11 @@
 package cel
 
 import (
-	"fmt"
-	"time"
+	"context"
 
 	"github.com/devopsfaith/krakend-cel/internal"
 	"github.com/devopsfaith/krakend/config"
 	"github.com/devopsfaith/krakend/logging"
-	"github.com/google/cel-go/cel"
 )
 
 func NewRejecter(l logging.Logger, cfg *config.EndpointConfig) *Rejecter {
@@ -16,8 +14,26 @@ func NewRejecter(l logging.Logger, cfg *config.EndpointConfig) *Rejecter {
 		return nil
 	}
 
-	p := internal.NewCheckExpressionParser(l)
-	evaluators, err := p.ParseJWT(def)
+	vars, err := internal.NewVars(def.Vars)
+	if err != nil {
+		l.Debug("CEL: error building the JWT rejecter:", err.Error())
+		return nil
+	}
+	lists, err := internal.NewLists(def.Lists)
+	if err != nil {
+		l.Debug("CEL: error building the JWT rejecter:", err.Error())
+		return nil
+	}
+	schemas, err := internal.NewSchemas(def.Schemas)
+	if err != nil {
+		l.Debug("CEL: error building the JWT rejecter:", err.Error())
+		return nil
+	}
+	if def.Audit {
+		def.Definitions = auditDefinitions(def.Definitions)
+	}
+	p := internal.NewCheckExpressionParser(l).WithVars(vars).WithLists(lists).WithSchemas(schemas).WithRedacted(def.LogRedactKeys()).WithFeatures(currentFeatures())
+	evaluators, err := p.ParseJWT(def.Definitions)
 	if err != nil {
 		l.Debug("CEL: error building the JWT rejecter:", err.Error())
 		return nil
@@ -27,30 +43,66 @@ func NewRejecter(l logging.Logger, cfg *config.EndpointConfig) *Rejecter {
 		name:       cfg.Endpoint,
 		evaluators: evaluators,
 		logger:     l,
+		constants:  pipeConstants(vars, cfg.Endpoint),
 	}
 }
 
+// rejecterPhase is the phase of the logs of the rejecter, which evaluates the claims of the token
+const rejecterPhase = "jwt"
+
 type Rejecter struct {
 	name       string
-	evaluators []cel.Program
+	evaluators []internal.Evaluator
 	logger     logging.Logger
+	constants  map[string]interface{}
 }
 
 func (r *Rejecter) Reject(data map[string]interface{}) bool {
-	now := timeNow().Format(time.RFC3339)
+	now := timeNow()
 	reqActivation := map[string]interface{}{
-		internal.JwtKey: data,
-		internal.NowKey: now,
+		internal.JwtKey:     data,
+		internal.NowKey:     nowTimestamp(now),
+		internal.NowUnixKey: now.Unix(),
 	}
+	for k, v := range r.constants {
+		reqActivation[k] = v
+	}
+	name := "rejecter " + r.name
 	for i, eval := range r.evaluators {
-		res, _, err := eval.Eval(reqActivation)
-		resultMsg := fmt.Sprintf("CEL: %s rejecter #%d result: %v - err: %v", r.name, i, res, err)
+		fields := []interface{}{LogFieldEndpoint, name, LogFieldPhase, rejecterPhase, LogFieldDefinitionIndex, i, LogFieldExpression, eval.Source()}
+		if eval.Definition.Negate {
+			fields = append(fields, "negate", true)
+		}
+		res, err := evaluate(context.Background(), eval, reqActivation)
+
+		if isAborted(err) {
+			countOutcome(name, i, OutcomeError)
+			logEvent(r.logger, levelWarning, "check aborted", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			return true
+		}
+
+		if err != nil && eval.Definition.FailOpen() {
+			countOutcome(name, i, OutcomeError)
+			logEvent(r.logger, levelWarning, "check failed, skipping it", append(fields, LogFieldOutcome, OutcomeError, "error", logValue(eval, err))...)
+			continue
+		}
 
-		if v, ok := res.Value().(bool); !ok || !v {
-			r.logger.Info(resultMsg)
+		if v, ok := boolResult(res); !ok || v == eval.Definition.Negate {
+			if eval.Definition.Audit {
+				countOutcome(name, i, OutcomeAudit)
+				logEvent(r.logger, rejectLevel(eval.Definition), "check rejected in audit mode", append(fields, LogFieldOutcome, OutcomeAudit, "result", logValue(eval, res), "error", logValue(eval, err))...)
+				continue
+			}
+			outcome := OutcomeReject
+			if err != nil {
+				outcome = OutcomeError
+			}
+			countOutcome(name, i, outcome)
+			logEvent(r.logger, rejectLevel(eval.Definition), "check rejected", append(fields, LogFieldOutcome, outcome, "result", logValue(eval, res), "error", logValue(eval, err))...)
 			return true
 		}
-		r.logger.Debug(resultMsg)
+		countOutcome(name, i, OutcomePass)
+		logEvent(r.logger, levelDebug, "check passed", append(fields, LogFieldOutcome, OutcomePass)...)
 	}
 	return false
 }
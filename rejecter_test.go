@@ -77,3 +77,69 @@ func TestRejecter_Reject(t *testing.T) {
 		}
 	}
 }
+
+func TestRejecter_Reject_negateAndAudit(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		def      internal.InterpretableDefinition
+		data     map[string]interface{}
+		expected bool
+	}{
+		{name: "negated match", def: internal.InterpretableDefinition{CheckExpression: "JWT.role == 'banned'", Negate: true}, data: map[string]interface{}{"role": "banned"}, expected: true},
+		{name: "negated miss", def: internal.InterpretableDefinition{CheckExpression: "JWT.role == 'banned'", Negate: true}, data: map[string]interface{}{"role": "admin"}, expected: false},
+		{name: "audited", def: internal.InterpretableDefinition{CheckExpression: "JWT.role == 'admin'", Audit: true}, data: map[string]interface{}{"role": "guest"}, expected: false},
+	} {
+		rejecter := NewRejecter(logging.NoOp, &config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{tc.def}},
+		})
+		if rejecter == nil {
+			t.Errorf("%s: nil rejecter", tc.name)
+			continue
+		}
+		if res := rejecter.Reject(tc.data); res != tc.expected {
+			t.Errorf("%s: unexpected result %v", tc.name, res)
+		}
+	}
+}
+
+func TestRejecter_Reject_logFields(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		def     internal.InterpretableDefinition
+		data    map[string]interface{}
+		msg     string
+		outcome string
+	}{
+		{name: "passed", def: internal.InterpretableDefinition{CheckExpression: "JWT.role == 'admin'"}, data: map[string]interface{}{"role": "admin"}, msg: "CEL: check passed", outcome: OutcomePass},
+		{name: "rejected", def: internal.InterpretableDefinition{CheckExpression: "JWT.role == 'admin'"}, data: map[string]interface{}{"role": "guest"}, msg: "CEL: check rejected", outcome: OutcomeReject},
+		{name: "failed", def: internal.InterpretableDefinition{CheckExpression: "JWT.role == 'admin'"}, data: map[string]interface{}{}, msg: "CEL: check rejected", outcome: OutcomeError},
+		{name: "audited", def: internal.InterpretableDefinition{CheckExpression: "JWT.role == 'admin'", Audit: true}, data: map[string]interface{}{"role": "guest"}, msg: "CEL: check rejected in audit mode", outcome: OutcomeAudit},
+		{name: "fail open", def: internal.InterpretableDefinition{CheckExpression: "JWT.role == 'admin'", FailPolicy: internal.FailPolicyOpen}, data: map[string]interface{}{}, msg: "CEL: check failed, skipping it", outcome: OutcomeError},
+	} {
+		l := &fieldLogger{}
+		rejecter := NewRejecter(l, &config.EndpointConfig{
+			Endpoint:    "/foo",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{tc.def}},
+		})
+		if rejecter == nil {
+			t.Errorf("%s: nil rejecter", tc.name)
+			continue
+		}
+		rejecter.Reject(tc.data)
+
+		if len(l.entries) != 1 {
+			t.Errorf("%s: unexpected entries: %+v", tc.name, l.entries)
+			continue
+		}
+		e := l.entries[0]
+		if e.msg != tc.msg {
+			t.Errorf("%s: unexpected message %q", tc.name, e.msg)
+		}
+		if e.fields[LogFieldEndpoint] != "rejecter /foo" || e.fields[LogFieldPhase] != rejecterPhase ||
+			e.fields[LogFieldDefinitionIndex] != 0 || e.fields[LogFieldExpression] != tc.def.CheckExpression ||
+			e.fields[LogFieldOutcome] != tc.outcome {
+			t.Errorf("%s: unexpected fields: %+v", tc.name, e.fields)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package cel
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+// InterpretableDefinition is a definition of a rule, as declared in the extra config
+type InterpretableDefinition = internal.InterpretableDefinition
+
+// ReloadableProxy evaluates the definitions of an endpoint around the next proxy, like the ones
+// built by the ProxyFactory, but its definitions can be replaced without restarting the gateway
+type ReloadableProxy struct {
+	l        logging.Logger
+	name     string
+	endpoint string
+	backends int
+	cfg      internal.Config
+	rules    atomic.Value
+	prxy     proxy.Proxy
+}
+
+var errNoConfig = errors.New("the endpoint has no valid CEL config")
+
+// NewReloadableProxy returns a ReloadableProxy wrapping the next proxy with the CEL config of the
+// endpoint. The config is required, since its options (vars, JWT settings, limits...) are kept
+// across the reloads and only the definitions are replaced. A missing or malformed config returns
+// an error
+func NewReloadableProxy(l logging.Logger, cfg *config.EndpointConfig, next proxy.Proxy) (*ReloadableProxy, error) {
+	def, ok := internal.ConfigGetter(cfg.ExtraConfig)
+	if !ok {
+		return nil, errNoConfig
+	}
+	p := &ReloadableProxy{
+		l:        l,
+		name:     "proxy " + cfg.Endpoint,
+		endpoint: cfg.Endpoint,
+		backends: len(cfg.Backend),
+		cfg:      def,
+	}
+	if isSequential(cfg) {
+		next = withSequence(next)
+	}
+	p.prxy = rulesProxy(l, p.name, p.backends, p.current, next, nil)
+	if def.ErrorBody != nil {
+		if !errorStatusRegistered() {
+			return nil, errErrorStatus
+		}
+		p.prxy = errorBodyProxy(*def.ErrorBody, p.prxy)
+	}
+	if err := p.Reload(def.Definitions); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload compiles the definitions and replaces the current ones. When the definitions are invalid,
+// the current ones are kept and the error is returned. The requests in flight complete with the
+// definitions they started with
+func (p *ReloadableProxy) Reload(definitions []InterpretableDefinition) error {
+	cfg := p.cfg
+	cfg.Definitions = definitions
+	cfg, err := withGroups(cfg)
+	var rs *ruleSet
+	if err == nil {
+		rs, err = newRuleSet(p.l, p.name, p.endpoint, p.backends, cfg)
+	}
+	if err != nil {
+		p.l.Error("CEL: error reloading the definitions for pipe", p.endpoint, ":", err.Error())
+		return err
+	}
+	p.rules.Store(rs)
+	p.l.Info("CEL: definitions reloaded for pipe", p.endpoint)
+	return nil
+}
+
+// Proxy evaluates the current definitions around the next proxy
+func (p *ReloadableProxy) Proxy(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+	return p.prxy(ctx, r)
+}
+
+// Summary returns the counts of the evaluators of the current definitions
+func (p *ReloadableProxy) Summary() PipeSummary {
+	return p.current().summary
+}
+
+func (p *ReloadableProxy) current() *ruleSet {
+	return p.rules.Load().(*ruleSet)
+}
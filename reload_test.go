@@ -0,0 +1,95 @@
+package cel
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestReloadableProxy(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	next := func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) { return expectedResponse, nil }
+	cfg := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: map[string]interface{}{
+			"vars":        map[string]interface{}{"method": "GET"},
+			"definitions": []internal.InterpretableDefinition{{CheckExpression: "req_method == method"}},
+		}},
+	}
+	p, err := NewReloadableProxy(logging.NoOp, cfg, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(method string) error {
+		_, err := p.Proxy(context.Background(), &proxy.Request{Method: method, Path: "/"})
+		return err
+	}
+	if err := call("GET"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := call("POST"); err == nil {
+		t.Error("expecting error")
+	}
+
+	// the vars of the config are kept
+	if err := p.Reload([]InterpretableDefinition{{CheckExpression: "req_method != method"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := call("GET"); err == nil {
+		t.Error("expecting error after the reload")
+	}
+	if err := call("POST"); err != nil {
+		t.Errorf("unexpected error after the reload: %v", err)
+	}
+
+	// invalid definitions keep the current ones
+	if err := p.Reload([]InterpretableDefinition{{CheckExpression: "req_method =="}}); err != internal.ErrParsing {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := call("POST"); err != nil {
+		t.Errorf("unexpected error after the failed reload: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			call("POST")
+		}()
+		go func(i int) {
+			defer wg.Done()
+			p.Reload([]InterpretableDefinition{{CheckExpression: "req_method != method", RejectMessage: string(rune('a' + i))}})
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestNewReloadableProxy_invalid(t *testing.T) {
+	if _, err := NewReloadableProxy(logging.NoOp, &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: []internal.InterpretableDefinition{
+			{CheckExpression: "req_method =="},
+		}},
+	}, proxy.NoopProxy); err != internal.ErrParsing {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, e := range []config.ExtraConfig{
+		{},
+		{internal.Namespace: "req_method == 'GET'"},
+		{internal.Namespace: map[string]interface{}{"definitions": 42}},
+	} {
+		if _, err := NewReloadableProxy(logging.NoOp, &config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: e,
+		}, proxy.NoopProxy); err != errNoConfig {
+			t.Errorf("unexpected error with %v: %v", e, err)
+		}
+	}
+}
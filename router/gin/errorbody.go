@@ -0,0 +1,36 @@
+package gin
+
+import (
+	"github.com/gin-gonic/gin"
+
+	cel "github.com/devopsfaith/krakend-cel"
+)
+
+// ErrorStatus returns the middleware completing the error bodies of the rejections. The endpoint
+// handlers render the responses returned with an error using the status reported by the writer,
+// so it reports the code of the cel.CheckError, if any, instead. Building it enables the
+// error_body of the pipes (see cel.RegisterErrorStatus), so it must be built before the factories
+// build them
+func ErrorStatus() gin.HandlerFunc {
+	cel.RegisterErrorStatus()
+	return func(c *gin.Context) {
+		c.Writer = &errorStatusWriter{ResponseWriter: c.Writer, c: c}
+		c.Next()
+	}
+}
+
+type errorStatusWriter struct {
+	gin.ResponseWriter
+	c *gin.Context
+}
+
+func (w *errorStatusWriter) Status() int {
+	if !w.Written() {
+		for _, e := range w.c.Errors {
+			if status, ok := cel.RejectionStatus(e.Err); ok {
+				return status
+			}
+		}
+	}
+	return w.ResponseWriter.Status()
+}
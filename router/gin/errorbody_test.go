@@ -0,0 +1,58 @@
+package gin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	krakendgin "github.com/devopsfaith/krakend/router/gin"
+	"github.com/gin-gonic/gin"
+
+	cel "github.com/devopsfaith/krakend-cel"
+)
+
+func TestErrorStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/private",
+		Method:   "GET",
+		Timeout:  time.Second,
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"error_body": map[string]interface{}{},
+				"definitions": []internal.InterpretableDefinition{
+					{
+						CheckExpression: "'Authorization' in req_headers",
+						RejectMessage:   "missing credentials",
+						StatusCode:      http.StatusUnauthorized,
+					},
+				},
+			},
+		},
+	}
+	middleware := ErrorStatus()
+	prxy, err := cel.ProxyFactory(logging.NoOp, proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	})).New(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine := gin.New()
+	engine.Use(middleware)
+	engine.GET("/private", krakendgin.EndpointHandler(endpoint, prxy))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/private", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status code: %d", w.Code)
+	}
+	if body := w.Body.String(); body != `{"error":{"code":401,"message":"missing credentials"}}` {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
@@ -0,0 +1,23 @@
+// Package gin adapts the errors of the CEL checks to the gin router
+package gin
+
+import (
+	"github.com/gin-gonic/gin"
+
+	cel "github.com/devopsfaith/krakend-cel"
+)
+
+// Redirect returns the middleware completing the redirections of the pre checks. The endpoint
+// handlers only set the status code of the errors, so it adds the Location header of the
+// cel.RedirectError, if any, before the response is written
+func Redirect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		for _, e := range c.Errors {
+			if r, ok := e.Err.(cel.RedirectError); ok {
+				c.Header("Location", r.Location)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package gin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	krakendgin "github.com/devopsfaith/krakend/router/gin"
+	"github.com/gin-gonic/gin"
+
+	cel "github.com/devopsfaith/krakend-cel"
+)
+
+func TestRedirect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/private",
+		Method:   "GET",
+		Timeout:  time.Second,
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{
+					CheckExpression:    "'Authorization' in req_headers",
+					RedirectExpression: "'https://login.example.com/?next=' + endpoint",
+				},
+			},
+		},
+	}
+	prxy, err := cel.ProxyFactory(logging.NoOp, proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	})).New(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine := gin.New()
+	engine.Use(Redirect())
+	engine.GET("/private", krakendgin.EndpointHandler(endpoint, prxy))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/private", nil))
+	if w.Code != http.StatusFound {
+		t.Errorf("unexpected status code: %d", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "https://login.example.com/?next=/private" {
+		t.Errorf("unexpected location: %s", location)
+	}
+}
@@ -0,0 +1,67 @@
+package cel
+
+import (
+	"context"
+	"sync"
+)
+
+// Names and attributes of the spans wrapping the evaluation of the phases
+const (
+	SpanPre  = "cel.pre"
+	SpanPost = "cel.post"
+
+	AttrPipe       = "cel.pipe"
+	AttrEvaluators = "cel.evaluators"
+	AttrOutcome    = "cel.outcome"
+)
+
+// Tracer starts the spans wrapping the evaluation of the pre and post phases. It receives the
+// context of the request, so the spans can be created as children of the one started by the
+// tracing middleware of the gateway. Implementations must be safe for concurrent use
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is the subset of the span operations used by the module
+type Span interface {
+	SetAttribute(key string, value interface{})
+	// SetError marks the span as failed
+	SetError(msg string)
+	End()
+}
+
+// SetTracer wires the tracer of the evaluations. Until a tracer is set, no span is created
+func SetTracer(t Tracer) {
+	tracerMu.Lock()
+	tracer = t
+	tracerMu.Unlock()
+}
+
+// tracePhase runs f inside a span with the name of the phase, recording the outcome of the phase
+func tracePhase(ctx context.Context, phase, pipe string, evaluators int, f func(context.Context) error) error {
+	tracerMu.RLock()
+	t := tracer
+	tracerMu.RUnlock()
+	if t == nil || evaluators == 0 {
+		return f(ctx)
+	}
+
+	ctx, span := t.Start(ctx, phase)
+	defer span.End()
+	span.SetAttribute(AttrPipe, pipe)
+	span.SetAttribute(AttrEvaluators, evaluators)
+
+	err := f(ctx)
+	if err != nil {
+		span.SetAttribute(AttrOutcome, OutcomeReject)
+		span.SetError(err.Error())
+		return err
+	}
+	span.SetAttribute(AttrOutcome, OutcomePass)
+	return nil
+}
+
+var (
+	tracerMu sync.RWMutex
+	tracer   Tracer
+)
@@ -0,0 +1,87 @@
+package cel
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/devopsfaith/krakend-cel/internal"
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+type ctxKey string
+
+func TestProxyFactory_tracing(t *testing.T) {
+	tr := &memoryTracer{}
+	SetTracer(tr)
+	defer SetTracer(nil)
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(&proxy.Response{IsComplete: true})).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_method == 'GET'", RejectMessage: "only GET"},
+				{ModExpression: "req_method", Header: "X-Method"},
+				{CheckExpression: "resp_completed"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx := context.WithValue(context.Background(), ctxKey("parent"), "span-0")
+	for _, method := range []string{"GET", "POST"} {
+		prxy(ctx, &proxy.Request{Method: method, Path: "/some-path", Headers: map[string][]string{}})
+	}
+
+	expected := []memorySpan{
+		{name: SpanPre, parent: "span-0", ended: true, attrs: map[string]interface{}{AttrPipe: "proxy /", AttrEvaluators: 2, AttrOutcome: OutcomePass}},
+		{name: SpanPost, parent: "span-0", ended: true, attrs: map[string]interface{}{AttrPipe: "proxy /", AttrEvaluators: 1, AttrOutcome: OutcomePass}},
+		{name: SpanPre, parent: "span-0", ended: true, err: "only GET", attrs: map[string]interface{}{AttrPipe: "proxy /", AttrEvaluators: 2, AttrOutcome: OutcomeReject}},
+	}
+	if len(tr.spans) != len(expected) {
+		t.Errorf("unexpected spans: %+v", tr.spans)
+		return
+	}
+	for i, s := range tr.spans {
+		e := expected[i]
+		if s.name != e.name || s.parent != e.parent || s.ended != e.ended || s.err != e.err {
+			t.Errorf("span #%d: unexpected span %+v", i, *s)
+		}
+		for k, v := range e.attrs {
+			if s.attrs[k] != v {
+				t.Errorf("span #%d: unexpected attribute %s: %v", i, k, s.attrs[k])
+			}
+		}
+	}
+}
+
+type memoryTracer struct {
+	mu    sync.Mutex
+	spans []*memorySpan
+}
+
+func (m *memoryTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(ctxKey("parent")).(string)
+	s := &memorySpan{name: name, parent: parent, attrs: map[string]interface{}{}}
+	m.mu.Lock()
+	m.spans = append(m.spans, s)
+	m.mu.Unlock()
+	return context.WithValue(ctx, ctxKey("parent"), name), s
+}
+
+type memorySpan struct {
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	err    string
+	ended  bool
+}
+
+func (s *memorySpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *memorySpan) SetError(msg string)                        { s.err = msg }
+func (s *memorySpan) End()                                       { s.ended = true }